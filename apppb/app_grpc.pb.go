@@ -0,0 +1,368 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: app.proto
+
+package apppb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	App_LastLogIndex_FullMethodName        = "/raftd.app.v1.App/LastLogIndex"
+	App_UpdateEntries_FullMethodName       = "/raftd.app.v1.App/UpdateEntries"
+	App_Read_FullMethodName                = "/raftd.app.v1.App/Read"
+	App_Sync_FullMethodName                = "/raftd.app.v1.App/Sync"
+	App_PrepareSnapshot_FullMethodName     = "/raftd.app.v1.App/PrepareSnapshot"
+	App_SaveSnapshot_FullMethodName        = "/raftd.app.v1.App/SaveSnapshot"
+	App_RecoverFromSnapshot_FullMethodName = "/raftd.app.v1.App/RecoverFromSnapshot"
+)
+
+// AppClient is the client API for App service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// App is implemented by the application when APP_PROTOCOL=grpc. It mirrors the HTTP callback API, see the README.
+//
+// Every call carries the raftd-node-id and raftd-replica-id metadata, which identify the shard and replica.
+type AppClient interface {
+	// LastLogIndex returns the index of the last log entry that has been persisted
+	LastLogIndex(ctx context.Context, in *LastLogIndexRequest, opts ...grpc.CallOption) (*LastLogIndexResponse, error)
+	// UpdateEntries persists one or more entries
+	UpdateEntries(ctx context.Context, in *UpdateEntriesRequest, opts ...grpc.CallOption) (*UpdateEntriesResponse, error)
+	// Read serves a linearizable read, relaying the query of /raft/read
+	Read(ctx context.Context, in *ReadRequest, opts ...grpc.CallOption) (*ReadResponse, error)
+	// Sync is called after updates if RAFT_SYNC=1
+	Sync(ctx context.Context, in *SyncRequest, opts ...grpc.CallOption) (*SyncResponse, error)
+	// PrepareSnapshot prepares for a snapshot, returning state that is passed to SaveSnapshot
+	PrepareSnapshot(ctx context.Context, in *PrepareSnapshotRequest, opts ...grpc.CallOption) (*PrepareSnapshotResponse, error)
+	// SaveSnapshot streams a snapshot of the state returned by PrepareSnapshot
+	SaveSnapshot(ctx context.Context, in *SaveSnapshotRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[SnapshotChunk], error)
+	// RecoverFromSnapshot replaces the application's state with a snapshot streamed from SaveSnapshot
+	RecoverFromSnapshot(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[SnapshotChunk, RecoverFromSnapshotResponse], error)
+}
+
+type appClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAppClient(cc grpc.ClientConnInterface) AppClient {
+	return &appClient{cc}
+}
+
+func (c *appClient) LastLogIndex(ctx context.Context, in *LastLogIndexRequest, opts ...grpc.CallOption) (*LastLogIndexResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(LastLogIndexResponse)
+	err := c.cc.Invoke(ctx, App_LastLogIndex_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *appClient) UpdateEntries(ctx context.Context, in *UpdateEntriesRequest, opts ...grpc.CallOption) (*UpdateEntriesResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(UpdateEntriesResponse)
+	err := c.cc.Invoke(ctx, App_UpdateEntries_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *appClient) Read(ctx context.Context, in *ReadRequest, opts ...grpc.CallOption) (*ReadResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ReadResponse)
+	err := c.cc.Invoke(ctx, App_Read_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *appClient) Sync(ctx context.Context, in *SyncRequest, opts ...grpc.CallOption) (*SyncResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(SyncResponse)
+	err := c.cc.Invoke(ctx, App_Sync_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *appClient) PrepareSnapshot(ctx context.Context, in *PrepareSnapshotRequest, opts ...grpc.CallOption) (*PrepareSnapshotResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(PrepareSnapshotResponse)
+	err := c.cc.Invoke(ctx, App_PrepareSnapshot_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *appClient) SaveSnapshot(ctx context.Context, in *SaveSnapshotRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[SnapshotChunk], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &App_ServiceDesc.Streams[0], App_SaveSnapshot_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[SaveSnapshotRequest, SnapshotChunk]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type App_SaveSnapshotClient = grpc.ServerStreamingClient[SnapshotChunk]
+
+func (c *appClient) RecoverFromSnapshot(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[SnapshotChunk, RecoverFromSnapshotResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &App_ServiceDesc.Streams[1], App_RecoverFromSnapshot_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[SnapshotChunk, RecoverFromSnapshotResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type App_RecoverFromSnapshotClient = grpc.ClientStreamingClient[SnapshotChunk, RecoverFromSnapshotResponse]
+
+// AppServer is the server API for App service.
+// All implementations must embed UnimplementedAppServer
+// for forward compatibility.
+//
+// App is implemented by the application when APP_PROTOCOL=grpc. It mirrors the HTTP callback API, see the README.
+//
+// Every call carries the raftd-node-id and raftd-replica-id metadata, which identify the shard and replica.
+type AppServer interface {
+	// LastLogIndex returns the index of the last log entry that has been persisted
+	LastLogIndex(context.Context, *LastLogIndexRequest) (*LastLogIndexResponse, error)
+	// UpdateEntries persists one or more entries
+	UpdateEntries(context.Context, *UpdateEntriesRequest) (*UpdateEntriesResponse, error)
+	// Read serves a linearizable read, relaying the query of /raft/read
+	Read(context.Context, *ReadRequest) (*ReadResponse, error)
+	// Sync is called after updates if RAFT_SYNC=1
+	Sync(context.Context, *SyncRequest) (*SyncResponse, error)
+	// PrepareSnapshot prepares for a snapshot, returning state that is passed to SaveSnapshot
+	PrepareSnapshot(context.Context, *PrepareSnapshotRequest) (*PrepareSnapshotResponse, error)
+	// SaveSnapshot streams a snapshot of the state returned by PrepareSnapshot
+	SaveSnapshot(*SaveSnapshotRequest, grpc.ServerStreamingServer[SnapshotChunk]) error
+	// RecoverFromSnapshot replaces the application's state with a snapshot streamed from SaveSnapshot
+	RecoverFromSnapshot(grpc.ClientStreamingServer[SnapshotChunk, RecoverFromSnapshotResponse]) error
+	mustEmbedUnimplementedAppServer()
+}
+
+// UnimplementedAppServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedAppServer struct{}
+
+func (UnimplementedAppServer) LastLogIndex(context.Context, *LastLogIndexRequest) (*LastLogIndexResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method LastLogIndex not implemented")
+}
+func (UnimplementedAppServer) UpdateEntries(context.Context, *UpdateEntriesRequest) (*UpdateEntriesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateEntries not implemented")
+}
+func (UnimplementedAppServer) Read(context.Context, *ReadRequest) (*ReadResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Read not implemented")
+}
+func (UnimplementedAppServer) Sync(context.Context, *SyncRequest) (*SyncResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Sync not implemented")
+}
+func (UnimplementedAppServer) PrepareSnapshot(context.Context, *PrepareSnapshotRequest) (*PrepareSnapshotResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PrepareSnapshot not implemented")
+}
+func (UnimplementedAppServer) SaveSnapshot(*SaveSnapshotRequest, grpc.ServerStreamingServer[SnapshotChunk]) error {
+	return status.Errorf(codes.Unimplemented, "method SaveSnapshot not implemented")
+}
+func (UnimplementedAppServer) RecoverFromSnapshot(grpc.ClientStreamingServer[SnapshotChunk, RecoverFromSnapshotResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method RecoverFromSnapshot not implemented")
+}
+func (UnimplementedAppServer) mustEmbedUnimplementedAppServer() {}
+func (UnimplementedAppServer) testEmbeddedByValue()             {}
+
+// UnsafeAppServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AppServer will
+// result in compilation errors.
+type UnsafeAppServer interface {
+	mustEmbedUnimplementedAppServer()
+}
+
+func RegisterAppServer(s grpc.ServiceRegistrar, srv AppServer) {
+	// If the following call pancis, it indicates UnimplementedAppServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&App_ServiceDesc, srv)
+}
+
+func _App_LastLogIndex_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LastLogIndexRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AppServer).LastLogIndex(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: App_LastLogIndex_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AppServer).LastLogIndex(ctx, req.(*LastLogIndexRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _App_UpdateEntries_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateEntriesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AppServer).UpdateEntries(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: App_UpdateEntries_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AppServer).UpdateEntries(ctx, req.(*UpdateEntriesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _App_Read_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReadRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AppServer).Read(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: App_Read_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AppServer).Read(ctx, req.(*ReadRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _App_Sync_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SyncRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AppServer).Sync(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: App_Sync_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AppServer).Sync(ctx, req.(*SyncRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _App_PrepareSnapshot_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PrepareSnapshotRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AppServer).PrepareSnapshot(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: App_PrepareSnapshot_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AppServer).PrepareSnapshot(ctx, req.(*PrepareSnapshotRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _App_SaveSnapshot_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SaveSnapshotRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AppServer).SaveSnapshot(m, &grpc.GenericServerStream[SaveSnapshotRequest, SnapshotChunk]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type App_SaveSnapshotServer = grpc.ServerStreamingServer[SnapshotChunk]
+
+func _App_RecoverFromSnapshot_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(AppServer).RecoverFromSnapshot(&grpc.GenericServerStream[SnapshotChunk, RecoverFromSnapshotResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type App_RecoverFromSnapshotServer = grpc.ClientStreamingServer[SnapshotChunk, RecoverFromSnapshotResponse]
+
+// App_ServiceDesc is the grpc.ServiceDesc for App service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var App_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "raftd.app.v1.App",
+	HandlerType: (*AppServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "LastLogIndex",
+			Handler:    _App_LastLogIndex_Handler,
+		},
+		{
+			MethodName: "UpdateEntries",
+			Handler:    _App_UpdateEntries_Handler,
+		},
+		{
+			MethodName: "Read",
+			Handler:    _App_Read_Handler,
+		},
+		{
+			MethodName: "Sync",
+			Handler:    _App_Sync_Handler,
+		},
+		{
+			MethodName: "PrepareSnapshot",
+			Handler:    _App_PrepareSnapshot_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "SaveSnapshot",
+			Handler:       _App_SaveSnapshot_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "RecoverFromSnapshot",
+			Handler:       _App_RecoverFromSnapshot_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "app.proto",
+}
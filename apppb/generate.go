@@ -0,0 +1,4 @@
+// Package apppb contains the gRPC App service that the application implements when APP_PROTOCOL=grpc
+package apppb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative app.proto
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	"github.com/danthegoodman1/raftd/env"
+	"github.com/danthegoodman1/raftd/http_server"
+	"github.com/danthegoodman1/raftd/raft"
+	"gopkg.in/yaml.v3"
+)
+
+const usage = `usage: raftd [--config path] [command]
+
+With no command, raftd starts serving.
+
+Commands:
+  config check                    validate the config and print the effective config
+  export <archive>                write a snapshot of every shard of the raftd running on this host to an archive,
+                                  skipping shards it is a witness of
+  import [--members ids=addrs] <archive>
+                                  seed an empty RAFT_DIR with an archive, with members (default RAFT_INITIAL_MEMBERS)
+                                  as the membership of every shard
+  recover --shard N --members ids=addrs [--archive path] --confirm-data-loss
+                                  UNSAFE: replace the membership of a shard that lost its quorum, keeping the state
+                                  of this replica
+`
+
+// runCommand runs a raftd subcommand, returning the exit code
+func runCommand(configPath string, args []string) int {
+	switch {
+	case len(args) == 2 && args[0] == "config" && args[1] == "check":
+		return configCheck(configPath)
+	case len(args) >= 1 && args[0] == "export":
+		return exportCommand(configPath, args[1:])
+	case len(args) >= 1 && args[0] == "import":
+		return importCommand(configPath, args[1:])
+	case len(args) >= 1 && args[0] == "recover":
+		return recoverCommand(configPath, args[1:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+}
+
+// configCheck prints the effective config and any problems with it
+func configCheck(configPath string) int {
+	c, warnings, err := env.Load(configPath)
+	for _, warning := range warnings {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", warning)
+	}
+	if err == nil {
+		// The raft package reads the loaded config
+		err = raft.CheckConfig()
+	}
+
+	out, marshalErr := yaml.Marshal(c)
+	if marshalErr != nil {
+		fmt.Fprintf(os.Stderr, "error marshaling config: %s\n", marshalErr)
+		return 1
+	}
+	fmt.Print(string(out))
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config is invalid:\n%s\n", err)
+		return 1
+	}
+	fmt.Fprintln(os.Stderr, "config is valid")
+	return 0
+}
+
+// loadConfig loads the config for commands that need a valid one, printing any problems
+func loadConfig(configPath string) bool {
+	_, warnings, err := env.Load(configPath)
+	for _, warning := range warnings {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", warning)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config is invalid:\n%s\n", err)
+		return false
+	}
+	return true
+}
+
+// exportCommand exports a snapshot of every shard from the raftd running on this host, and writes them to an
+// archive. The snapshots are exported to RAFT_DIR, so it must run on the same host as raftd.
+func exportCommand(configPath string, args []string) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+	if !loadConfig(configPath) {
+		return 1
+	}
+
+	if err := exportArchive(context.Background(), flags.Arg(0)); err != nil {
+		fmt.Fprintf(os.Stderr, "export failed: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+func exportArchive(ctx context.Context, archivePath string) error {
+	client := newLocalRaftdClient()
+
+	var memberships []raft.Membership
+	if err := client.do(ctx, http.MethodGet, "/raft/membership", nil, &memberships); err != nil {
+		return fmt.Errorf("error listing shards: %w", err)
+	}
+
+	exportDir, err := raft.NewArchiveExportDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(exportDir)
+
+	snapshotIndexes := map[uint64]uint64{}
+	for _, membership := range memberships {
+		if membership.Error != "" {
+			return fmt.Errorf("error getting membership of shard %d: %s", membership.ShardID, membership.Error)
+		}
+		if slices.ContainsFunc(membership.Witnesses, func(member raft.Member) bool { return member.ReplicaID == env.Current.ReplicaID }) {
+			fmt.Fprintf(os.Stderr, "warning: skipping shard %d, this replica is a witness of it and has no state to export\n", membership.ShardID)
+			continue
+		}
+		shardDir := raft.ArchiveShardExportDir(exportDir, membership.ShardID)
+		if err := os.Mkdir(shardDir, 0755); err != nil {
+			return fmt.Errorf("error in os.Mkdir: %w", err)
+		}
+
+		query := url.Values{
+			"shard":  {strconv.FormatUint(membership.ShardID, 10)},
+			"export": {shardDir},
+		}
+		var res http_server.CreateSnapshotResponse
+		if err := client.do(ctx, http.MethodPost, "/raft/snapshot", query, &res); err != nil {
+			return fmt.Errorf("error exporting shard %d: %w", membership.ShardID, err)
+		}
+		snapshotIndexes[membership.ShardID] = res.Index
+	}
+	if len(snapshotIndexes) == 0 {
+		return fmt.Errorf("replica %d has no shards with a state machine to export", env.Current.ReplicaID)
+	}
+
+	// Write next to the archive, so it is only replaced once complete
+	f, err := os.CreateTemp(filepath.Dir(archivePath), filepath.Base(archivePath)+".tmp")
+	if err != nil {
+		return fmt.Errorf("error in os.CreateTemp: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	manifest, err := raft.WriteArchive(f, exportDir, snapshotIndexes)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("error in f.Sync: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error in f.Close: %w", err)
+	}
+	if err := os.Rename(f.Name(), archivePath); err != nil {
+		return fmt.Errorf("error in os.Rename: %w", err)
+	}
+
+	for _, shard := range manifest.Shards {
+		fmt.Fprintf(os.Stderr, "exported shard %d at index %d\n", shard.ShardID, shard.Index)
+	}
+	fmt.Fprintf(os.Stderr, "wrote %s\n", archivePath)
+	return nil
+}
+
+// importCommand seeds a fresh RAFT_DIR with an archive. raftd must not be running.
+func importCommand(configPath string, args []string) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	rawMembers := flags.String("members", "", "the membership of every imported shard as replicaID=addr pairs, defaults to RAFT_INITIAL_MEMBERS")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+	if !loadConfig(configPath) {
+		return 1
+	}
+
+	if *rawMembers == "" {
+		*rawMembers = env.Current.RaftInitialMembers
+	}
+	members, witnesses, err := env.ParseMembers(*rawMembers)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid members: %s\n", err)
+		return 2
+	}
+	if len(witnesses) > 0 {
+		fmt.Fprintln(os.Stderr, "invalid members: witnesses can not be imported, recruit them once the shards are running")
+		return 2
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error opening archive: %s\n", err)
+		return 1
+	}
+	defer f.Close()
+
+	manifest, err := raft.ImportArchive(f, members)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import failed: %s\n", err)
+		return 1
+	}
+	for _, shard := range manifest.Shards {
+		fmt.Fprintf(os.Stderr, "imported shard %d at index %d\n", shard.ShardID, shard.Index)
+	}
+	fmt.Fprintf(os.Stderr, "imported the archive of replica %d from %s, start raftd to join the new membership\n", manifest.ReplicaID, manifest.CreatedAt)
+	return 0
+}
+
+const recoverWarning = `raftd recover forcibly replaces the membership of a shard that lost its quorum, keeping the
+state of this replica. It is UNSAFE:
+  - anything the shard committed that this replica did not apply is lost
+  - every other former member of the shard must be permanently stopped, and never started again with its data
+  - raftd must be stopped on this replica, and the application must be running
+Run it again with --confirm-data-loss to recover.
+`
+
+// recoverCommand recovers a shard that lost its quorum from this replica. raftd must not be running.
+func recoverCommand(configPath string, args []string) int {
+	flags := flag.NewFlagSet("recover", flag.ContinueOnError)
+	shardID := flags.Uint64("shard", 0, "the shard to recover")
+	rawMembers := flags.String("members", "", "the new membership of the shard as replicaID=addr pairs, including this replica")
+	archivePath := flags.String("archive", "", "write the recovered state to an archive, for the other new members to import")
+	confirmed := flags.Bool("confirm-data-loss", false, "confirm the recovery, which may lose committed data")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 0 || *rawMembers == "" {
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+	if !*confirmed {
+		fmt.Fprint(os.Stderr, recoverWarning)
+		return 2
+	}
+	if !loadConfig(configPath) {
+		return 1
+	}
+
+	members, witnesses, err := env.ParseMembers(*rawMembers)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid members: %s\n", err)
+		return 2
+	}
+	if len(witnesses) > 0 {
+		fmt.Fprintln(os.Stderr, "invalid members: witnesses can not be recovered to, recruit them once the shard is running")
+		return 2
+	}
+
+	if err := recoverShard(*shardID, members, *archivePath); err != nil {
+		fmt.Fprintf(os.Stderr, "recover failed: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+func recoverShard(shardID uint64, members map[uint64]string, archivePath string) error {
+	var archive *os.File
+	if archivePath != "" {
+		var err error
+		if archive, err = os.OpenFile(archivePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644); err != nil {
+			return fmt.Errorf("error creating archive: %w", err)
+		}
+		defer archive.Close()
+	}
+
+	var w io.Writer
+	if archive != nil {
+		w = archive
+	}
+	record, err := raft.RecoverShard(context.Background(), shardID, members, w)
+	if err != nil {
+		if archive != nil {
+			os.Remove(archivePath)
+		}
+		return err
+	}
+	if archive != nil {
+		if err := archive.Sync(); err != nil {
+			return fmt.Errorf("error in archive.Sync: %w", err)
+		}
+		if err := archive.Close(); err != nil {
+			return fmt.Errorf("error in archive.Close: %w", err)
+		}
+		fmt.Fprintf(os.Stderr, "wrote %s, run raftd import with the same members on the other new members\n", archivePath)
+	}
+
+	fmt.Fprintf(os.Stderr, "recovered shard %d at index %d (term %d), start raftd to run it with the new membership\n", record.ShardID, record.Index, record.Term)
+	return nil
+}
+
+// localRaftdClient calls the HTTP API of the raftd running on this host, at HTTP_LISTEN_ADDR
+type localRaftdClient struct {
+	client *http.Client
+}
+
+func newLocalRaftdClient() *localRaftdClient {
+	network, addr := env.ListenNetwork(env.Current.HTTPListenAddr)
+	if network == "tcp" {
+		// Listening on all interfaces includes localhost
+		if host, port, err := net.SplitHostPort(addr); err == nil && (host == "" || net.ParseIP(host).IsUnspecified()) {
+			addr = net.JoinHostPort("localhost", port)
+		}
+	}
+
+	dialer := &net.Dialer{}
+	return &localRaftdClient{
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, network, addr)
+				},
+			},
+		},
+	}
+}
+
+// do makes a request, decoding the JSON response into res. The server bounds how long requests take.
+func (c *localRaftdClient) do(ctx context.Context, method, path string, query url.Values, res any) error {
+	u := url.URL{Scheme: "http", Host: "raftd", Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("error in http.NewRequestWithContext: %w", err)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error in client.Do: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading response body: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s returned %d: %s", method, path, resp.StatusCode, body)
+	}
+	if err := json.Unmarshal(body, res); err != nil {
+		return fmt.Errorf("error unmarshaling response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package env
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const unixScheme = "unix://"
+
+// AppURL is a parsed APP_URL
+type AppURL struct {
+	// BaseURL is prepended to callback paths. For unix sockets it uses a placeholder host.
+	BaseURL string
+	// SocketPath is set if the application listens on a unix socket
+	SocketPath string
+}
+
+// ParseAppURL parses an http(s) URL, or a unix socket URL like unix:///var/run/app.sock with an optional path
+// prefix after a colon, like unix:///var/run/app.sock:/api
+func ParseAppURL(s string) (AppURL, error) {
+	if socket, isUnix := strings.CutPrefix(s, unixScheme); isUnix {
+		socketPath, prefix, _ := strings.Cut(socket, ":")
+		if socketPath == "" {
+			return AppURL{}, fmt.Errorf("'%s' is missing the socket path", s)
+		}
+		if prefix != "" && !strings.HasPrefix(prefix, "/") {
+			return AppURL{}, fmt.Errorf("'%s' path prefix must start with /", s)
+		}
+		return AppURL{
+			BaseURL:    "http://unix" + strings.TrimSuffix(prefix, "/"),
+			SocketPath: socketPath,
+		}, nil
+	}
+
+	parsed, err := url.Parse(s)
+	if err != nil {
+		return AppURL{}, err
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return AppURL{}, fmt.Errorf("'%s' must be an http(s) URL with a host, or a unix:// socket", s)
+	}
+
+	return AppURL{BaseURL: strings.TrimSuffix(s, "/")}, nil
+}
+
+// ListenNetwork returns the network and address to listen on for a host:port or unix:///path/to.sock address
+func ListenNetwork(addr string) (network, address string) {
+	if socketPath, isUnix := strings.CutPrefix(addr, unixScheme); isUnix {
+		return "unix", socketPath
+	}
+	return "tcp", addr
+}
@@ -0,0 +1,502 @@
+package env
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the full raftd configuration. It is loaded from an optional YAML or TOML config file, and env vars
+// override anything set in the file. File keys are the lowercased env var names (e.g. app_url for APP_URL).
+type Config struct {
+	Env                  string `env:"ENV" yaml:"env" toml:"env"`
+	TracingServiceName   string `env:"TRACING_SERVICE_NAME" yaml:"tracing_service_name" toml:"tracing_service_name"`
+	OLTPEndpoint         string `env:"OLTP_ENDPOINT" yaml:"oltp_endpoint" toml:"oltp_endpoint"`
+	HTTPListenAddr       string `env:"HTTP_LISTEN_ADDR" yaml:"http_listen_addr" toml:"http_listen_addr"`
+	RaftListenAddr       string `env:"RAFT_LISTEN_ADDR" yaml:"raft_listen_addr" toml:"raft_listen_addr"`
+	MetricsAPIListenAddr string `env:"METRICS_LISTEN_ADDR" yaml:"metrics_listen_addr" toml:"metrics_listen_addr"`
+
+	// RaftInitialMembers is a csv of id=addr pairs like 1=localhost:6000,2=localhost:6001,3w=localhost:6002
+	RaftInitialMembers string `env:"RAFT_INITIAL_MEMBERS" yaml:"raft_initial_members" toml:"raft_initial_members"`
+
+	// ApplicationURL is where the application can be reached
+	ApplicationURL       string `env:"APP_URL" yaml:"app_url" toml:"app_url"`
+	ReplicaID            uint64 `env:"REPLICA_ID" yaml:"replica_id" toml:"replica_id"`
+	RaftSync             bool   `env:"RAFT_SYNC" yaml:"raft_sync" toml:"raft_sync"`
+	PromoteMaxLag        uint64 `env:"PROMOTE_MAX_LAG" yaml:"promote_max_lag" toml:"promote_max_lag"`                // max entries a non-voting replica can be behind to be promoted
+	RaftJoinNonVoting    bool   `env:"RAFT_JOIN_NON_VOTING" yaml:"raft_join_non_voting" toml:"raft_join_non_voting"` // join shards as a non-voting replica, to be promoted later
+	RaftStorageDirectory string `env:"RAFT_DIR" yaml:"raft_dir" toml:"raft_dir"`
+
+	// Timeouts for application callbacks, 0 disables the timeout
+	AppOpenTimeoutMs            int64 `env:"APP_OPEN_TIMEOUT_MS" yaml:"app_open_timeout_ms" toml:"app_open_timeout_ms"`
+	AppUpdateTimeoutMs          int64 `env:"APP_UPDATE_TIMEOUT_MS" yaml:"app_update_timeout_ms" toml:"app_update_timeout_ms"`
+	AppReadTimeoutMs            int64 `env:"APP_READ_TIMEOUT_MS" yaml:"app_read_timeout_ms" toml:"app_read_timeout_ms"`
+	AppSyncTimeoutMs            int64 `env:"APP_SYNC_TIMEOUT_MS" yaml:"app_sync_timeout_ms" toml:"app_sync_timeout_ms"`
+	AppPrepareSnapshotTimeoutMs int64 `env:"APP_PREPARE_SNAPSHOT_TIMEOUT_MS" yaml:"app_prepare_snapshot_timeout_ms" toml:"app_prepare_snapshot_timeout_ms"`
+	// Snapshots are streamed, so these are the max time without any bytes being transferred
+	AppSaveSnapshotIdleTimeoutSec    int64 `env:"APP_SAVE_SNAPSHOT_IDLE_TIMEOUT_SEC" yaml:"app_save_snapshot_idle_timeout_sec" toml:"app_save_snapshot_idle_timeout_sec"`
+	AppRecoverSnapshotIdleTimeoutSec int64 `env:"APP_RECOVER_SNAPSHOT_IDLE_TIMEOUT_SEC" yaml:"app_recover_snapshot_idle_timeout_sec" toml:"app_recover_snapshot_idle_timeout_sec"`
+
+	// Transport shared by every shard for requests to the application
+	AppProtocol             string `env:"APP_PROTOCOL" yaml:"app_protocol" toml:"app_protocol"` // http1, h2c, or grpc
+	AppMaxIdleConns         int64  `env:"APP_MAX_IDLE_CONNS" yaml:"app_max_idle_conns" toml:"app_max_idle_conns"`
+	AppMaxConnsPerHost      int64  `env:"APP_MAX_CONNS_PER_HOST" yaml:"app_max_conns_per_host" toml:"app_max_conns_per_host"`             // 0 is unlimited
+	AppMaxConcurrentStreams int64  `env:"APP_MAX_CONCURRENT_STREAMS" yaml:"app_max_concurrent_streams" toml:"app_max_concurrent_streams"` // max in flight requests, 0 is unlimited
+	AppIdleConnTimeoutSec   int64  `env:"APP_IDLE_CONN_TIMEOUT_SEC" yaml:"app_idle_conn_timeout_sec" toml:"app_idle_conn_timeout_sec"`
+	AppKeepAliveSec         int64  `env:"APP_KEEPALIVE_SEC" yaml:"app_keepalive_sec" toml:"app_keepalive_sec"`
+	AppUpdateEncoding       string `env:"APP_UPDATE_ENCODING" yaml:"app_update_encoding" toml:"app_update_encoding"` // json or binary, for /UpdateEntries over HTTP
+
+	// Retry budgets for idempotent application callbacks, -1 retries forever (pausing the shard while the app is down)
+	AppOpenMaxRetries            int64 `env:"APP_OPEN_MAX_RETRIES" yaml:"app_open_max_retries" toml:"app_open_max_retries"`
+	AppUpdateMaxRetries          int64 `env:"APP_UPDATE_MAX_RETRIES" yaml:"app_update_max_retries" toml:"app_update_max_retries"`
+	AppReadMaxRetries            int64 `env:"APP_READ_MAX_RETRIES" yaml:"app_read_max_retries" toml:"app_read_max_retries"`
+	AppSyncMaxRetries            int64 `env:"APP_SYNC_MAX_RETRIES" yaml:"app_sync_max_retries" toml:"app_sync_max_retries"`
+	AppPrepareSnapshotMaxRetries int64 `env:"APP_PREPARE_SNAPSHOT_MAX_RETRIES" yaml:"app_prepare_snapshot_max_retries" toml:"app_prepare_snapshot_max_retries"`
+	AppRetryBaseDelayMs          int64 `env:"APP_RETRY_BASE_DELAY_MS" yaml:"app_retry_base_delay_ms" toml:"app_retry_base_delay_ms"`
+	AppRetryMaxDelayMs           int64 `env:"APP_RETRY_MAX_DELAY_MS" yaml:"app_retry_max_delay_ms" toml:"app_retry_max_delay_ms"`
+	AppBreakerFailureThreshold   int64 `env:"APP_BREAKER_FAILURE_THRESHOLD" yaml:"app_breaker_failure_threshold" toml:"app_breaker_failure_threshold"` // 0 disables the circuit breaker
+	AppBreakerCooldownMs         int64 `env:"APP_BREAKER_COOLDOWN_MS" yaml:"app_breaker_cooldown_ms" toml:"app_breaker_cooldown_ms"`
+
+	// Async proposals, see POST /raft/update?async=1
+	AsyncProposalTimeoutSec   int64 `env:"ASYNC_PROPOSAL_TIMEOUT_SEC" yaml:"async_proposal_timeout_sec" toml:"async_proposal_timeout_sec"`
+	AsyncProposalMaxResults   int64 `env:"ASYNC_PROPOSAL_MAX_RESULTS" yaml:"async_proposal_max_results" toml:"async_proposal_max_results"` // max tracked proposals, pending or finished
+	AsyncProposalResultTTLSec int64 `env:"ASYNC_PROPOSAL_RESULT_TTL_SEC" yaml:"async_proposal_result_ttl_sec" toml:"async_proposal_result_ttl_sec"`
+
+	SnapshotRequestTimeoutSec int64 `env:"SNAPSHOT_REQUEST_TIMEOUT_SEC" yaml:"snapshot_request_timeout_sec" toml:"snapshot_request_timeout_sec"` // for POST and GET /raft/snapshot
+
+	ReadinessPolicy string `env:"READINESS_POLICY" yaml:"readiness_policy" toml:"readiness_policy"` // all, any, or shards
+	ReadinessShards string `env:"READINESS_SHARDS" yaml:"readiness_shards" toml:"readiness_shards"` // csv of shard IDs required when READINESS_POLICY=shards
+
+	LeaderBalanceIntervalSec int64  `env:"LEADER_BALANCE_INTERVAL_SEC" yaml:"leader_balance_interval_sec" toml:"leader_balance_interval_sec"` // 0 disables the leader balancer
+	LeaderBalanceCooldownSec int64  `env:"LEADER_BALANCE_COOLDOWN_SEC" yaml:"leader_balance_cooldown_sec" toml:"leader_balance_cooldown_sec"`
+	LeaderBalanceWeights     string `env:"LEADER_BALANCE_WEIGHTS" yaml:"leader_balance_weights" toml:"leader_balance_weights"` // csv of replicaID=weight pairs like 1=2,2=1,3=1
+
+	// Raft defaults for every shard, see dragonboat's config.Config. Shards can override these when created.
+	RaftElectionRTT            uint64 `env:"RAFT_ELECTION_RTT" yaml:"raft_election_rtt" toml:"raft_election_rtt"`
+	RaftHeartbeatRTT           uint64 `env:"RAFT_HEARTBEAT_RTT" yaml:"raft_heartbeat_rtt" toml:"raft_heartbeat_rtt"`
+	RaftCheckQuorum            bool   `env:"RAFT_CHECK_QUORUM" yaml:"raft_check_quorum" toml:"raft_check_quorum"`
+	RaftPreVote                bool   `env:"RAFT_PRE_VOTE" yaml:"raft_pre_vote" toml:"raft_pre_vote"`
+	RaftSnapshotEntries        uint64 `env:"RAFT_SNAPSHOT_ENTRIES" yaml:"raft_snapshot_entries" toml:"raft_snapshot_entries"` // 0 disables automatic snapshots
+	RaftCompactionOverhead     uint64 `env:"RAFT_COMPACTION_OVERHEAD" yaml:"raft_compaction_overhead" toml:"raft_compaction_overhead"`
+	RaftOrderedConfigChange    bool   `env:"RAFT_ORDERED_CONFIG_CHANGE" yaml:"raft_ordered_config_change" toml:"raft_ordered_config_change"`
+	RaftMaxInMemLogSize        uint64 `env:"RAFT_MAX_IN_MEM_LOG_SIZE" yaml:"raft_max_in_mem_log_size" toml:"raft_max_in_mem_log_size"`    // bytes, 0 is unlimited
+	RaftSnapshotCompression    string `env:"RAFT_SNAPSHOT_COMPRESSION" yaml:"raft_snapshot_compression" toml:"raft_snapshot_compression"` // none or snappy
+	RaftEntryCompression       string `env:"RAFT_ENTRY_COMPRESSION" yaml:"raft_entry_compression" toml:"raft_entry_compression"`          // none or snappy
+	RaftDisableAutoCompactions bool   `env:"RAFT_DISABLE_AUTO_COMPACTIONS" yaml:"raft_disable_auto_compactions" toml:"raft_disable_auto_compactions"`
+	RaftQuiesce                bool   `env:"RAFT_QUIESCE" yaml:"raft_quiesce" toml:"raft_quiesce"`
+
+	// NodeHost settings, see dragonboat's config.NodeHostConfig
+	RaftRTTMillisecond      uint64 `env:"RAFT_RTT_MS" yaml:"raft_rtt_ms" toml:"raft_rtt_ms"`
+	RaftDeploymentID        uint64 `env:"RAFT_DEPLOYMENT_ID" yaml:"raft_deployment_id" toml:"raft_deployment_id"`
+	RaftWALDirectory        string `env:"RAFT_WAL_DIR" yaml:"raft_wal_dir" toml:"raft_wal_dir"` // defaults to the replica's directory in RAFT_DIR
+	RaftMutualTLS           bool   `env:"RAFT_MUTUAL_TLS" yaml:"raft_mutual_tls" toml:"raft_mutual_tls"`
+	RaftCAFile              string `env:"RAFT_CA_FILE" yaml:"raft_ca_file" toml:"raft_ca_file"`
+	RaftCertFile            string `env:"RAFT_CERT_FILE" yaml:"raft_cert_file" toml:"raft_cert_file"`
+	RaftKeyFile             string `env:"RAFT_KEY_FILE" yaml:"raft_key_file" toml:"raft_key_file"`
+	RaftMaxSendQueueSize    uint64 `env:"RAFT_MAX_SEND_QUEUE_SIZE" yaml:"raft_max_send_queue_size" toml:"raft_max_send_queue_size"`          // bytes, 0 is unlimited
+	RaftMaxReceiveQueueSize uint64 `env:"RAFT_MAX_RECEIVE_QUEUE_SIZE" yaml:"raft_max_receive_queue_size" toml:"raft_max_receive_queue_size"` // bytes, 0 is unlimited
+}
+
+var (
+	ErrInvalidConfig  = errors.New("invalid config")
+	ErrInvalidMembers = errors.New("invalid raft initial members")
+
+	// legacyEnvVars maps env var names that used to be documented to their current names
+	legacyEnvVars = map[string]string{
+		"NODE_ID":    "REPLICA_ID",
+		"RAFT_PEERS": "RAFT_INITIAL_MEMBERS",
+	}
+
+	// otherEnvVars are read outside of Config, e.g. by the logger
+	otherEnvVars = []string{"DEBUG", "TRACE", "PRETTY", "LOG_TIME_MS", "RAFTD_CONFIG"}
+
+	// envVarPrefixes are the prefixes of raftd env vars, used to spot misspelled ones
+	envVarPrefixes = []string{"RAFT", "APP_", "HTTP_", "METRICS_", "REPLICA_", "PROMOTE_", "READINESS_", "LEADER_BALANCE_", "TRACING_", "OLTP_", "ASYNC_PROPOSAL_", "SNAPSHOT_"}
+)
+
+// Default returns the config used when nothing is set
+func Default() Config {
+	return Config{
+		HTTPListenAddr:       ":9090",
+		RaftListenAddr:       "0.0.0.0:9091",
+		MetricsAPIListenAddr: ":9092",
+		ApplicationURL:       "http://localhost:8080",
+		PromoteMaxLag:        100,
+		RaftStorageDirectory: "_raft",
+
+		AppOpenTimeoutMs:                 1000,
+		AppUpdateTimeoutMs:               1000,
+		AppReadTimeoutMs:                 1000,
+		AppSyncTimeoutMs:                 1000,
+		AppPrepareSnapshotTimeoutMs:      1000,
+		AppSaveSnapshotIdleTimeoutSec:    60,
+		AppRecoverSnapshotIdleTimeoutSec: 60,
+
+		AppProtocol:           "http1",
+		AppMaxIdleConns:       100,
+		AppIdleConnTimeoutSec: 90,
+		AppKeepAliveSec:       30,
+		AppUpdateEncoding:     "json",
+
+		AppOpenMaxRetries:            -1,
+		AppUpdateMaxRetries:          -1,
+		AppReadMaxRetries:            2,
+		AppSyncMaxRetries:            -1,
+		AppPrepareSnapshotMaxRetries: 3,
+		AppRetryBaseDelayMs:          50,
+		AppRetryMaxDelayMs:           5000,
+		AppBreakerFailureThreshold:   5,
+		AppBreakerCooldownMs:         5000,
+		AsyncProposalTimeoutSec:      60,
+		AsyncProposalMaxResults:      10000,
+		AsyncProposalResultTTLSec:    300,
+		SnapshotRequestTimeoutSec:    600,
+		ReadinessPolicy:              "all",
+		LeaderBalanceIntervalSec:     30,
+		LeaderBalanceCooldownSec:     60,
+
+		RaftElectionRTT:         10,
+		RaftHeartbeatRTT:        1,
+		RaftCheckQuorum:         true,
+		RaftSnapshotEntries:     1000,
+		RaftCompactionOverhead:  5,
+		RaftSnapshotCompression: "none",
+		RaftEntryCompression:    "none",
+
+		RaftRTTMillisecond: 3,
+	}
+}
+
+// Load builds the effective config from the defaults, the config file at path (if not empty), and env vars, in
+// increasing order of precedence. On success Current is set to it. The returned warnings should be shown to the
+// operator, e.g. for unknown or legacy names.
+func Load(path string) (Config, []string, error) {
+	c := Default()
+	var warnings []string
+
+	if path != "" {
+		fileWarnings, err := c.loadFile(path)
+		if err != nil {
+			return c, warnings, err
+		}
+		warnings = append(warnings, fileWarnings...)
+	}
+
+	envWarnings, err := c.applyEnv()
+	warnings = append(warnings, envWarnings...)
+	if err != nil {
+		return c, warnings, err
+	}
+
+	if err := c.Validate(); err != nil {
+		return c, warnings, err
+	}
+
+	Current = &c
+	return c, warnings, nil
+}
+
+// loadFile decodes a YAML (.yaml, .yml) or TOML (.toml) config file into c
+func (c *Config) loadFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %w", err)
+	}
+
+	var warnings []string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, c); err != nil {
+			return nil, fmt.Errorf("%w: error parsing %s: %w", ErrInvalidConfig, path, err)
+		}
+		// yaml.v3 can only reject unknown keys, so find them ourselves to warn instead
+		var keys map[string]any
+		if err := yaml.Unmarshal(data, &keys); err != nil {
+			return nil, fmt.Errorf("%w: error parsing %s: %w", ErrInvalidConfig, path, err)
+		}
+		known := fileKeys()
+		for key := range keys {
+			if !slices.Contains(known, key) {
+				warnings = append(warnings, unknownFileKeyWarning(path, key))
+			}
+		}
+	case ".toml":
+		md, err := toml.NewDecoder(bytes.NewReader(data)).Decode(c)
+		if err != nil {
+			return nil, fmt.Errorf("%w: error parsing %s: %w", ErrInvalidConfig, path, err)
+		}
+		for _, key := range md.Undecoded() {
+			warnings = append(warnings, unknownFileKeyWarning(path, key.String()))
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown config file type '%s', must be .yaml, .yml, or .toml", ErrInvalidConfig, filepath.Ext(path))
+	}
+
+	slices.Sort(warnings)
+	return warnings, nil
+}
+
+func unknownFileKeyWarning(path, key string) string {
+	if current, isLegacy := legacyEnvVars[strings.ToUpper(key)]; isLegacy {
+		return fmt.Sprintf("%s: '%s' is not used, did you mean '%s'?", path, key, strings.ToLower(current))
+	}
+	return fmt.Sprintf("%s: unknown config key '%s'", path, key)
+}
+
+// applyEnv overrides c with any env vars that are set. Legacy env var names are used if the current name is not
+// set, and env vars that look like they were meant for raftd but are unknown are warned about.
+func (c *Config) applyEnv() ([]string, error) {
+	var (
+		warnings []string
+		errs     []error
+	)
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Tag.Get("env")
+		raw := os.Getenv(name)
+		if raw == "" {
+			raw = legacyEnvValue(name)
+		}
+		if raw == "" {
+			continue
+		}
+
+		if err := setField(v.Field(i), raw); err != nil {
+			errs = append(errs, fmt.Errorf("%w: %s: %w", ErrInvalidConfig, name, err))
+		}
+	}
+
+	known := EnvVarNames()
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if current, isLegacy := legacyEnvVars[name]; isLegacy {
+			if os.Getenv(current) != "" {
+				warnings = append(warnings, fmt.Sprintf("%s is ignored because %s is set", name, current))
+			} else {
+				warnings = append(warnings, fmt.Sprintf("%s is deprecated, use %s instead", name, current))
+			}
+			continue
+		}
+
+		hasPrefix := slices.ContainsFunc(envVarPrefixes, func(prefix string) bool {
+			return strings.HasPrefix(name, prefix)
+		})
+		if hasPrefix && !slices.Contains(known, name) && !slices.Contains(otherEnvVars, name) {
+			warnings = append(warnings, fmt.Sprintf("unknown env var %s", name))
+		}
+	}
+
+	slices.Sort(warnings)
+	return warnings, errors.Join(errs...)
+}
+
+func legacyEnvValue(name string) string {
+	for legacy, current := range legacyEnvVars {
+		if current == name {
+			return os.Getenv(legacy)
+		}
+	}
+	return ""
+}
+
+func setField(field reflect.Value, raw string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("'%s' is not a bool, use 1 or 0", raw)
+		}
+		field.SetBool(b)
+	case reflect.Int64:
+		i, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("'%s' is not an integer", raw)
+		}
+		field.SetInt(i)
+	case reflect.Uint64:
+		u, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("'%s' is not a non-negative integer", raw)
+		}
+		field.SetUint(u)
+	default:
+		return fmt.Errorf("unsupported config type %s", field.Kind())
+	}
+
+	return nil
+}
+
+// EnvVarNames returns the env var names of every config field
+func EnvVarNames() []string {
+	return tagValues("env")
+}
+
+func fileKeys() []string {
+	return tagValues("yaml")
+}
+
+func tagValues(tag string) []string {
+	t := reflect.TypeOf(Config{})
+	values := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		values = append(values, t.Field(i).Tag.Get(tag))
+	}
+	return values
+}
+
+// Validate checks addresses and the initial members. Raft specific settings are validated by the raft package.
+func (c Config) Validate() error {
+	var errs []error
+	if c.ReplicaID == 0 {
+		errs = append(errs, fmt.Errorf("%w: REPLICA_ID must be >= 1", ErrInvalidConfig))
+	}
+
+	if network, addr := ListenNetwork(c.HTTPListenAddr); network == "unix" {
+		if addr == "" {
+			errs = append(errs, fmt.Errorf("%w: HTTP_LISTEN_ADDR: '%s' is missing the socket path", ErrInvalidConfig, c.HTTPListenAddr))
+		}
+	} else if err := validateAddr(addr, false); err != nil {
+		errs = append(errs, fmt.Errorf("%w: HTTP_LISTEN_ADDR: %w", ErrInvalidConfig, err))
+	}
+	if err := validateAddr(c.MetricsAPIListenAddr, false); err != nil {
+		errs = append(errs, fmt.Errorf("%w: METRICS_LISTEN_ADDR: %w", ErrInvalidConfig, err))
+	}
+	if err := validateAddr(c.RaftListenAddr, true); err != nil {
+		errs = append(errs, fmt.Errorf("%w: RAFT_LISTEN_ADDR: %w", ErrInvalidConfig, err))
+	}
+
+	if appURL, err := ParseAppURL(c.ApplicationURL); err != nil {
+		errs = append(errs, fmt.Errorf("%w: APP_URL: %w", ErrInvalidConfig, err))
+	} else if parsed, _ := url.Parse(appURL.BaseURL); c.AppProtocol == "grpc" && parsed.Path != "" {
+		errs = append(errs, fmt.Errorf("%w: APP_URL: '%s' can not have a path with the grpc protocol", ErrInvalidConfig, c.ApplicationURL))
+	}
+
+	v := reflect.ValueOf(c)
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Tag.Get("env")
+		if !v.Field(i).CanInt() {
+			// Unsigned fields can not be negative
+			continue
+		}
+		switch {
+		case strings.HasSuffix(name, "_MS") || strings.HasSuffix(name, "_SEC") || strings.HasSuffix(name, "_THRESHOLD"):
+			if v.Field(i).Int() < 0 {
+				errs = append(errs, fmt.Errorf("%w: %s must not be negative", ErrInvalidConfig, name))
+			}
+		case strings.HasSuffix(name, "_MAX_RETRIES"):
+			if v.Field(i).Int() < -1 {
+				errs = append(errs, fmt.Errorf("%w: %s must be -1 (retry forever) or more", ErrInvalidConfig, name))
+			}
+		}
+	}
+
+	if c.AppProtocol != "http1" && c.AppProtocol != "h2c" && c.AppProtocol != "grpc" {
+		errs = append(errs, fmt.Errorf("%w: APP_PROTOCOL must be http1, h2c, or grpc", ErrInvalidConfig))
+	}
+	if c.AppUpdateEncoding != "json" && c.AppUpdateEncoding != "binary" {
+		errs = append(errs, fmt.Errorf("%w: APP_UPDATE_ENCODING must be json or binary", ErrInvalidConfig))
+	}
+	for name, value := range map[string]int64{
+		"APP_MAX_IDLE_CONNS":         c.AppMaxIdleConns,
+		"APP_MAX_CONNS_PER_HOST":     c.AppMaxConnsPerHost,
+		"APP_MAX_CONCURRENT_STREAMS": c.AppMaxConcurrentStreams,
+	} {
+		if value < 0 {
+			errs = append(errs, fmt.Errorf("%w: %s must not be negative", ErrInvalidConfig, name))
+		}
+	}
+
+	if c.AsyncProposalTimeoutSec < 1 {
+		errs = append(errs, fmt.Errorf("%w: ASYNC_PROPOSAL_TIMEOUT_SEC must be >= 1", ErrInvalidConfig))
+	}
+	if c.AsyncProposalMaxResults < 1 {
+		errs = append(errs, fmt.Errorf("%w: ASYNC_PROPOSAL_MAX_RESULTS must be >= 1", ErrInvalidConfig))
+	}
+	if c.SnapshotRequestTimeoutSec < 1 {
+		errs = append(errs, fmt.Errorf("%w: SNAPSHOT_REQUEST_TIMEOUT_SEC must be >= 1", ErrInvalidConfig))
+	}
+
+	if _, _, err := ParseMembers(c.RaftInitialMembers); err != nil {
+		errs = append(errs, fmt.Errorf("RAFT_INITIAL_MEMBERS: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateAddr checks a host:port address. If hostRequired is set, the host may not be omitted.
+func validateAddr(addr string, hostRequired bool) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("'%s' must be in the format host:port", addr)
+	}
+	if hostRequired && host == "" {
+		return fmt.Errorf("'%s' must include a host", addr)
+	}
+	if p, err := strconv.ParseUint(port, 10, 16); err != nil || (hostRequired && p == 0) {
+		return fmt.Errorf("'%s' has an invalid port", addr)
+	}
+
+	return nil
+}
+
+// ParseMembers parses a csv of replicaID=addr pairs. A replica ID suffixed with w (e.g. 3w=addr) is a witness.
+func ParseMembers(s string) (members, witnesses map[uint64]string, err error) {
+	members = map[uint64]string{}
+	witnesses = map[uint64]string{}
+	if s == "" {
+		return nil, nil, fmt.Errorf("%w: must not be empty", ErrInvalidMembers)
+	}
+
+	addrs := map[string]uint64{}
+	for _, peerPair := range strings.Split(s, ",") {
+		idAddrPair := strings.SplitN(strings.TrimSpace(peerPair), "=", 2)
+		if len(idAddrPair) != 2 {
+			return nil, nil, fmt.Errorf("%w: invalid peer pair '%s', should be in the format replicaID=addr", ErrInvalidMembers, peerPair)
+		}
+
+		rawID, isWitness := strings.CutSuffix(idAddrPair[0], "w")
+		replicaID, err := strconv.ParseUint(rawID, 10, 64)
+		if err != nil || replicaID == 0 {
+			return nil, nil, fmt.Errorf("%w: invalid replica ID '%s', must be >= 1", ErrInvalidMembers, idAddrPair[0])
+		}
+		addr := idAddrPair[1]
+		if err := validateAddr(addr, true); err != nil {
+			return nil, nil, fmt.Errorf("%w: replica %d: %w", ErrInvalidMembers, replicaID, err)
+		}
+
+		_, isMember := members[replicaID]
+		_, isKnownWitness := witnesses[replicaID]
+		if isMember || isKnownWitness {
+			return nil, nil, fmt.Errorf("%w: replica %d is listed more than once", ErrInvalidMembers, replicaID)
+		}
+		if other, exists := addrs[addr]; exists {
+			return nil, nil, fmt.Errorf("%w: replicas %d and %d have the same address %s", ErrInvalidMembers, other, replicaID, addr)
+		}
+		addrs[addr] = replicaID
+
+		if isWitness {
+			witnesses[replicaID] = addr
+		} else {
+			members[replicaID] = addr
+		}
+	}
+
+	if len(members) == 0 {
+		return nil, nil, fmt.Errorf("%w: there must be at least one non-witness member", ErrInvalidMembers)
+	}
+
+	return members, witnesses, nil
+}
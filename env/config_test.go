@@ -0,0 +1,178 @@
+package env
+
+import (
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	for name, file := range map[string]string{
+		"config.yaml": "replica_id: 2\napp_url: http://file:8080\nraft_listen_addr: 127.0.0.1:6001\nraft_initial_members: 2=127.0.0.1:6001\nraft_sync: true\nunknown_key: 1\n",
+		"config.toml": "replica_id = 2\napp_url = \"http://file:8080\"\nraft_listen_addr = \"127.0.0.1:6001\"\nraft_initial_members = \"2=127.0.0.1:6001\"\nraft_sync = true\nunknown_key = 1\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			previous := Current
+			t.Cleanup(func() { Current = previous })
+			path := filepath.Join(t.TempDir(), name)
+			if err := os.WriteFile(path, []byte(file), 0644); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("APP_URL", "http://env:8080")
+			t.Setenv("RAFT_SYNC", "0")
+
+			c, warnings, err := Load(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Env vars override the file, which overrides the defaults
+			if c.ApplicationURL != "http://env:8080" || c.RaftSync {
+				t.Fatalf("env vars did not override the file: APP_URL %s, RAFT_SYNC %t", c.ApplicationURL, c.RaftSync)
+			}
+			if c.ReplicaID != 2 || c.RaftListenAddr != "127.0.0.1:6001" {
+				t.Fatalf("file did not override the defaults: REPLICA_ID %d, RAFT_LISTEN_ADDR %s", c.ReplicaID, c.RaftListenAddr)
+			}
+			if c.HTTPListenAddr != Default().HTTPListenAddr {
+				t.Fatalf("HTTP_LISTEN_ADDR is %s without being set", c.HTTPListenAddr)
+			}
+			if *Current != c {
+				t.Fatalf("Current is %+v after loading %+v", *Current, c)
+			}
+			if !slices.ContainsFunc(warnings, func(w string) bool { return strings.Contains(w, "unknown_key") }) {
+				t.Fatalf("no warning about the unknown key in %v", warnings)
+			}
+		})
+	}
+}
+
+func TestLoadLegacyEnvVars(t *testing.T) {
+	previous := Current
+	t.Cleanup(func() { Current = previous })
+	t.Setenv("NODE_ID", "3")
+	t.Setenv("RAFT_INITIAL_MEMBERS", "3=127.0.0.1:6001")
+
+	c, warnings, err := Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ReplicaID != 3 {
+		t.Fatalf("REPLICA_ID is %d from NODE_ID", c.ReplicaID)
+	}
+	if !slices.Contains(warnings, "NODE_ID is deprecated, use REPLICA_ID instead") {
+		t.Fatalf("no deprecation warning in %v", warnings)
+	}
+
+	t.Setenv("REPLICA_ID", "4")
+	t.Setenv("RAFT_INITIAL_MEMBERS", "4=127.0.0.1:6001")
+	if c, warnings, _ = Load(""); c.ReplicaID != 4 || !slices.Contains(warnings, "NODE_ID is ignored because REPLICA_ID is set") {
+		t.Fatalf("REPLICA_ID is %d with warnings %v", c.ReplicaID, warnings)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	previous := Current
+	t.Cleanup(func() { Current = previous })
+	t.Setenv("REPLICA_ID", "one")
+
+	if _, _, err := Load(""); !errors.Is(err, ErrInvalidConfig) || !strings.Contains(err.Error(), "REPLICA_ID") {
+		t.Fatalf("got error %v", err)
+	}
+	if Current != previous {
+		t.Fatal("Current changed after an invalid config")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		modify  func(c *Config)
+		wantErr error
+		field   string
+	}{
+		{name: "valid", modify: func(c *Config) {}},
+		{name: "unix http listener", modify: func(c *Config) { c.HTTPListenAddr = "unix:///tmp/raftd.sock" }},
+		{name: "replica ID", modify: func(c *Config) { c.ReplicaID = 0 }, wantErr: ErrInvalidConfig, field: "REPLICA_ID"},
+		{name: "http listener", modify: func(c *Config) { c.HTTPListenAddr = "9090" }, wantErr: ErrInvalidConfig, field: "HTTP_LISTEN_ADDR"},
+		{name: "unix http listener without a path", modify: func(c *Config) { c.HTTPListenAddr = "unix://" }, wantErr: ErrInvalidConfig, field: "HTTP_LISTEN_ADDR"},
+		{name: "raft listener without a host", modify: func(c *Config) { c.RaftListenAddr = ":9091" }, wantErr: ErrInvalidConfig, field: "RAFT_LISTEN_ADDR"},
+		{name: "metrics listener port", modify: func(c *Config) { c.MetricsAPIListenAddr = ":99999" }, wantErr: ErrInvalidConfig, field: "METRICS_LISTEN_ADDR"},
+		{name: "app url", modify: func(c *Config) { c.ApplicationURL = "localhost:8080" }, wantErr: ErrInvalidConfig, field: "APP_URL"},
+		{name: "grpc app url with a path", modify: func(c *Config) {
+			c.AppProtocol = "grpc"
+			c.ApplicationURL = "http://localhost:8080/api"
+		}, wantErr: ErrInvalidConfig, field: "APP_URL"},
+		{name: "negative timeout", modify: func(c *Config) { c.AppReadTimeoutMs = -1 }, wantErr: ErrInvalidConfig, field: "APP_READ_TIMEOUT_MS"},
+		{name: "retry forever", modify: func(c *Config) { c.AppReadMaxRetries = -1 }},
+		{name: "negative retries", modify: func(c *Config) { c.AppReadMaxRetries = -2 }, wantErr: ErrInvalidConfig, field: "APP_READ_MAX_RETRIES"},
+		{name: "app protocol", modify: func(c *Config) { c.AppProtocol = "http3" }, wantErr: ErrInvalidConfig, field: "APP_PROTOCOL"},
+		{name: "update encoding", modify: func(c *Config) { c.AppUpdateEncoding = "protobuf" }, wantErr: ErrInvalidConfig, field: "APP_UPDATE_ENCODING"},
+		{name: "negative connections", modify: func(c *Config) { c.AppMaxConnsPerHost = -1 }, wantErr: ErrInvalidConfig, field: "APP_MAX_CONNS_PER_HOST"},
+		{name: "async proposal timeout", modify: func(c *Config) { c.AsyncProposalTimeoutSec = 0 }, wantErr: ErrInvalidConfig, field: "ASYNC_PROPOSAL_TIMEOUT_SEC"},
+		{name: "members", modify: func(c *Config) { c.RaftInitialMembers = "" }, wantErr: ErrInvalidMembers, field: "RAFT_INITIAL_MEMBERS"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := Default()
+			c.ReplicaID = 1
+			c.RaftInitialMembers = "1=127.0.0.1:9091"
+			tc.modify(&c)
+
+			err := c.Validate()
+			if tc.wantErr == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if !errors.Is(err, tc.wantErr) || !strings.Contains(err.Error(), tc.field) {
+				t.Fatalf("got error %v, want %v for %s", err, tc.wantErr, tc.field)
+			}
+		})
+	}
+}
+
+func TestParseMembers(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		s         string
+		members   map[uint64]string
+		witnesses map[uint64]string
+	}{
+		{name: "single", s: "1=localhost:6000", members: map[uint64]string{1: "localhost:6000"}, witnesses: map[uint64]string{}},
+		{name: "spaces", s: "1=localhost:6000, 2=localhost:6001", members: map[uint64]string{1: "localhost:6000", 2: "localhost:6001"}, witnesses: map[uint64]string{}},
+		{name: "witness", s: "1=localhost:6000,2=localhost:6001,3w=localhost:6002",
+			members:   map[uint64]string{1: "localhost:6000", 2: "localhost:6001"},
+			witnesses: map[uint64]string{3: "localhost:6002"}},
+		{name: "empty", s: ""},
+		{name: "missing address", s: "1"},
+		{name: "zero replica ID", s: "0=localhost:6000"},
+		{name: "invalid replica ID", s: "a=localhost:6000"},
+		{name: "witness suffix only", s: "1=localhost:6000,w=localhost:6001"},
+		{name: "witness suffix before the ID", s: "1=localhost:6000,w2=localhost:6001"},
+		{name: "missing host", s: "1=:6000"},
+		{name: "missing port", s: "1=localhost"},
+		{name: "duplicate replica", s: "1=localhost:6000,1=localhost:6001"},
+		{name: "replica is a member and a witness", s: "1=localhost:6000,1w=localhost:6001"},
+		{name: "duplicate address", s: "1=localhost:6000,2=localhost:6000"},
+		{name: "only witnesses", s: "1w=localhost:6000"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			members, witnesses, err := ParseMembers(tc.s)
+			if tc.members == nil {
+				if !errors.Is(err, ErrInvalidMembers) {
+					t.Fatalf("got members %v, witnesses %v and error %v, want %v", members, witnesses, err, ErrInvalidMembers)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(members, tc.members) || !maps.Equal(witnesses, tc.witnesses) {
+				t.Fatalf("got members %v and witnesses %v, want %v and %v", members, witnesses, tc.members, tc.witnesses)
+			}
+		})
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/danthegoodman1/raftd/gologger"
@@ -18,6 +19,7 @@ import (
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/rs/zerolog"
+	"github.com/samber/lo"
 	"golang.org/x/net/http2"
 )
 
@@ -26,17 +28,27 @@ var logger = gologger.NewLogger().With().Str("Service", "HTTPServer").Logger()
 type HTTPServer struct {
 	Echo    *echo.Echo
 	manager *raft.RaftManager
-	Ready   *syncx.Map[uint64, bool]
+	Ready   *syncx.Map[uint64, raft.ShardState]
 }
 
 type CustomValidator struct {
 	validator *validator.Validate
 }
 
-func StartHTTPServer(readyMap *syncx.Map[uint64, bool], manager *raft.RaftManager) *HTTPServer {
-	listener, err := net.Listen("tcp", env.HTTPListenAddr)
+func StartHTTPServer(readyMap *syncx.Map[uint64, raft.ShardState], manager *raft.RaftManager) *HTTPServer {
+	network, addr := env.ListenNetwork(env.Current.HTTPListenAddr)
+	if network == "unix" {
+		// Remove the socket left behind if raftd did not shut down cleanly
+		if info, err := os.Lstat(addr); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(addr); err != nil {
+				logger.Error().Err(err).Msg("error removing stale unix socket, exiting")
+				os.Exit(1)
+			}
+		}
+	}
+	listener, err := net.Listen(network, addr)
 	if err != nil {
-		logger.Error().Err(err).Msg("error creating tcp listener, exiting")
+		logger.Error().Err(err).Msgf("error creating %s listener, exiting", network)
 		os.Exit(1)
 	}
 	s := &HTTPServer{
@@ -62,15 +74,22 @@ func StartHTTPServer(readyMap *syncx.Map[uint64, bool], manager *raft.RaftManage
 		// Data operations
 		raftGroup := s.Echo.Group("/raft")
 		raftGroup.GET("/read", ccHandler(s.Lookup))
+		raftGroup.POST("/read", ccHandler(s.Lookup)) // for clients that can't send a GET body
 		raftGroup.POST("/update", ccHandler(s.Update))
+		raftGroup.GET("/proposals/:id", ccHandler(s.GetProposal))
+		raftGroup.POST("/session", ccHandler(s.OpenSession))
+		raftGroup.DELETE("/session", ccHandler(s.CloseSession))
 		raftGroup.GET("/snapshot", ccHandler(s.ReadSnapshot))
 		raftGroup.POST("/snapshot", ccHandler(s.CreateSnapshot))
+		raftGroup.GET("/snapshots", ccHandler(s.ListSnapshots))
 
 		// Raft management
 		raftGroup.POST("/recruit_replica", ccHandler(s.RecruitReplica))
 		raftGroup.POST("/remove_replica", ccHandler(s.RemoveReplica))
-		// todo POST /new_shard
-		// todo GET /membership_info
+		raftGroup.POST("/promote_replica", ccHandler(s.PromoteReplica))
+		raftGroup.POST("/new_shard", ccHandler(s.NewShard))
+		raftGroup.POST("/transfer_leader", ccHandler(s.TransferLeader))
+		raftGroup.GET("/membership", ccHandler(s.GetMembership))
 	}
 
 	s.Echo.Listener = listener
@@ -112,25 +131,56 @@ func (s *HTTPServer) HealthCheck(c echo.Context) error {
 	return c.String(http.StatusOK, "ok")
 }
 
+// ReadinessCheck reports whether the replica is ready according to the readiness policy. Use ?shard= to check a
+// single shard, and ?format=json for a breakdown of every shard's state.
 func (s *HTTPServer) ReadinessCheck(c echo.Context) error {
-	// TODO check all shards for readiness, maybe we make each item have a status code like this instead of boolean?
-	// readyCode := s.Ready.Load()
-	// switch readyCode {
-	// case 0:
-	// 	return c.String(http.StatusInternalServerError, "not ready")
-	// case 1:
-	// 	return c.String(http.StatusOK, "ready")
-	// case 2:
-	// 	return c.String(http.StatusInternalServerError, "shut down")
-	// default:
-	// 	return c.String(http.StatusInternalServerError, fmt.Sprintf("unknown status code %d", readyCode))
-	// }
-
-	if ready, ok := s.Ready.Load(0); ok && ready {
-		return c.String(http.StatusOK, "ready")
+	if c.QueryParam("shard") != "" {
+		shardID, err := strconv.ParseUint(c.QueryParam("shard"), 10, 64)
+		if err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("invalid shard ID '%s'", c.QueryParam("shard")))
+		}
+		state, ok := s.Ready.Load(shardID)
+		if !ok {
+			return c.String(http.StatusNotFound, "shard not found")
+		}
+		return c.String(readinessStatusCode(state == raft.ShardStateReady, []raft.ShardState{state}), string(state))
+	}
+
+	report := s.manager.Readiness()
+	states := lo.Map(report.RequiredShards(), func(shardID uint64, _ int) raft.ShardState {
+		return report.Shards[shardID]
+	})
+	statusCode := readinessStatusCode(report.Ready, states)
+	if c.QueryParam("format") == "json" {
+		return c.JSON(statusCode, report)
+	}
+
+	switch {
+	case report.Ready:
+		return c.String(statusCode, "ready")
+	case statusCode == http.StatusInternalServerError && lo.Contains(states, raft.ShardStateFailed):
+		return c.String(statusCode, "failed")
+	case statusCode == http.StatusInternalServerError:
+		return c.String(statusCode, "shut down")
+	default:
+		return c.String(statusCode, "not ready")
+	}
+}
+
+// readinessStatusCode returns 200 if ready, 500 if any of the states will never become ready (shut down or failed),
+// or 503 if still becoming ready
+func readinessStatusCode(ready bool, states []raft.ShardState) int {
+	if ready {
+		return http.StatusOK
+	}
+	for _, state := range states {
+		switch state {
+		case raft.ShardStateClosing, raft.ShardStateClosed, raft.ShardStateFailed:
+			return http.StatusInternalServerError
+		}
 	}
 
-	return c.String(http.StatusServiceUnavailable, "not ready")
+	return http.StatusServiceUnavailable
 }
 
 func (s *HTTPServer) Shutdown(ctx context.Context) error {
@@ -1,30 +1,466 @@
 package http_server
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/danthegoodman1/raftd/env"
+	"github.com/danthegoodman1/raftd/raft"
 	"github.com/labstack/echo/v4"
+	"github.com/lni/dragonboat/v4"
+	"io"
 	"net/http"
+	"strconv"
+	"time"
 )
 
+const shardIDHeader = "raftd-shard-id"
+
+// shardIDFromRequest reads the target shard from the `shard` query param, falling back to the
+// raftd-shard-id header. If neither is provided, the initial shard (0) is used.
+func shardIDFromRequest(c echo.Context) (uint64, error) {
+	raw := c.QueryParam("shard")
+	if raw == "" {
+		raw = c.Request().Header.Get(shardIDHeader)
+	}
+	if raw == "" {
+		return 0, nil
+	}
+
+	shardID, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid shard ID '%s'", raw))
+	}
+
+	return shardID, nil
+}
+
+// raftErrorStatus maps errors from raft operations to the status code returned to the caller
+func raftErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, dragonboat.ErrShardNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, dragonboat.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, raft.ErrProposalDropped):
+		return http.StatusConflict
+	case errors.Is(err, raft.ErrInvalidConsistency):
+		return http.StatusBadRequest
+	case errors.Is(err, raft.ErrNotLeader), errors.Is(err, raft.ErrWitness), errors.Is(err, dragonboat.ErrInvalidOperation):
+		// Witnesses can not serve reads or proposals
+		return http.StatusMisdirectedRequest
+	case errors.Is(err, raft.ErrInvalidTarget), errors.Is(err, raft.ErrInvalidReplicaType),
+		errors.Is(err, raft.ErrInvalidSeries), errors.Is(err, raft.ErrInvalidCommand):
+		return http.StatusBadRequest
+	case errors.Is(err, raft.ErrSessionNotFound):
+		return http.StatusGone
+	case errors.Is(err, raft.ErrSessionSeriesUsed), errors.Is(err, raft.ErrSessionResultLost):
+		return http.StatusConflict
+	case errors.Is(err, raft.ErrNoTransferTarget), errors.Is(err, raft.ErrNotNonVoting):
+		return http.StatusConflict
+	case errors.Is(err, raft.ErrReplicaLagging):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, raft.ErrInvalidSnapshotOptions), errors.Is(err, dragonboat.ErrInvalidOption):
+		return http.StatusBadRequest
+	case errors.Is(err, dragonboat.ErrRejected):
+		// e.g. nothing was applied since the last snapshot
+		return http.StatusConflict
+	case errors.Is(err, raft.ErrProposalNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, dragonboat.ErrSystemBusy), errors.Is(err, raft.ErrTooManyProposals):
+		return http.StatusTooManyRequests
+	case errors.Is(err, dragonboat.ErrPayloadTooBig):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, dragonboat.ErrShardNotReady),
+		errors.Is(err, raft.ErrAppUnavailable),
+		errors.Is(err, dragonboat.ErrShardNotInitialized),
+		errors.Is(err, dragonboat.ErrShardClosed),
+		errors.Is(err, dragonboat.ErrClosed):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, dragonboat.ErrCanceled), errors.Is(err, context.Canceled):
+		return 499 // client closed request
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// readOptionsFromRequest reads the `consistency`, `max_staleness` (Go duration, e.g. 500ms) and `max_lag`
+// (number of entries) query params
+func readOptionsFromRequest(c echo.Context) (raft.ReadOptions, error) {
+	var opts raft.ReadOptions
+	consistency, err := raft.ParseReadConsistency(c.QueryParam("consistency"))
+	if err != nil {
+		return opts, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	opts.Consistency = consistency
+
+	if raw := c.QueryParam("max_staleness"); raw != "" {
+		opts.MaxStaleness, err = time.ParseDuration(raw)
+		if err != nil {
+			return opts, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid max_staleness '%s'", raw))
+		}
+	}
+	if raw := c.QueryParam("max_lag"); raw != "" {
+		opts.MaxLag, err = strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return opts, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid max_lag '%s'", raw))
+		}
+	}
+
+	return opts, nil
+}
+
+// Lookup performs a read with the requested consistency, relaying the request body to the application's /Read endpoint and its
+// response body back to the caller unchanged
 func (s *HTTPServer) Lookup(c *CustomContext) error {
-	panic("todo")
+	ctx := c.Request().Context()
+	shardID, err := shardIDFromRequest(c)
+	if err != nil {
+		return err
+	}
+
+	opts, err := readOptionsFromRequest(c)
+	if err != nil {
+		return err
+	}
+
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.InternalError(err, "error reading request body")
+	}
+
+	result, err := s.manager.Read(ctx, shardID, raft.ReadQuery{
+		ContentType: c.Request().Header.Get(echo.HeaderContentType),
+		Body:        body,
+	}, opts)
+	if err != nil {
+		status := raftErrorStatus(err)
+		if status == http.StatusInternalServerError {
+			return c.InternalError(err, "error in manager.Read")
+		}
+		return c.String(status, err.Error())
+	}
+
+	contentType := result.ContentType
+	if contentType == "" {
+		contentType = echo.MIMEOctetStream
+	}
+
+	return c.Blob(http.StatusOK, contentType, result.Body)
+}
+
+type UpdateResponse struct {
+	Value uint64
+	Data  []byte
+	// Error explains a rejection, the status the application gave the entry is the status of the response
+	Error string `json:",omitempty"`
+}
+
+const (
+	// duplicateHeader is set on /raft/update responses that returned the stored result of a session proposal
+	duplicateHeader = "raftd-duplicate"
+	// appliedHeader is set on responses for entries that were applied, so a rejection by the application can be
+	// told apart from an error of raftd with the same status
+	appliedHeader = "raftd-applied"
+)
+
+func newUpdateResponse(result raft.EntryResult) UpdateResponse {
+	return UpdateResponse{
+		Value: result.Value,
+		Data:  result.Data,
+		Error: result.Error,
+	}
 }
 
+// sessionFromRequest reads the optional `session` and `series` query params
+func sessionFromRequest(c echo.Context) (sessionID, series uint64, err error) {
+	rawSession, rawSeries := c.QueryParam("session"), c.QueryParam("series")
+	if rawSession == "" && rawSeries == "" {
+		return 0, 0, nil
+	}
+
+	sessionID, err = strconv.ParseUint(rawSession, 10, 64)
+	if err != nil || sessionID == 0 {
+		return 0, 0, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid session '%s'", rawSession))
+	}
+	series, err = strconv.ParseUint(rawSeries, 10, 64)
+	if err != nil || series == 0 {
+		return 0, 0, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid series '%s', must be >= 1", rawSeries))
+	}
+
+	return sessionID, series, nil
+}
+
+// Update proposes the request body as a command on the shard, returning once it has been applied. With a session
+// and series, a retried command is applied at most once. With `async=1`, it returns the ID of the proposal as soon
+// as it is accepted instead, see GetProposal.
 func (s *HTTPServer) Update(c *CustomContext) error {
-	panic("todo")
+	ctx := c.Request().Context()
+	shardID, err := shardIDFromRequest(c)
+	if err != nil {
+		return err
+	}
+	sessionID, series, err := sessionFromRequest(c)
+	if err != nil {
+		return err
+	}
+	async := false
+	if raw := c.QueryParam("async"); raw != "" {
+		async, err = strconv.ParseBool(raw)
+		if err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("invalid async '%s', use 1 or 0", raw))
+		}
+	}
+
+	cmd, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.InternalError(err, "error reading request body")
+	}
+
+	if async {
+		proposalID, err := s.manager.ProposeAsync(shardID, sessionID, series, cmd)
+		if err != nil {
+			status := raftErrorStatus(err)
+			if status == http.StatusInternalServerError {
+				return c.InternalError(err, "error in manager.ProposeAsync")
+			}
+			return c.String(status, err.Error())
+		}
+		return c.JSON(http.StatusAccepted, AsyncUpdateResponse{ProposalID: proposalID})
+	}
+
+	var result raft.EntryResult
+	duplicate := false
+	if sessionID != 0 {
+		result, duplicate, err = s.manager.ProposeInSession(ctx, shardID, sessionID, series, cmd)
+	} else {
+		result, err = s.manager.Propose(ctx, shardID, cmd)
+	}
+	if err != nil {
+		status := raftErrorStatus(err)
+		if status == http.StatusInternalServerError {
+			return c.InternalError(err, "error in manager.Propose")
+		}
+		return c.String(status, err.Error())
+	}
+
+	if duplicate {
+		c.Response().Header().Set(duplicateHeader, "true")
+	}
+	c.Response().Header().Set(appliedHeader, "true")
+	return c.JSON(result.HTTPStatus(), newUpdateResponse(result))
+}
+
+type AsyncUpdateResponse struct {
+	ProposalID string
+}
+
+type ProposalResponse struct {
+	ID      string
+	ShardID uint64
+	// Status is one of pending, committed, applied, dropped, timed_out, or failed
+	Status raft.ProposalStatus
+	// Result is set once the proposal is applied
+	Result    *UpdateResponse `json:",omitempty"`
+	Duplicate bool            `json:",omitempty"`
+	Error     string          `json:",omitempty"`
+}
+
+// maxProposalWait caps how long GetProposal long-polls, to stay under common proxy timeouts
+const maxProposalWait = time.Minute
+
+// GetProposal returns the state of an async proposal. With `wait` (Go duration, e.g. 30s), it long-polls until the
+// proposal has finished or the wait is over.
+func (s *HTTPServer) GetProposal(c *CustomContext) error {
+	ctx := c.Request().Context()
+	var wait time.Duration
+	if raw := c.QueryParam("wait"); raw != "" {
+		var err error
+		wait, err = time.ParseDuration(raw)
+		if err != nil || wait < 0 {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("invalid wait '%s'", raw))
+		}
+	}
+
+	state, err := s.manager.GetProposal(ctx, c.Param("id"), min(wait, maxProposalWait))
+	if err != nil {
+		status := raftErrorStatus(err)
+		if status == http.StatusInternalServerError {
+			return c.InternalError(err, "error in manager.GetProposal")
+		}
+		return c.String(status, err.Error())
+	}
+
+	res := ProposalResponse{
+		ID:        state.ID,
+		ShardID:   state.ShardID,
+		Status:    state.Status,
+		Duplicate: state.Duplicate,
+		Error:     state.Error,
+	}
+	if state.Result != nil {
+		// Like /raft/update, the response has the status the application gave the entry
+		updateResponse := newUpdateResponse(*state.Result)
+		res.Result = &updateResponse
+		c.Response().Header().Set(appliedHeader, "true")
+		return c.JSON(state.Result.HTTPStatus(), res)
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+type SessionResponse struct {
+	SessionID uint64
+}
+
+// OpenSession registers a client session on the shard, for exactly-once proposals with /raft/update
+func (s *HTTPServer) OpenSession(c *CustomContext) error {
+	ctx := c.Request().Context()
+	shardID, err := shardIDFromRequest(c)
+	if err != nil {
+		return err
+	}
+
+	sessionID, err := s.manager.OpenSession(ctx, shardID)
+	if err != nil {
+		status := raftErrorStatus(err)
+		if status == http.StatusInternalServerError {
+			return c.InternalError(err, "error in manager.OpenSession")
+		}
+		return c.String(status, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, SessionResponse{SessionID: sessionID})
+}
+
+// CloseSession unregisters a client session
+func (s *HTTPServer) CloseSession(c *CustomContext) error {
+	ctx := c.Request().Context()
+	shardID, err := shardIDFromRequest(c)
+	if err != nil {
+		return err
+	}
+	sessionID, err := strconv.ParseUint(c.QueryParam("session"), 10, 64)
+	if err != nil {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("invalid session '%s'", c.QueryParam("session")))
+	}
+
+	if err := s.manager.CloseSession(ctx, shardID, sessionID); err != nil {
+		status := raftErrorStatus(err)
+		if status == http.StatusInternalServerError {
+			return c.InternalError(err, "error in manager.CloseSession")
+		}
+		return c.String(status, err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+type CreateSnapshotResponse struct {
+	Index uint64
+	// ExportPath is the directory the snapshot was exported to, if it was exported
+	ExportPath string `json:",omitempty"`
 }
 
+// CreateSnapshot takes a snapshot of the shard on this replica. With `export` (an existing directory on this
+// replica), the snapshot is exported there instead. With `compact=1`, every log entry covered by the snapshot is
+// removed.
 func (s *HTTPServer) CreateSnapshot(c *CustomContext) error {
-	panic("todo")
+	ctx := c.Request().Context()
+	shardID, err := shardIDFromRequest(c)
+	if err != nil {
+		return err
+	}
+	opts := raft.SnapshotOptions{
+		ExportPath: c.QueryParam("export"),
+	}
+	if raw := c.QueryParam("compact"); raw != "" {
+		opts.Compact, err = strconv.ParseBool(raw)
+		if err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("invalid compact '%s', use 1 or 0", raw))
+		}
+	}
+
+	index, err := s.manager.CreateSnapshot(ctx, shardID, opts)
+	if err != nil {
+		status := raftErrorStatus(err)
+		if status == http.StatusInternalServerError {
+			return c.InternalError(err, "error in manager.CreateSnapshot")
+		}
+		return c.String(status, err.Error())
+	}
+
+	res := CreateSnapshotResponse{Index: index}
+	if opts.ExportPath != "" {
+		res.ExportPath = raft.ExportedSnapshotDir(opts.ExportPath, index)
+	}
+	return c.JSON(http.StatusOK, res)
 }
 
+const (
+	snapshotIndexHeader      = "raftd-snapshot-index"
+	snapshotTermHeader       = "raftd-snapshot-term"
+	snapshotMembershipHeader = "raftd-snapshot-membership"
+)
+
+// ReadSnapshot takes a new snapshot of the shard on this replica and streams the application's payload, for offline
+// backups. The index, term, and membership (JSON) of the snapshot are in the response headers.
 func (s *HTTPServer) ReadSnapshot(c *CustomContext) error {
-	panic("todo")
+	ctx := c.Request().Context()
+	shardID, err := shardIDFromRequest(c)
+	if err != nil {
+		return err
+	}
+
+	export, err := s.manager.ExportSnapshot(ctx, shardID)
+	if err != nil {
+		status := raftErrorStatus(err)
+		if status == http.StatusInternalServerError {
+			return c.InternalError(err, "error in manager.ExportSnapshot")
+		}
+		return c.String(status, err.Error())
+	}
+	defer export.Payload.Close()
+
+	membership, err := json.Marshal(export.Membership)
+	if err != nil {
+		return c.InternalError(err, "error in json.Marshal")
+	}
+	header := c.Response().Header()
+	header.Set(snapshotIndexHeader, fmt.Sprint(export.Index))
+	header.Set(snapshotTermHeader, fmt.Sprint(export.Term))
+	header.Set(snapshotMembershipHeader, string(membership))
+
+	return c.Stream(http.StatusOK, echo.MIMEOctetStream, export.Payload)
+}
+
+// ListSnapshots lists the snapshots retained by this replica, for the requested shard or for every shard
+func (s *HTTPServer) ListSnapshots(c *CustomContext) error {
+	var shardID *uint64
+	if c.QueryParam("shard") != "" || c.Request().Header.Get(shardIDHeader) != "" {
+		id, err := shardIDFromRequest(c)
+		if err != nil {
+			return err
+		}
+		shardID = &id
+	}
+
+	snapshots, err := s.manager.ListSnapshots(shardID)
+	if err != nil {
+		return c.InternalError(err, "error in manager.ListSnapshots")
+	}
+
+	return c.JSON(http.StatusOK, snapshots)
 }
 
 type RecruitRequest struct {
 	ReplicaAddr string
 	ReplicaID   uint64
 	ShardID     uint64
+	// NonVoting adds the replica as a learner that does not count towards quorum
+	NonVoting bool
+	// Witness adds the replica as a witness that votes but has no state machine
+	Witness bool
 }
 
 // RecruitReplica a new raft member into the cluster
@@ -35,7 +471,10 @@ func (s *HTTPServer) RecruitReplica(c *CustomContext) error {
 		return c.String(http.StatusBadRequest, err.Error())
 	}
 
-	err := s.manager.RecruitReplica(ctx, body.ReplicaID, body.ShardID, body.ReplicaAddr)
+	err := s.manager.RecruitReplica(ctx, body.ReplicaID, body.ShardID, body.ReplicaAddr, body.NonVoting, body.Witness)
+	if errors.Is(err, raft.ErrInvalidReplicaType) {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
@@ -63,3 +502,121 @@ func (s *HTTPServer) RemoveReplica(c *CustomContext) error {
 
 	return c.NoContent(http.StatusAccepted)
 }
+
+type NewShardRequest struct {
+	ShardID uint64
+	// Members is a map of replica ID to raft address. Omit if this replica is joining an existing shard.
+	Members map[uint64]string
+	// Witnesses is a map of replica ID to raft address for witnesses, which the leader adds once the shard starts
+	Witnesses map[uint64]string
+	// Config overrides the default raft config for this shard. Should be the same on every replica.
+	Config *raft.ShardConfig
+}
+
+// NewShard starts a new shard on this replica. Must be called on every member of the new shard.
+func (s *HTTPServer) NewShard(c *CustomContext) error {
+	var body NewShardRequest
+	if err := ValidateRequest(c, &body); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	err := s.manager.CreateShard(body.ShardID, body.Members, body.Witnesses, body.Config)
+	if errors.Is(err, raft.ErrShardExists) {
+		return c.String(http.StatusConflict, err.Error())
+	}
+	if errors.Is(err, raft.ErrInvalidConfig) {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.NoContent(http.StatusCreated)
+}
+
+// GetMembership returns the membership of the requested shard, or of every shard on this replica if no shard is given
+func (s *HTTPServer) GetMembership(c *CustomContext) error {
+	ctx := c.Request().Context()
+	if c.QueryParam("shard") == "" && c.Request().Header.Get(shardIDHeader) == "" {
+		return c.JSON(http.StatusOK, s.manager.GetAllMemberships(ctx))
+	}
+
+	shardID, err := shardIDFromRequest(c)
+	if err != nil {
+		return err
+	}
+
+	membership, err := s.manager.GetMembership(ctx, shardID)
+	if err != nil {
+		status := raftErrorStatus(err)
+		if status == http.StatusInternalServerError {
+			return c.InternalError(err, "error in manager.GetMembership")
+		}
+		return c.String(status, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, membership)
+}
+
+type TransferLeaderRequest struct {
+	ShardID uint64
+	// TargetReplicaID is the replica to transfer leadership to, or 0 for any other voting member
+	TargetReplicaID uint64
+}
+
+type TransferLeaderResponse struct {
+	LeaderID uint64
+}
+
+// TransferLeader moves leadership of a shard to another replica, returning once the new leader is observed
+func (s *HTTPServer) TransferLeader(c *CustomContext) error {
+	ctx := c.Request().Context()
+	var body TransferLeaderRequest
+	if err := ValidateRequest(c, &body); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	leaderID, err := s.manager.TransferLeader(ctx, body.ShardID, body.TargetReplicaID)
+	if err != nil {
+		status := raftErrorStatus(err)
+		if status == http.StatusInternalServerError {
+			return c.InternalError(err, "error in manager.TransferLeader")
+		}
+		return c.String(status, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, TransferLeaderResponse{
+		LeaderID: leaderID,
+	})
+}
+
+type PromoteRequest struct {
+	ShardID uint64
+	// MaxLag is how many entries behind the leader this replica may be when promoted, defaults to PROMOTE_MAX_LAG
+	MaxLag *uint64
+}
+
+// PromoteReplica promotes this replica from non-voting to voting once it has caught up with the leader
+func (s *HTTPServer) PromoteReplica(c *CustomContext) error {
+	ctx := c.Request().Context()
+	var body PromoteRequest
+	if err := ValidateRequest(c, &body); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	maxLag := env.Current.PromoteMaxLag
+	if body.MaxLag != nil {
+		maxLag = *body.MaxLag
+	}
+
+	err := s.manager.PromoteReplica(ctx, body.ShardID, maxLag)
+	if err != nil {
+		status := raftErrorStatus(err)
+		if status == http.StatusInternalServerError {
+			return c.InternalError(err, "error in manager.PromoteReplica")
+		}
+		return c.String(status, err.Error())
+	}
+
+	return c.NoContent(http.StatusAccepted)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"github.com/danthegoodman1/raftd/env"
 	"github.com/danthegoodman1/raftd/observability"
 	"github.com/danthegoodman1/raftd/raft"
@@ -20,18 +21,34 @@ import (
 var logger = gologger.NewLogger()
 
 func main() {
+	configPath := flag.String("config", os.Getenv("RAFTD_CONFIG"), "path to a YAML or TOML config file, env vars override its values")
+	flag.Parse()
+
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(*configPath, flag.Args()))
+	}
+
+	_, warnings, err := env.Load(*configPath)
+	for _, warning := range warnings {
+		logger.Warn().Msg(warning)
+	}
+	if err != nil {
+		logger.Fatal().Err(err).Msg("invalid config")
+		return
+	}
+
 	logger.Debug().Msg("starting raftd")
 
 	prometheusReporter := observability.NewPrometheusReporter()
 	go func() {
-		err := observability.StartInternalHTTPServer(env.MetricsAPIListenAddr, prometheusReporter)
+		err := observability.StartInternalHTTPServer(env.Current.MetricsAPIListenAddr, prometheusReporter)
 		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			logger.Fatal().Err(err).Msg("internal server couldn't start")
 			return
 		}
 	}()
 
-	readyMap := syncx.NewMap[uint64, bool]()
+	readyMap := syncx.NewMap[uint64, raft.ShardState]()
 
 	raftManager, err := raft.NewRaftManager(&readyMap)
 	if err != nil {
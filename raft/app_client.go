@@ -0,0 +1,360 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/danthegoodman1/raftd/env"
+	"github.com/lni/dragonboat/v4/statemachine"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type (
+	// appCallback identifies an application endpoint, and is used as a metric label
+	appCallback string
+
+	// appBackend calls the application over a protocol. Idempotent callbacks are retried by the backend, snapshot
+	// streams are not.
+	appBackend interface {
+		LastLogIndex(ctx context.Context, replica appReplica) (uint64, error)
+		UpdateEntries(ctx context.Context, replica appReplica, entries []statemachine.Entry) ([]EntryResult, error)
+		Read(ctx context.Context, replica appReplica, query ReadQuery) (ReadResult, error)
+		Sync(ctx context.Context, replica appReplica) error
+		// PrepareSnapshot returns state that is opaque to raftd, which is passed to SaveSnapshot
+		PrepareSnapshot(ctx context.Context, replica appReplica) (any, error)
+		SaveSnapshot(ctx context.Context, replica appReplica, state any, w io.Writer) error
+		RecoverFromSnapshot(ctx context.Context, replica appReplica, r io.Reader) error
+	}
+
+	// appClient retries idempotent callbacks with backoff, independent of the protocol. A process has a single one,
+	// shared by every shard since they all talk to the same application, so its breaker is the one the breaker
+	// metrics report.
+	appClient struct {
+		timeouts appTimeouts
+		// retries is the retry budget of each callback, -1 retries forever
+		retries   map[appCallback]int64
+		baseDelay time.Duration
+		maxDelay  time.Duration
+		breaker   *circuitBreaker
+	}
+
+	// appReplica is the replica a call to the application is made for
+	appReplica struct {
+		shardID, replicaID uint64
+		// onPause is called when a call starts waiting for the application to come back, and onResume once it has
+		onPause, onResume func(callback appCallback)
+	}
+
+	breakerState int
+
+	// circuitBreaker stops requests to the application after consecutive failures, then lets a single probe request
+	// through after the cooldown to check if it is back
+	circuitBreaker struct {
+		mu        sync.Mutex
+		state     breakerState
+		failures  int64
+		threshold int64
+		cooldown  time.Duration
+		openedAt  time.Time
+	}
+)
+
+const (
+	callbackOpen            appCallback = "LastLogIndex"
+	callbackUpdate          appCallback = "UpdateEntries"
+	callbackRead            appCallback = "Read"
+	callbackSync            appCallback = "Sync"
+	callbackPrepareSnapshot appCallback = "PrepareSnapshot"
+	callbackSaveSnapshot    appCallback = "SaveSnapshot"
+	callbackRecoverSnapshot appCallback = "RecoverFromSnapshot"
+)
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+
+	// breakerProbeWait is how long to wait while another request is probing the application
+	breakerProbeWait = 100 * time.Millisecond
+)
+
+var (
+	ErrAppUnavailable = errors.New("application is unavailable")
+
+	appRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "raftd_app_requests_total",
+		Help: "Requests made to the application, by callback and result",
+	}, []string{"callback", "result"})
+	appRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "raftd_app_retries_total",
+		Help: "Requests to the application that were retried, by callback",
+	}, []string{"callback"})
+	appBreakerState = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "raftd_app_breaker_state",
+		Help: "State of the application circuit breaker, which every shard of the process shares: 0 closed, 1 half open, 2 open",
+	})
+	appBreakerOpened = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "raftd_app_breaker_opened_total",
+		Help: "Number of times the application circuit breaker, which every shard of the process shares, opened",
+	})
+)
+
+// newAppBackend creates the backend for APP_PROTOCOL. It is called once per process, by the RaftManager or by an
+// offline recovery, so there is a single circuit breaker for the breaker metrics to report.
+func newAppBackend() (appBackend, error) {
+	appURL, err := env.ParseAppURL(env.Current.ApplicationURL)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing application url: %w", err)
+	}
+
+	client := newAppClient()
+	if env.Current.AppProtocol == AppProtocolGRPC {
+		return newGRPCBackend(client, appURL)
+	}
+	return newHTTPBackend(client, appURL)
+}
+
+func newAppClient() *appClient {
+	return &appClient{
+		timeouts: appTimeoutsFromEnv(),
+		retries: map[appCallback]int64{
+			callbackOpen:            env.Current.AppOpenMaxRetries,
+			callbackUpdate:          env.Current.AppUpdateMaxRetries,
+			callbackRead:            env.Current.AppReadMaxRetries,
+			callbackSync:            env.Current.AppSyncMaxRetries,
+			callbackPrepareSnapshot: env.Current.AppPrepareSnapshotMaxRetries,
+		},
+		baseDelay: time.Duration(env.Current.AppRetryBaseDelayMs) * time.Millisecond,
+		maxDelay:  time.Duration(env.Current.AppRetryMaxDelayMs) * time.Millisecond,
+		breaker: &circuitBreaker{
+			threshold: env.Current.AppBreakerFailureThreshold,
+			cooldown:  time.Duration(env.Current.AppBreakerCooldownMs) * time.Millisecond,
+		},
+	}
+}
+
+// isRetryable returns whether the error means the application is unavailable, rather than it rejecting the request
+func isRetryable(err error) bool {
+	var statusErr *appStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+	if s, isGRPC := status.FromError(err); isGRPC {
+		switch s.Code() {
+		case codes.Unavailable, codes.ResourceExhausted, codes.DeadlineExceeded, codes.Aborted:
+			return true
+		default:
+			return false
+		}
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// isTimeout returns whether the attempt timed out, in which case the request may have reached the application and
+// still be running
+func isTimeout(err error) bool {
+	if s, isGRPC := status.FromError(err); isGRPC {
+		return s.Code() == codes.DeadlineExceeded
+	}
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// do calls an idempotent callback, retrying within the callback's retry budget. Each attempt runs with the
+// callback's timeout. Callbacks that retry forever wait for the application while the circuit breaker is open,
+// others fail with ErrAppUnavailable. /UpdateEntries is never retried after a timeout, since the application may
+// still be applying the entries and would see them twice at once. Once ctx is done no more attempts are made, but an
+// /UpdateEntries attempt in flight runs to completion for the same reason.
+func (c *appClient) do(ctx context.Context, callback appCallback, replica appReplica, attempt func(ctx context.Context) error) error {
+	budget := c.retries[callback]
+	paused := false
+	var retries int64
+	for {
+		if wait, allowed := c.breaker.allow(); !allowed {
+			if budget >= 0 {
+				return fmt.Errorf("%w: circuit breaker is open", ErrAppUnavailable)
+			}
+			if !paused && replica.onPause != nil {
+				replica.onPause(callback)
+			}
+			paused = true
+			if err := sleepContext(ctx, wait); err != nil {
+				return err
+			}
+			continue
+		}
+
+		attemptCtx := ctx
+		if callback == callbackUpdate {
+			// An /UpdateEntries call in flight is not abandoned, the application could still be applying the entries
+			// when they are sent again
+			attemptCtx = context.WithoutCancel(ctx)
+		}
+		err := c.attempt(attemptCtx, callback, attempt)
+		if err != nil && ctx.Err() != nil {
+			// The call was abandoned, which says nothing about the application
+			return err
+		}
+		if err == nil || !isRetryable(err) {
+			// The application responded, so it is up
+			c.breaker.success()
+			if paused && replica.onResume != nil {
+				replica.onResume(callback)
+			}
+			return err
+		}
+
+		c.breaker.failure()
+		if ctx.Err() != nil || (budget >= 0 && retries >= budget) {
+			return err
+		}
+		if callback == callbackUpdate && isTimeout(err) {
+			return fmt.Errorf("not retrying %s after a timeout, the application may still be applying the entries: %w", callback, err)
+		}
+		retries++
+		appRetries.WithLabelValues(string(callback)).Inc()
+		if err := sleepContext(ctx, c.backoff(retries)); err != nil {
+			return err
+		}
+	}
+}
+
+// stream calls a streaming callback once, since a stream can not be retried
+func (c *appClient) stream(ctx context.Context, callback appCallback, attempt func(ctx context.Context) error) error {
+	if _, allowed := c.breaker.allow(); !allowed {
+		return fmt.Errorf("%w: circuit breaker is open", ErrAppUnavailable)
+	}
+
+	err := attempt(ctx)
+	recordRequest(callback, err)
+	if err != nil && isRetryable(err) {
+		c.breaker.failure()
+	} else {
+		c.breaker.success()
+	}
+
+	return err
+}
+
+func (c *appClient) attempt(ctx context.Context, callback appCallback, attempt func(ctx context.Context) error) error {
+	ctx, cancel := withTimeout(ctx, c.timeout(callback))
+	defer cancel()
+
+	err := attempt(ctx)
+	recordRequest(callback, err)
+	return err
+}
+
+func recordRequest(callback appCallback, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	appRequests.WithLabelValues(string(callback), result).Inc()
+}
+
+func (c *appClient) timeout(callback appCallback) time.Duration {
+	switch callback {
+	case callbackOpen:
+		return c.timeouts.Open
+	case callbackUpdate:
+		return c.timeouts.Update
+	case callbackRead:
+		return c.timeouts.Read
+	case callbackSync:
+		return c.timeouts.Sync
+	case callbackPrepareSnapshot:
+		return c.timeouts.PrepareSnapshot
+	default:
+		return 0
+	}
+}
+
+// backoff returns an exponential backoff with full jitter
+func (c *appClient) backoff(attempt int64) time.Duration {
+	delay := c.maxDelay
+	if attempt < 32 && c.baseDelay<<attempt < c.maxDelay {
+		delay = c.baseDelay << attempt
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return rand.N(delay)
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// allow returns whether a request may be made now, otherwise how long to wait before asking again
+func (b *circuitBreaker) allow() (time.Duration, bool) {
+	if b.threshold <= 0 {
+		return 0, true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if wait := time.Until(b.openedAt.Add(b.cooldown)); wait > 0 {
+			return wait, false
+		}
+		// This request is the probe
+		b.setState(breakerHalfOpen)
+		return 0, true
+	case breakerHalfOpen:
+		return breakerProbeWait, false
+	default:
+		return 0, true
+	}
+}
+
+func (b *circuitBreaker) success() {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.setState(breakerClosed)
+}
+
+func (b *circuitBreaker) failure() {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.threshold) {
+		b.openedAt = time.Now()
+		b.setState(breakerOpen)
+		appBreakerOpened.Inc()
+	}
+}
+
+// setState must be called with mu held
+func (b *circuitBreaker) setState(state breakerState) {
+	b.state = state
+	appBreakerState.Set(float64(state))
+}
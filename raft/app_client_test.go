@@ -0,0 +1,72 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAppClientRetries(t *testing.T) {
+	unavailable := &appStatusError{StatusCode: http.StatusServiceUnavailable}
+	for _, tc := range []struct {
+		name     string
+		callback appCallback
+		budget   int64
+		err      error
+		attempts int
+	}{
+		{name: "update retries while unavailable", callback: callbackUpdate, budget: -1, err: unavailable, attempts: 3},
+		{name: "update does not retry a timeout", callback: callbackUpdate, budget: -1, err: fmt.Errorf("error in http.Do: %w", context.DeadlineExceeded), attempts: 1},
+		{name: "update does not retry a grpc timeout", callback: callbackUpdate, budget: -1, err: status.Error(codes.DeadlineExceeded, "deadline"), attempts: 1},
+		{name: "read retries a timeout", callback: callbackRead, budget: 2, err: context.DeadlineExceeded, attempts: 3},
+		{name: "budget", callback: callbackRead, budget: 1, err: unavailable, attempts: 2},
+		{name: "rejected", callback: callbackUpdate, budget: -1, err: &appStatusError{StatusCode: http.StatusBadRequest}, attempts: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &appClient{
+				retries: map[appCallback]int64{tc.callback: tc.budget},
+				breaker: &circuitBreaker{},
+			}
+			attempts := 0
+			err := client.do(context.Background(), tc.callback, appReplica{}, func(ctx context.Context) error {
+				attempts++
+				if attempts == 3 {
+					return nil
+				}
+				return tc.err
+			})
+			if attempts != tc.attempts {
+				t.Fatalf("made %d attempts, want %d", attempts, tc.attempts)
+			}
+			if wantErr := attempts < 3; wantErr != (err != nil) || (wantErr && !errors.Is(err, tc.err)) {
+				t.Fatalf("got error %v after %d attempts", err, attempts)
+			}
+		})
+	}
+}
+
+func TestAppClientCanceled(t *testing.T) {
+	client := &appClient{
+		retries: map[appCallback]int64{callbackRead: -1},
+		breaker: &circuitBreaker{threshold: 5, failures: 3},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	resumed := false
+	replica := appReplica{onResume: func(appCallback) { resumed = true }}
+	err := client.do(ctx, callbackRead, replica, func(attemptCtx context.Context) error {
+		cancel()
+		return attemptCtx.Err()
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+	// A canceled call is not a response from the application
+	if client.breaker.failures != 3 || resumed {
+		t.Fatalf("breaker has %d failures and resumed is %t after a canceled call", client.breaker.failures, resumed)
+	}
+}
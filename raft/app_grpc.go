@@ -0,0 +1,288 @@
+package raft
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/danthegoodman1/raftd/apppb"
+	"github.com/danthegoodman1/raftd/env"
+	"github.com/lni/dragonboat/v4/statemachine"
+	"github.com/samber/lo"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+// snapshotChunkSize is the max size of each chunk streamed to RecoverFromSnapshot
+const snapshotChunkSize = 64 * 1024
+
+type (
+	// grpcBackend calls the application's gRPC App service, see apppb/app.proto
+	grpcBackend struct {
+		client *appClient
+		app    apppb.AppClient
+		// sem caps the number of in flight calls, nil if unlimited
+		sem chan struct{}
+	}
+)
+
+var (
+	ErrInvalidSnapshotState = errors.New("invalid snapshot state")
+)
+
+func newGRPCBackend(client *appClient, appURL env.AppURL) (*grpcBackend, error) {
+	parsed, err := url.Parse(appURL.BaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing application url: %w", err)
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: time.Duration(env.Current.AppKeepAliveSec) * time.Second,
+	}
+	target := parsed.Host
+	dial := func(ctx context.Context, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+	if appURL.SocketPath != "" {
+		// Every call goes to the socket, whatever the placeholder host in the URL
+		target = "passthrough:///" + parsed.Host
+		dial = func(ctx context.Context, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", appURL.SocketPath)
+		}
+	}
+
+	creds := insecure.NewCredentials()
+	if parsed.Scheme == "https" {
+		creds = credentials.NewTLS(&tls.Config{})
+	}
+
+	conn, err := grpc.NewClient(target,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithContextDialer(dial),
+		grpc.WithIdleTimeout(time.Duration(env.Current.AppIdleConnTimeoutSec)*time.Second),
+		// Update batches and reads are not bounded by raftd, so neither are messages
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(math.MaxInt32), grpc.MaxCallSendMsgSize(math.MaxInt32)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error in grpc.NewClient: %w", err)
+	}
+
+	b := &grpcBackend{
+		client: client,
+		app:    apppb.NewAppClient(conn),
+	}
+	if env.Current.AppMaxConcurrentStreams > 0 {
+		b.sem = make(chan struct{}, env.Current.AppMaxConcurrentStreams)
+	}
+
+	return b, nil
+}
+
+// outgoing acquires an in flight slot and adds the replica metadata to the context. release must be called once the
+// call is done.
+func (b *grpcBackend) outgoing(ctx context.Context, replica appReplica) (context.Context, func(), error) {
+	release := func() {}
+	if b.sem != nil {
+		select {
+		case b.sem <- struct{}{}:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+		release = func() { <-b.sem }
+	}
+
+	ctx = metadata.AppendToOutgoingContext(ctx,
+		"raftd-node-id", fmt.Sprint(replica.shardID),
+		"raftd-replica-id", fmt.Sprint(replica.replicaID),
+	)
+	return ctx, release, nil
+}
+
+// unary calls an idempotent callback
+func (b *grpcBackend) unary(ctx context.Context, callback appCallback, replica appReplica, call func(ctx context.Context) error) error {
+	return b.client.do(ctx, callback, replica, func(ctx context.Context) error {
+		ctx, release, err := b.outgoing(ctx, replica)
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		return call(ctx)
+	})
+}
+
+func (b *grpcBackend) LastLogIndex(ctx context.Context, replica appReplica) (uint64, error) {
+	var lastLogIndex uint64
+	err := b.unary(ctx, callbackOpen, replica, func(ctx context.Context) error {
+		res, err := b.app.LastLogIndex(ctx, &apppb.LastLogIndexRequest{})
+		if err != nil {
+			return fmt.Errorf("error in app.LastLogIndex: %w", err)
+		}
+		lastLogIndex = res.GetLastLogIndex()
+		return nil
+	})
+
+	return lastLogIndex, err
+}
+
+func (b *grpcBackend) UpdateEntries(ctx context.Context, replica appReplica, entries []statemachine.Entry) ([]EntryResult, error) {
+	req := &apppb.UpdateEntriesRequest{
+		Entries: lo.Map(entries, func(entry statemachine.Entry, index int) *apppb.Entry {
+			return &apppb.Entry{
+				Index: entry.Index,
+				Cmd:   entry.Cmd,
+			}
+		}),
+	}
+
+	var results []EntryResult
+	err := b.unary(ctx, callbackUpdate, replica, func(ctx context.Context) error {
+		res, err := b.app.UpdateEntries(ctx, req)
+		if err != nil {
+			return fmt.Errorf("error in app.UpdateEntries: %w", err)
+		}
+		results = lo.Map(res.GetResults(), func(result *apppb.Result, index int) EntryResult {
+			return EntryResult{
+				Value:  result.GetValue(),
+				Data:   result.GetData(),
+				Status: int(result.GetStatus()),
+				Error:  result.GetError(),
+			}
+		})
+		return nil
+	})
+
+	return results, err
+}
+
+func (b *grpcBackend) Read(ctx context.Context, replica appReplica, query ReadQuery) (ReadResult, error) {
+	var result ReadResult
+	err := b.unary(ctx, callbackRead, replica, func(ctx context.Context) error {
+		res, err := b.app.Read(ctx, &apppb.ReadRequest{
+			ContentType: query.ContentType,
+			Body:        query.Body,
+		})
+		if err != nil {
+			return fmt.Errorf("error in app.Read: %w", err)
+		}
+		result = ReadResult{
+			ContentType: res.GetContentType(),
+			Body:        res.GetBody(),
+		}
+		return nil
+	})
+
+	return result, err
+}
+
+func (b *grpcBackend) Sync(ctx context.Context, replica appReplica) error {
+	return b.unary(ctx, callbackSync, replica, func(ctx context.Context) error {
+		if _, err := b.app.Sync(ctx, &apppb.SyncRequest{}); err != nil {
+			return fmt.Errorf("error in app.Sync: %w", err)
+		}
+		return nil
+	})
+}
+
+func (b *grpcBackend) PrepareSnapshot(ctx context.Context, replica appReplica) (any, error) {
+	var state []byte
+	err := b.unary(ctx, callbackPrepareSnapshot, replica, func(ctx context.Context) error {
+		res, err := b.app.PrepareSnapshot(ctx, &apppb.PrepareSnapshotRequest{})
+		if err != nil {
+			return fmt.Errorf("error in app.PrepareSnapshot: %w", err)
+		}
+		state = res.GetState()
+		return nil
+	})
+
+	return state, err
+}
+
+func (b *grpcBackend) SaveSnapshot(ctx context.Context, replica appReplica, state any, w io.Writer) error {
+	stateBytes, ok := state.([]byte)
+	if !ok && state != nil {
+		return fmt.Errorf("%w: expected []byte, got %T", ErrInvalidSnapshotState, state)
+	}
+
+	return b.client.stream(ctx, callbackSaveSnapshot, func(ctx context.Context) error {
+		// Cancelling ends the stream if we stop reading early
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		ctx, release, err := b.outgoing(ctx, replica)
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		stream, err := b.app.SaveSnapshot(ctx, &apppb.SaveSnapshotRequest{State: stateBytes})
+		if err != nil {
+			return fmt.Errorf("error in app.SaveSnapshot: %w", err)
+		}
+		for {
+			chunk, err := stream.Recv()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("error in stream.Recv: %w", err)
+			}
+			if _, err := w.Write(chunk.GetData()); err != nil {
+				return fmt.Errorf("error writing snapshot: %w", err)
+			}
+		}
+	})
+}
+
+func (b *grpcBackend) RecoverFromSnapshot(ctx context.Context, replica appReplica, r io.Reader) error {
+	return b.client.stream(ctx, callbackRecoverSnapshot, func(ctx context.Context) error {
+		// Cancelling aborts the stream if reading the snapshot fails
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		ctx, release, err := b.outgoing(ctx, replica)
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		stream, err := b.app.RecoverFromSnapshot(ctx)
+		if err != nil {
+			return fmt.Errorf("error in app.RecoverFromSnapshot: %w", err)
+		}
+
+		buf := make([]byte, snapshotChunkSize)
+		for {
+			n, readErr := r.Read(buf)
+			if n > 0 {
+				// The chunk is serialized before Send returns, so the buffer can be reused
+				err := stream.Send(&apppb.SnapshotChunk{Data: buf[:n]})
+				if errors.Is(err, io.EOF) {
+					// The application ended the stream, its status is returned by CloseAndRecv
+					break
+				}
+				if err != nil {
+					return fmt.Errorf("error in stream.Send: %w", err)
+				}
+			}
+			if errors.Is(readErr, io.EOF) {
+				break
+			}
+			if readErr != nil {
+				return fmt.Errorf("error reading snapshot: %w", readErr)
+			}
+		}
+
+		if _, err := stream.CloseAndRecv(); err != nil {
+			return fmt.Errorf("error in stream.CloseAndRecv: %w", err)
+		}
+		return nil
+	})
+}
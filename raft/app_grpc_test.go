@@ -0,0 +1,292 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/danthegoodman1/raftd/apppb"
+	"github.com/lni/dragonboat/v4/statemachine"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// testGRPCApp is an application that records every command it applies, like testApp, over gRPC
+type testGRPCApp struct {
+	apppb.UnimplementedAppServer
+	mu       sync.Mutex
+	applied  uint64
+	commands []string
+	// readErr is returned by Read when set
+	readErr error
+	reads   int
+	// replicaIDs has the raftd-replica-id metadata of every call
+	replicaIDs []string
+}
+
+type testGRPCSnapshot struct {
+	Applied  uint64
+	Commands []string
+}
+
+func (a *testGRPCApp) record(ctx context.Context) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	a.replicaIDs = append(a.replicaIDs, md.Get("raftd-replica-id")...)
+}
+
+func (a *testGRPCApp) LastLogIndex(ctx context.Context, _ *apppb.LastLogIndexRequest) (*apppb.LastLogIndexResponse, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.record(ctx)
+	return &apppb.LastLogIndexResponse{LastLogIndex: a.applied}, nil
+}
+
+func (a *testGRPCApp) UpdateEntries(ctx context.Context, req *apppb.UpdateEntriesRequest) (*apppb.UpdateEntriesResponse, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.record(ctx)
+	results := make([]*apppb.Result, len(req.GetEntries()))
+	for i, entry := range req.GetEntries() {
+		a.applied = entry.GetIndex()
+		a.commands = append(a.commands, string(entry.GetCmd()))
+		results[i] = &apppb.Result{Value: entry.GetIndex(), Data: []byte("applied " + string(entry.GetCmd())), Status: 201}
+	}
+	return &apppb.UpdateEntriesResponse{Results: results}, nil
+}
+
+func (a *testGRPCApp) Read(ctx context.Context, req *apppb.ReadRequest) (*apppb.ReadResponse, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.record(ctx)
+	a.reads++
+	if a.readErr != nil {
+		return nil, a.readErr
+	}
+	body, _ := json.Marshal(a.commands)
+	return &apppb.ReadResponse{ContentType: req.GetContentType(), Body: body}, nil
+}
+
+func (a *testGRPCApp) PrepareSnapshot(ctx context.Context, _ *apppb.PrepareSnapshotRequest) (*apppb.PrepareSnapshotResponse, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.record(ctx)
+	state, _ := json.Marshal(testGRPCSnapshot{Applied: a.applied, Commands: a.commands})
+	return &apppb.PrepareSnapshotResponse{State: state}, nil
+}
+
+func (a *testGRPCApp) SaveSnapshot(req *apppb.SaveSnapshotRequest, stream grpc.ServerStreamingServer[apppb.SnapshotChunk]) error {
+	// Sent in small chunks, which raftd must join back together
+	state := req.GetState()
+	for len(state) > 0 {
+		n := min(len(state), 1000)
+		if err := stream.Send(&apppb.SnapshotChunk{Data: state[:n]}); err != nil {
+			return err
+		}
+		state = state[n:]
+	}
+	return nil
+}
+
+func (a *testGRPCApp) RecoverFromSnapshot(stream grpc.ClientStreamingServer[apppb.SnapshotChunk, apppb.RecoverFromSnapshotResponse]) error {
+	var buf bytes.Buffer
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		buf.Write(chunk.GetData())
+	}
+
+	var snapshot testGRPCSnapshot
+	if err := json.Unmarshal(buf.Bytes(), &snapshot); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.applied, a.commands = snapshot.Applied, snapshot.Commands
+	return stream.SendAndClose(&apppb.RecoverFromSnapshotResponse{})
+}
+
+// newTestGRPCBackend serves app in-process and returns a backend connected to it
+func newTestGRPCBackend(t *testing.T, app apppb.AppServer, client *appClient) *grpcBackend {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	apppb.RegisterAppServer(srv, app)
+	go func() { _ = srv.Serve(lis) }()
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///app",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return &grpcBackend{client: client, app: apppb.NewAppClient(conn)}
+}
+
+func newTestAppClient(budget int64) *appClient {
+	return &appClient{
+		retries: map[appCallback]int64{
+			callbackOpen:   budget,
+			callbackUpdate: budget,
+			callbackRead:   budget,
+		},
+		breaker: &circuitBreaker{},
+	}
+}
+
+func TestGRPCBackendUpdateAndRead(t *testing.T) {
+	app := &testGRPCApp{}
+	backend := newTestGRPCBackend(t, app, newTestAppClient(0))
+	replica := appReplica{shardID: 1, replicaID: 2}
+	ctx := context.Background()
+
+	results, err := backend.UpdateEntries(ctx, replica, []statemachine.Entry{{Index: 5, Cmd: []byte("a")}, {Index: 6, Cmd: []byte("b")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []EntryResult{{Value: 5, Data: []byte("applied a"), Status: 201}, {Value: 6, Data: []byte("applied b"), Status: 201}}
+	if !slices.EqualFunc(results, want, func(a, b EntryResult) bool {
+		return a.Value == b.Value && bytes.Equal(a.Data, b.Data) && a.Status == b.Status && a.Error == b.Error
+	}) {
+		t.Fatalf("got results %+v, want %+v", results, want)
+	}
+
+	lastLogIndex, err := backend.LastLogIndex(ctx, replica)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastLogIndex != 6 {
+		t.Fatalf("last log index %d", lastLogIndex)
+	}
+
+	res, err := backend.Read(ctx, replica, ReadQuery{ContentType: "application/json", Body: []byte("{}")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ContentType != "application/json" || string(res.Body) != `["a","b"]` {
+		t.Fatalf("read %s of type %s", res.Body, res.ContentType)
+	}
+
+	if !slices.Equal(app.replicaIDs, []string{"2", "2", "2"}) {
+		t.Fatalf("calls had replica IDs %v", app.replicaIDs)
+	}
+}
+
+func TestGRPCBackendSnapshot(t *testing.T) {
+	// Larger than a chunk, so it is streamed in several
+	commands := []string{"a", strings.Repeat("b", 3*snapshotChunkSize)}
+	source := &testGRPCApp{applied: 7, commands: commands}
+	target := &testGRPCApp{}
+	sourceBackend := newTestGRPCBackend(t, source, newTestAppClient(0))
+	targetBackend := newTestGRPCBackend(t, target, newTestAppClient(0))
+	ctx := context.Background()
+
+	state, err := sourceBackend.PrepareSnapshot(ctx, appReplica{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snapshot bytes.Buffer
+	if err := sourceBackend.SaveSnapshot(ctx, appReplica{}, state, &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if err := targetBackend.RecoverFromSnapshot(ctx, appReplica{}, &snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	if target.applied != 7 || !slices.Equal(target.commands, commands) {
+		t.Fatalf("recovered applied index %d and %d commands", target.applied, len(target.commands))
+	}
+
+	// The application rejecting the snapshot fails the recovery
+	err = targetBackend.RecoverFromSnapshot(ctx, appReplica{}, strings.NewReader("not a snapshot"))
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("got error %v, want %s", err, codes.InvalidArgument)
+	}
+}
+
+func TestGRPCBackendStatusCodes(t *testing.T) {
+	for _, tc := range []struct {
+		code      codes.Code
+		retryable bool
+		timeout   bool
+	}{
+		{code: codes.Unavailable, retryable: true},
+		{code: codes.ResourceExhausted, retryable: true},
+		{code: codes.Aborted, retryable: true},
+		{code: codes.DeadlineExceeded, retryable: true, timeout: true},
+		{code: codes.InvalidArgument},
+		{code: codes.NotFound},
+		{code: codes.FailedPrecondition},
+		{code: codes.Internal},
+		{code: codes.Unimplemented},
+	} {
+		t.Run(tc.code.String(), func(t *testing.T) {
+			app := &testGRPCApp{readErr: status.Error(tc.code, "read failed")}
+			backend := newTestGRPCBackend(t, app, newTestAppClient(1))
+
+			_, err := backend.Read(context.Background(), appReplica{}, ReadQuery{})
+			if status.Code(err) != tc.code {
+				t.Fatalf("got error %v, want %s", err, tc.code)
+			}
+			if isRetryable(err) != tc.retryable || isTimeout(err) != tc.timeout {
+				t.Fatalf("retryable %t and timeout %t for %v", isRetryable(err), isTimeout(err), err)
+			}
+			wantReads := 1
+			if tc.retryable {
+				wantReads = 2
+			}
+			if app.reads != wantReads {
+				t.Fatalf("made %d reads, want %d", app.reads, wantReads)
+			}
+		})
+	}
+}
+
+func TestGRPCBackendAttemptTimeout(t *testing.T) {
+	app := &blockingGRPCApp{}
+	client := newTestAppClient(-1)
+	client.timeouts = appTimeouts{Update: 50 * time.Millisecond}
+	backend := newTestGRPCBackend(t, app, client)
+
+	// The deadline of the attempt is seen as a timeout, which /UpdateEntries does not retry
+	_, err := backend.UpdateEntries(context.Background(), appReplica{}, []statemachine.Entry{{Index: 1}})
+	if !isTimeout(err) || !isRetryable(err) {
+		t.Fatalf("got error %v, want a retryable timeout", err)
+	}
+	if app.calls.Load() != 1 {
+		t.Fatalf("made %d calls after a timeout", app.calls.Load())
+	}
+}
+
+// blockingGRPCApp does not answer /UpdateEntries until the call is canceled
+type blockingGRPCApp struct {
+	apppb.UnimplementedAppServer
+	calls atomic.Int64
+}
+
+func (a *blockingGRPCApp) UpdateEntries(ctx context.Context, _ *apppb.UpdateEntriesRequest) (*apppb.UpdateEntriesResponse, error) {
+	a.calls.Add(1)
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
@@ -0,0 +1,306 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/danthegoodman1/raftd/env"
+	"github.com/lni/dragonboat/v4/statemachine"
+	"github.com/samber/lo"
+)
+
+type (
+	// httpBackend calls the application's HTTP callback API
+	httpBackend struct {
+		client         *appClient
+		baseURL        string
+		httpClient     *http.Client
+		updateEncoding string
+	}
+
+	// appStatusError is returned when the application responds with a non-2xx status code
+	appStatusError struct {
+		StatusCode int
+		Body       string
+	}
+
+	updateEntry struct {
+		Index uint64
+		Cmd   []byte
+	}
+	updateResponse struct {
+		Results []EntryResult
+	}
+)
+
+const (
+	jsonContentType  = "application/json"
+	bytesContentType = "application/octet-stream"
+)
+
+var (
+	ErrHighStatusCode            = errors.New("high status code")
+	ErrUnsupportedUpdateEncoding = errors.New("application does not accept the update encoding")
+)
+
+func newHTTPBackend(client *appClient, appURL env.AppURL) (*httpBackend, error) {
+	transport, err := newAppTransport(appURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &httpBackend{
+		client:         client,
+		baseURL:        appURL.BaseURL,
+		httpClient:     &http.Client{Transport: transport},
+		updateEncoding: env.Current.AppUpdateEncoding,
+	}, nil
+}
+
+func (e *appStatusError) Error() string {
+	return fmt.Sprintf("%s (%d): %s", ErrHighStatusCode, e.StatusCode, e.Body)
+}
+
+func (e *appStatusError) Unwrap() error {
+	return ErrHighStatusCode
+}
+
+func genHighStatusCodeError(statusCode int, body io.Reader) error {
+	allBytes, err := io.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("error in io.ReadAll: %w", err)
+	}
+
+	if len(allBytes) > 100 {
+		allBytes = allBytes[:100]
+	}
+
+	return &appStatusError{StatusCode: statusCode, Body: string(allBytes)}
+}
+
+// doJSON calls an idempotent callback, decoding the JSON response
+func doJSON[T any](ctx context.Context, b *httpBackend, callback appCallback, replica appReplica, contentType string, body []byte) (T, error) {
+	var resBody T
+	err := b.client.do(ctx, callback, replica, func(ctx context.Context) error {
+		res, err := b.send(ctx, callback, replica, contentType, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		resBytes, err := io.ReadAll(res.Body)
+		if err != nil {
+			return fmt.Errorf("error in io.ReadAll: %w", err)
+		}
+
+		err = json.Unmarshal(resBytes, &resBody)
+		if err != nil {
+			return fmt.Errorf("error in json.Unmarshal: %w", err)
+		}
+
+		return nil
+	})
+
+	return resBody, err
+}
+
+// send performs a request to the application, returning the response if it was successful. The caller is
+// responsible for closing the response body.
+func (b *httpBackend) send(ctx context.Context, callback appCallback, replica appReplica, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", b.baseURL+"/"+string(callback), body)
+	if err != nil {
+		return nil, fmt.Errorf("error in NewRequestWithContext: %w", err)
+	}
+	req.Header.Set("raftd-node-id", fmt.Sprint(replica.shardID))
+	req.Header.Set("raftd-replica-id", fmt.Sprint(replica.replicaID))
+	if contentType != "" {
+		req.Header.Set("content-type", contentType)
+	}
+	if sized, ok := body.(interface{ Len() int }); ok && req.ContentLength == 0 {
+		// Bodies that are encoded as they are read still have a known length
+		req.ContentLength = int64(sized.Len())
+	}
+
+	res, err := b.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error in http.Do: %w", err)
+	}
+
+	if res.StatusCode > 299 {
+		defer res.Body.Close()
+		return nil, genHighStatusCodeError(res.StatusCode, res.Body)
+	}
+
+	return res, nil
+}
+
+// LastLogIndex also checks that the application accepts the configured encoding of /UpdateEntries, so a replica
+// fails to open rather than failing every batch
+func (b *httpBackend) LastLogIndex(ctx context.Context, replica appReplica) (uint64, error) {
+	res, err := doJSON[struct {
+		LastLogIndex uint64
+		// UpdateEncodings are the encodings of /UpdateEntries the application accepts besides JSON
+		UpdateEncodings []string
+	}](ctx, b, callbackOpen, replica, "", nil)
+	if err != nil {
+		return 0, fmt.Errorf("error in doJSON: %w", err)
+	}
+
+	if b.updateEncoding != UpdateEncodingJSON && !slices.Contains(res.UpdateEncodings, b.updateEncoding) {
+		return 0, fmt.Errorf("%w: APP_UPDATE_ENCODING is %s, but /LastLogIndex only lists %v", ErrUnsupportedUpdateEncoding, b.updateEncoding, res.UpdateEncodings)
+	}
+
+	return res.LastLogIndex, nil
+}
+
+func (b *httpBackend) UpdateEntries(ctx context.Context, replica appReplica, entries []statemachine.Entry) ([]EntryResult, error) {
+	if b.updateEncoding == UpdateEncodingBinary {
+		return b.updateEntriesBinary(ctx, replica, entries)
+	}
+
+	jsonBytes, err := json.Marshal(map[string]any{
+		"Entries": lo.Map(entries, func(entry statemachine.Entry, index int) updateEntry {
+			return updateEntry{
+				Index: entry.Index,
+				Cmd:   entry.Cmd,
+			}
+		}),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error in json.Marshal: %w", err)
+	}
+
+	res, err := doJSON[updateResponse](ctx, b, callbackUpdate, replica, jsonContentType, jsonBytes)
+	if err != nil {
+		return nil, fmt.Errorf("error in doJSON: %w", err)
+	}
+
+	return res.Results, nil
+}
+
+// updateEntriesBinary sends the entries with binary framing. The application may respond with binary framed or
+// JSON results, according to the response content-type.
+func (b *httpBackend) updateEntriesBinary(ctx context.Context, replica appReplica, entries []statemachine.Entry) ([]EntryResult, error) {
+	if err := validateFrameEntries(entries); err != nil {
+		return nil, err
+	}
+
+	var results []EntryResult
+	err := b.client.do(ctx, callbackUpdate, replica, func(ctx context.Context) error {
+		// Every attempt encodes the entries again
+		res, err := b.send(ctx, callbackUpdate, replica, binaryContentType, newEntriesReader(entries))
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		if mediaType(res.Header.Get("content-type")) == binaryContentType {
+			results, err = decodeResults(res.Body)
+			return err
+		}
+
+		resBytes, err := io.ReadAll(res.Body)
+		if err != nil {
+			return fmt.Errorf("error in io.ReadAll: %w", err)
+		}
+		var resBody updateResponse
+		if err := json.Unmarshal(resBytes, &resBody); err != nil {
+			return fmt.Errorf("error in json.Unmarshal: %w", err)
+		}
+		results = resBody.Results
+		return nil
+	})
+
+	return results, err
+}
+
+// mediaType strips any parameters from a content-type
+func mediaType(contentType string) string {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	return strings.ToLower(strings.TrimSpace(mediaType))
+}
+
+func (b *httpBackend) Read(ctx context.Context, replica appReplica, query ReadQuery) (ReadResult, error) {
+	var result ReadResult
+	err := b.client.do(ctx, callbackRead, replica, func(ctx context.Context) error {
+		res, err := b.send(ctx, callbackRead, replica, query.ContentType, bytes.NewReader(query.Body))
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			return fmt.Errorf("error in io.ReadAll: %w", err)
+		}
+
+		result = ReadResult{
+			ContentType: res.Header.Get("content-type"),
+			Body:        body,
+		}
+		return nil
+	})
+
+	return result, err
+}
+
+func (b *httpBackend) Sync(ctx context.Context, replica appReplica) error {
+	return b.client.do(ctx, callbackSync, replica, func(ctx context.Context) error {
+		res, err := b.send(ctx, callbackSync, replica, "", nil)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		// The response is empty, but reading it lets the connection be reused
+		_, err = io.Copy(io.Discard, res.Body)
+		return err
+	})
+}
+
+func (b *httpBackend) PrepareSnapshot(ctx context.Context, replica appReplica) (any, error) {
+	res, err := doJSON[any](ctx, b, callbackPrepareSnapshot, replica, "", nil)
+	if err != nil {
+		return nil, fmt.Errorf("error in doJSON: %w", err)
+	}
+
+	return res, nil
+}
+
+func (b *httpBackend) SaveSnapshot(ctx context.Context, replica appReplica, state any, w io.Writer) error {
+	jsonBytes, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("error in json.Marshal: %w", err)
+	}
+
+	return b.client.stream(ctx, callbackSaveSnapshot, func(ctx context.Context) error {
+		res, err := b.send(ctx, callbackSaveSnapshot, replica, jsonContentType, bytes.NewReader(jsonBytes))
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		if _, err := io.Copy(w, res.Body); err != nil {
+			return fmt.Errorf("error in io.Copy: %w", err)
+		}
+
+		return nil
+	})
+}
+
+func (b *httpBackend) RecoverFromSnapshot(ctx context.Context, replica appReplica, r io.Reader) error {
+	return b.client.stream(ctx, callbackRecoverSnapshot, func(ctx context.Context) error {
+		res, err := b.send(ctx, callbackRecoverSnapshot, replica, bytesContentType, r)
+		if err != nil {
+			return err
+		}
+		return res.Body.Close()
+	})
+}
@@ -0,0 +1,123 @@
+package raft
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danthegoodman1/raftd/env"
+	"golang.org/x/net/http2"
+)
+
+const (
+	// AppProtocolHTTP1 uses HTTP/1.1, or HTTP/2 if negotiated over TLS
+	AppProtocolHTTP1 = "http1"
+	// AppProtocolH2C uses HTTP/2 with prior knowledge for http:// application URLs
+	AppProtocolH2C = "h2c"
+	// AppProtocolGRPC calls the application's gRPC App service instead of the HTTP callback API
+	AppProtocolGRPC = "grpc"
+)
+
+var (
+	ErrInvalidAppProtocol = errors.New("invalid application protocol")
+)
+
+type (
+	// limitedTransport caps the number of in flight requests to the application
+	limitedTransport struct {
+		transport http.RoundTripper
+		sem       chan struct{}
+	}
+
+	// releaseBody releases a limitedTransport slot once the response body is closed
+	releaseBody struct {
+		io.ReadCloser
+		once    sync.Once
+		release func()
+	}
+)
+
+// newAppTransport builds the transport shared by every shard for requests to the application
+func newAppTransport(appURL env.AppURL) (http.RoundTripper, error) {
+	keepAlive := time.Duration(env.Current.AppKeepAliveSec) * time.Second
+	idleConnTimeout := time.Duration(env.Current.AppIdleConnTimeoutSec) * time.Second
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: keepAlive,
+	}
+	dial := dialer.DialContext
+	if appURL.SocketPath != "" {
+		// Every request goes to the socket, whatever the placeholder host in the URL
+		dial = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", appURL.SocketPath)
+		}
+	}
+
+	var transport http.RoundTripper
+	switch {
+	case env.Current.AppProtocol == AppProtocolH2C && strings.HasPrefix(appURL.BaseURL, "http://"):
+		transport = &http2.Transport{
+			AllowHTTP: true,
+			// Prior knowledge h2c is HTTP/2 over a plain connection
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(ctx, network, addr)
+			},
+			IdleConnTimeout:            idleConnTimeout,
+			ReadIdleTimeout:            keepAlive,
+			StrictMaxConcurrentStreams: env.Current.AppMaxConcurrentStreams > 0,
+		}
+	case env.Current.AppProtocol == AppProtocolH2C || env.Current.AppProtocol == AppProtocolHTTP1:
+		transport = &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dial,
+			ForceAttemptHTTP2:     true, // only used for https://, where HTTP/2 is negotiated with ALPN
+			MaxIdleConns:          int(env.Current.AppMaxIdleConns),
+			MaxIdleConnsPerHost:   int(env.Current.AppMaxIdleConns),
+			MaxConnsPerHost:       int(env.Current.AppMaxConnsPerHost),
+			IdleConnTimeout:       idleConnTimeout,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: time.Second,
+		}
+	default:
+		return nil, fmt.Errorf("%w: '%s', must be %s or %s", ErrInvalidAppProtocol, env.Current.AppProtocol, AppProtocolHTTP1, AppProtocolH2C)
+	}
+
+	if env.Current.AppMaxConcurrentStreams > 0 {
+		transport = &limitedTransport{
+			transport: transport,
+			sem:       make(chan struct{}, env.Current.AppMaxConcurrentStreams),
+		}
+	}
+
+	return transport, nil
+}
+
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	select {
+	case t.sem <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+
+	res, err := t.transport.RoundTrip(req)
+	if err != nil {
+		<-t.sem
+		return nil, err
+	}
+
+	// The stream is in use until the body is closed
+	res.Body = &releaseBody{ReadCloser: res.Body, release: func() { <-t.sem }}
+	return res, nil
+}
+
+func (b *releaseBody) Close() error {
+	defer b.once.Do(b.release)
+	return b.ReadCloser.Close()
+}
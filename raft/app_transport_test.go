@@ -0,0 +1,58 @@
+package raft
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/danthegoodman1/raftd/env"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// BenchmarkAppTransport compares the shared application transport with http.DefaultClient against an application
+// that speaks h2c, with requests from many goroutines like those of many shards
+func BenchmarkAppTransport(b *testing.B) {
+	srv := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		_, _ = w.Write([]byte(`{"Results":[{"Value":1}]}`))
+	}), &http2.Server{}))
+	b.Cleanup(srv.Close)
+
+	b.Setenv("APP_PROTOCOL", AppProtocolH2C)
+	setTestEnv(b, b.TempDir(), 1, "127.0.0.1:1", "1=127.0.0.1:1", srv.URL)
+	appURL, err := env.ParseAppURL(srv.URL)
+	if err != nil {
+		b.Fatal(err)
+	}
+	transport, err := newAppTransport(appURL)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, bm := range []struct {
+		name   string
+		client *http.Client
+	}{
+		{name: "h2c", client: &http.Client{Transport: transport}},
+		{name: "default", client: http.DefaultClient},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			body := []byte(`{"Entries":[{"Index":1,"Cmd":"YQ=="}]}`)
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					res, err := bm.client.Post(srv.URL+"/UpdateEntries", "application/json", bytes.NewReader(body))
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					_, _ = io.Copy(io.Discard, res.Body)
+					_ = res.Body.Close()
+				}
+			})
+		})
+	}
+}
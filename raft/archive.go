@@ -0,0 +1,359 @@
+package raft
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/danthegoodman1/raftd/env"
+	"github.com/danthegoodman1/raftd/utils"
+	"github.com/lni/dragonboat/v4/tools"
+	"github.com/samber/lo"
+)
+
+// Archives hold an exported snapshot of every shard of a replica, for backups and for seeding a new cluster with
+// `raftd export` and `raftd import`. An archive is a gzipped tar of:
+//
+//	manifest.json                        the ArchiveManifest
+//	shards/<shardID>/snapshot-<index>/   the snapshot directory exported by dragonboat
+const (
+	ArchiveVersion = 1
+
+	archiveManifestFile = "manifest.json"
+	archiveShardsDir    = "shards"
+)
+
+type (
+	ArchiveManifest struct {
+		Version   int
+		CreatedAt time.Time
+		// ReplicaID is the replica the snapshots were exported from
+		ReplicaID uint64
+		// Shards are ordered by shard ID
+		Shards []ArchiveShard
+	}
+
+	ArchiveShard struct {
+		SnapshotMetadata
+		// Config is the raft config override of the shard, restored on import
+		Config *ShardConfig `json:",omitempty"`
+	}
+)
+
+var (
+	ErrInvalidArchive = errors.New("invalid archive")
+	// ErrReplicaNotEmpty is returned when importing into a replica that already has raft data
+	ErrReplicaNotEmpty = errors.New("replica already has raft data")
+)
+
+// NewArchiveExportDir creates a directory for the running raftd to export the snapshots of an archive to
+func NewArchiveExportDir() (string, error) {
+	return newExportDir("archive-")
+}
+
+// ArchiveShardExportDir is the directory the shard's snapshot is exported to under the archive's export dir
+func ArchiveShardExportDir(exportDir string, shardID uint64) string {
+	return filepath.Join(exportDir, strconv.FormatUint(shardID, 10))
+}
+
+// WriteArchive writes the snapshots exported to exportDir (see ArchiveShardExportDir) as an archive to w, along with
+// the shard configs of this replica. snapshotIndexes are the exported snapshot index of every shard.
+func WriteArchive(w io.Writer, exportDir string, snapshotIndexes map[uint64]uint64) (*ArchiveManifest, error) {
+	status, err := readReplicaStatus()
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := ArchiveManifest{
+		Version:   ArchiveVersion,
+		CreatedAt: time.Now(),
+		ReplicaID: env.Current.ReplicaID,
+	}
+	shardIDs := lo.Keys(snapshotIndexes)
+	slices.Sort(shardIDs)
+	for _, shardID := range shardIDs {
+		ss, err := readSnapshotMetadata(ExportedSnapshotDir(ArchiveShardExportDir(exportDir, shardID), snapshotIndexes[shardID]))
+		if err != nil {
+			return nil, fmt.Errorf("error reading snapshot of shard %d: %w", shardID, err)
+		}
+		if ss.Witness || ss.Dummy {
+			return nil, fmt.Errorf("shard %d: %w, export from a replica with a state machine", shardID, ErrWitness)
+		}
+		manifest.Shards = append(manifest.Shards, ArchiveShard{
+			SnapshotMetadata: newSnapshotMetadata(ss),
+			Config:           status.Shards[shardID].Config,
+		})
+	}
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling archive manifest: %w", err)
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    archiveManifestFile,
+		Mode:    0644,
+		Size:    int64(len(manifestData)),
+		ModTime: manifest.CreatedAt,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error in tw.WriteHeader: %w", err)
+	}
+	if _, err := tw.Write(manifestData); err != nil {
+		return nil, fmt.Errorf("error in tw.Write: %w", err)
+	}
+
+	for _, shard := range manifest.Shards {
+		snapshotDir := ExportedSnapshotDir(ArchiveShardExportDir(exportDir, shard.ShardID), shard.Index)
+		if err := addArchiveDir(tw, snapshotDir, archiveSnapshotDir(shard)); err != nil {
+			return nil, fmt.Errorf("error archiving snapshot of shard %d: %w", shard.ShardID, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("error in tw.Close: %w", err)
+	}
+	if err := gw.Close(); err != nil {
+		return nil, fmt.Errorf("error in gw.Close: %w", err)
+	}
+
+	return &manifest, nil
+}
+
+// archiveSnapshotDir is the slash separated path of the shard's snapshot directory in an archive
+func archiveSnapshotDir(shard ArchiveShard) string {
+	return path.Join(archiveShardsDir, strconv.FormatUint(shard.ShardID, 10), snapshotDirName(shard.Index))
+}
+
+// addArchiveDir adds the files of dir to the archive under name
+func addArchiveDir(tw *tar.Writer, dir, name string) error {
+	return filepath.WalkDir(dir, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			return fmt.Errorf("%s is not a regular file", filePath)
+		}
+
+		rel, err := filepath.Rel(dir, filePath)
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = path.Join(name, filepath.ToSlash(rel))
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		f, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
+
+// ImportArchive seeds this replica's raft data with the snapshots of an archive, so the shards start with members
+// as their membership. This replica must have no raft data yet, and raftd must not be running. Every replica of the
+// new member set imports the same archive.
+//
+// Once imported, every shard of this replica joins the new membership when raftd starts, so RAFT_INITIAL_MEMBERS
+// is not used for them.
+func ImportArchive(r io.Reader, members map[uint64]string) (*ArchiveManifest, error) {
+	nhc, err := nodeHostConfig()
+	if err != nil {
+		return nil, err
+	}
+	statusPath := filepath.Join(env.Current.RaftStorageDirectory, replicaStatusFile)
+	for _, existing := range lo.Uniq([]string{statusPath, nhc.NodeHostDir, nhc.WALDir}) {
+		if _, err := os.Stat(existing); err == nil {
+			return nil, fmt.Errorf("%w: %s exists, import needs a fresh RAFT_DIR", ErrReplicaNotEmpty, existing)
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("error in os.Stat: %w", err)
+		}
+	}
+	if err := checkImportMembers(members); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(env.Current.RaftStorageDirectory, 0755); err != nil {
+		return nil, fmt.Errorf("error creating raft storage directory: %w", err)
+	}
+	dir, err := os.MkdirTemp(env.Current.RaftStorageDirectory, ".import-")
+	if err != nil {
+		return nil, fmt.Errorf("error in os.MkdirTemp: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := extractArchive(r, dir); err != nil {
+		return nil, err
+	}
+	manifest, err := readArchiveManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	useRaftLogger()
+	status := raftReplicaStatus{
+		Shards:    map[uint64]shardStatus{},
+		ReplicaID: env.Current.ReplicaID,
+	}
+	for _, shard := range manifest.Shards {
+		snapshotDir := filepath.Join(dir, filepath.FromSlash(archiveSnapshotDir(shard)))
+		ss, err := readSnapshotMetadata(snapshotDir)
+		if err != nil {
+			return nil, fmt.Errorf("error reading snapshot of shard %d: %w", shard.ShardID, err)
+		}
+		if ss.ShardID != shard.ShardID || ss.Index != shard.Index {
+			return nil, fmt.Errorf("%w: snapshot of shard %d does not match the manifest", ErrInvalidArchive, shard.ShardID)
+		}
+
+		if err := tools.ImportSnapshot(nhc, snapshotDir, members, env.Current.ReplicaID); err != nil {
+			return nil, fmt.Errorf("error in tools.ImportSnapshot for shard %d: %w", shard.ShardID, err)
+		}
+		// The imported membership is recorded by dragonboat, so the shard is started as if it joined
+		status.Shards[shard.ShardID] = shardStatus{
+			Join:   true,
+			Config: shard.Config,
+		}
+	}
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling replica status: %w", err)
+	}
+	if err := utils.WriteFileAtomic(statusPath, data, 0644); err != nil {
+		return nil, fmt.Errorf("error writing replica status: %w", err)
+	}
+
+	return manifest, nil
+}
+
+// checkImportMembers checks that this replica is one of the members snapshots are imported with, at the address it
+// listens on
+func checkImportMembers(members map[uint64]string) error {
+	if addr, exists := members[env.Current.ReplicaID]; !exists || addr != env.Current.RaftListenAddr {
+		return fmt.Errorf("%w: members must include this replica (%d) at RAFT_LISTEN_ADDR %s", env.ErrInvalidMembers, env.Current.ReplicaID, env.Current.RaftListenAddr)
+	}
+	return nil
+}
+
+// extractArchive extracts the files of an archive to dir
+func extractArchive(r io.Reader, dir string) error {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidArchive, err)
+	}
+	defer gr.Close()
+
+	tr := tar.NewReader(gr)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidArchive, err)
+		}
+		if !filepath.IsLocal(header.Name) {
+			return fmt.Errorf("%w: path '%s' is outside of the archive", ErrInvalidArchive, header.Name)
+		}
+
+		target := filepath.Join(dir, filepath.FromSlash(header.Name))
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return fmt.Errorf("error in os.MkdirAll: %w", err)
+			}
+		case tar.TypeReg:
+			if err := extractArchiveFile(tr, target); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%w: '%s' is not a regular file or directory", ErrInvalidArchive, header.Name)
+		}
+	}
+}
+
+func extractArchiveFile(r io.Reader, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("error in os.MkdirAll: %w", err)
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error in os.OpenFile: %w", err)
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("%w: extracting '%s': %w", ErrInvalidArchive, target, err)
+	}
+
+	return f.Close()
+}
+
+func readArchiveManifest(dir string) (*ArchiveManifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, archiveManifestFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: missing %s", ErrInvalidArchive, archiveManifestFile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error in os.ReadFile: %w", err)
+	}
+
+	var manifest ArchiveManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("%w: unmarshaling manifest: %w", ErrInvalidArchive, err)
+	}
+	if manifest.Version != ArchiveVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d, this raftd supports version %d", ErrInvalidArchive, manifest.Version, ArchiveVersion)
+	}
+	if len(manifest.Shards) == 0 {
+		return nil, fmt.Errorf("%w: no shards", ErrInvalidArchive)
+	}
+
+	return &manifest, nil
+}
+
+// readReplicaStatus reads the status file of this replica, which is empty if raftd never started
+func readReplicaStatus() (raftReplicaStatus, error) {
+	var status raftReplicaStatus
+	data, err := os.ReadFile(filepath.Join(env.Current.RaftStorageDirectory, replicaStatusFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return status, nil
+	}
+	if err != nil {
+		return status, fmt.Errorf("error reading replica status file: %w", err)
+	}
+	if err := json.Unmarshal(data, &status); err != nil {
+		return status, fmt.Errorf("error unmarshaling replica status: %w", err)
+	}
+
+	return status, nil
+}
@@ -0,0 +1,76 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/danthegoodman1/raftd/env"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	_, appURL := newTestApp(t)
+	rm := startTestReplica(t, t.TempDir(), appURL)
+	waitForShardState(t, rm, 0, ShardStateReady)
+	mustPropose(t, rm, 0, "a")
+	mustPropose(t, rm, 0, "b")
+
+	// Export like `raftd export`
+	exportDir, err := NewArchiveExportDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	shardDir := ArchiveShardExportDir(exportDir, 0)
+	if err := os.Mkdir(shardDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	index, err := rm.CreateSnapshot(ctx, 0, SnapshotOptions{ExportPath: shardDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	exported, err := WriteArchive(&archive, exportDir, map[uint64]uint64{0: index})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exported.Shards) != 1 || exported.Shards[0].Index != index || exported.ReplicaID != 1 {
+		t.Fatalf("exported manifest %+v", exported)
+	}
+	if err := rm.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Import into a new cluster on a new host, which takes a new replica ID, with a new application
+	app, appURL := newTestApp(t)
+	raftAddr := freeAddr(t)
+	setTestEnv(t, t.TempDir(), 2, raftAddr, "2="+raftAddr, appURL)
+	imported, err := ImportArchive(&archive, map[uint64]string{2: raftAddr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imported.Shards) != 1 || imported.Shards[0].Index != index {
+		t.Fatalf("imported manifest %+v", imported)
+	}
+	if _, err := ImportArchive(bytes.NewReader(nil), map[uint64]string{2: raftAddr}); err == nil {
+		t.Fatal("imported into a replica that has raft data")
+	}
+
+	rm = newTestRaftManager(t)
+	waitForShardState(t, rm, 0, ShardStateReady)
+	mustPropose(t, rm, 0, "c")
+	if _, commands := app.state(); !slices.Equal(commands, []string{"a", "b", "c"}) {
+		t.Fatalf("application has commands %v after the import", commands)
+	}
+	membership, err := rm.GetMembership(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(membership.Members) != 1 || membership.Members[0].ReplicaID != env.Current.ReplicaID || membership.Members[0].Addr != raftAddr {
+		t.Fatalf("imported shard has members %+v", membership.Members)
+	}
+}
@@ -0,0 +1,257 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/danthegoodman1/raftd/env"
+	"github.com/danthegoodman1/raftd/utils"
+	"github.com/lni/dragonboat/v4"
+)
+
+type (
+	ProposalStatus string
+
+	// ProposalState is the progress of an async proposal
+	ProposalState struct {
+		ID      string
+		ShardID uint64
+		Status  ProposalStatus
+		// Result is set once the proposal is applied
+		Result *EntryResult `json:",omitempty"`
+		// Duplicate is set if a session proposal returned the result of an earlier one
+		Duplicate bool `json:",omitempty"`
+		// Error is set if the proposal failed
+		Error string `json:",omitempty"`
+	}
+
+	asyncProposal struct {
+		state ProposalState
+		// changed is closed and replaced whenever the state changes
+		changed chan struct{}
+		// expires is set once the proposal is finished
+		expires time.Time
+	}
+
+	// proposalStore holds the state of async proposals. Finished proposals are kept until their TTL passes, or until
+	// room is needed for new proposals.
+	proposalStore struct {
+		mu        sync.Mutex
+		proposals map[string]*asyncProposal
+		// finished are the IDs of finished proposals in the order they finished, which is also the order they expire
+		finished   []string
+		maxResults int
+		ttl        time.Duration
+	}
+)
+
+const proposalIDPrefix = "prop_"
+
+const (
+	// ProposalPending has been accepted by this replica, but not committed yet
+	ProposalPending ProposalStatus = "pending"
+	// ProposalCommitted has been committed to the log, but not applied by this replica yet
+	ProposalCommitted ProposalStatus = "committed"
+	ProposalApplied   ProposalStatus = "applied"
+	// ProposalDropped was not committed (e.g. the leader changed), and is safe to propose again
+	ProposalDropped ProposalStatus = "dropped"
+	// ProposalTimedOut did not finish in time. It may still have been applied!
+	ProposalTimedOut ProposalStatus = "timed_out"
+	// ProposalFailed failed for another reason, see the Error of the state
+	ProposalFailed ProposalStatus = "failed"
+)
+
+var (
+	ErrProposalNotFound = errors.New("proposal not found")
+	ErrTooManyProposals = errors.New("too many pending async proposals")
+)
+
+func newProposalStore() *proposalStore {
+	return &proposalStore{
+		proposals:  map[string]*asyncProposal{},
+		maxResults: int(env.Current.AsyncProposalMaxResults),
+		ttl:        time.Duration(env.Current.AsyncProposalResultTTLSec) * time.Second,
+	}
+}
+
+// Final is whether the proposal will not change anymore
+func (s ProposalStatus) Final() bool {
+	return s != ProposalPending && s != ProposalCommitted
+}
+
+// add tracks a new pending proposal, evicting the oldest finished proposal if the store is full
+func (s *proposalStore) add(shardID uint64) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.evictExpired(time.Now())
+	if len(s.proposals) >= s.maxResults {
+		if len(s.finished) == 0 {
+			return "", fmt.Errorf("%w: %d are pending", ErrTooManyProposals, len(s.proposals))
+		}
+		delete(s.proposals, s.finished[0])
+		s.finished = s.finished[1:]
+	}
+
+	id := utils.GenRandomID(proposalIDPrefix)
+	s.proposals[id] = &asyncProposal{
+		state: ProposalState{
+			ID:      id,
+			ShardID: shardID,
+			Status:  ProposalPending,
+		},
+		changed: make(chan struct{}),
+	}
+	return id, nil
+}
+
+// remove forgets a proposal that was never submitted
+func (s *proposalStore) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.proposals, id)
+}
+
+// update changes the state of a proposal, waking up anyone waiting on it
+func (s *proposalStore) update(id string, update func(state *ProposalState)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, exists := s.proposals[id]
+	if !exists {
+		return
+	}
+	update(&p.state)
+	close(p.changed)
+	p.changed = make(chan struct{})
+
+	if p.state.Status.Final() {
+		p.expires = time.Now().Add(s.ttl)
+		s.finished = append(s.finished, id)
+	}
+}
+
+// evictExpired must be called with the lock held
+func (s *proposalStore) evictExpired(now time.Time) {
+	for len(s.finished) > 0 {
+		p := s.proposals[s.finished[0]]
+		if p != nil && p.expires.After(now) {
+			return
+		}
+		delete(s.proposals, s.finished[0])
+		s.finished = s.finished[1:]
+	}
+}
+
+// wait returns the state of the proposal once it is final, or its current state once ctx is done
+func (s *proposalStore) wait(ctx context.Context, id string) (ProposalState, error) {
+	for {
+		s.mu.Lock()
+		s.evictExpired(time.Now())
+		p, exists := s.proposals[id]
+		if !exists {
+			s.mu.Unlock()
+			return ProposalState{}, fmt.Errorf("%w: %s", ErrProposalNotFound, id)
+		}
+		state, changed := p.state, p.changed
+		s.mu.Unlock()
+
+		if state.Status.Final() {
+			return state, nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return state, nil
+		}
+	}
+}
+
+// ProposeAsync submits cmd to the shard, returning the ID of the proposal as soon as it is accepted. Its progress and
+// result can be followed with GetProposal. With a non-zero sessionID, the proposal is made in that client session as
+// with ProposeInSession.
+func (rm *RaftManager) ProposeAsync(shardID, sessionID, series uint64, cmd []byte) (string, error) {
+	if _, isSession := decodeSessionEntry(cmd); isSession {
+		return "", fmt.Errorf("%w: commands can not start with the session envelope prefix", ErrInvalidCommand)
+	}
+	if sessionID != 0 {
+		if series == 0 {
+			return "", fmt.Errorf("%w: series must be >= 1", ErrInvalidSeries)
+		}
+		cmd = encodeSessionEntry(sessionEntry{
+			op:        sessionOpPropose,
+			sessionID: sessionID,
+			series:    series,
+			cmd:       cmd,
+		})
+	}
+
+	id, err := rm.proposals.add(shardID)
+	if err != nil {
+		return "", err
+	}
+
+	rs, err := rm.nodeHost.Propose(rm.nodeHost.GetNoOPSession(shardID), cmd, time.Duration(env.Current.AsyncProposalTimeoutSec)*time.Second)
+	if err != nil {
+		rm.proposals.remove(id)
+		return "", fmt.Errorf("error in nodeHost.Propose: %w", err)
+	}
+
+	go rm.trackProposal(id, sessionID, rs)
+	return id, nil
+}
+
+// trackProposal follows an async proposal until it is finished. Commit notifications are enabled for the node
+// host, so the result channel reports the commit before the final result.
+func (rm *RaftManager) trackProposal(id string, sessionID uint64, rs *dragonboat.RequestState) {
+	resultC := rs.ResultC()
+	r := <-resultC
+	if r.Committed() {
+		rm.proposals.update(id, func(state *ProposalState) {
+			state.Status = ProposalCommitted
+		})
+		r = <-resultC
+	}
+
+	var result EntryResult
+	duplicate := false
+	rawResult, err := requestResult(rs, r)
+	if err == nil {
+		if sessionID != 0 {
+			result, duplicate, err = sessionProposalResult(sessionID, rawResult)
+		} else {
+			result, err = decodeEntryResult(rawResult)
+		}
+	}
+
+	rm.proposals.update(id, func(state *ProposalState) {
+		state.Duplicate = duplicate
+		switch {
+		case err == nil:
+			state.Status = ProposalApplied
+			state.Result = &result
+		case errors.Is(err, ErrProposalDropped):
+			state.Status = ProposalDropped
+			state.Error = err.Error()
+		case errors.Is(err, dragonboat.ErrTimeout):
+			state.Status = ProposalTimedOut
+			state.Error = err.Error()
+		default:
+			state.Status = ProposalFailed
+			state.Error = err.Error()
+		}
+	})
+}
+
+// GetProposal returns the state of an async proposal. If wait is positive, it waits up to that long for the
+// proposal to finish before returning its current state.
+func (rm *RaftManager) GetProposal(ctx context.Context, id string, wait time.Duration) (ProposalState, error) {
+	ctx, cancel := context.WithTimeout(ctx, max(wait, 0))
+	defer cancel()
+
+	return rm.proposals.wait(ctx, id)
+}
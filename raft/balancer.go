@@ -0,0 +1,189 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/danthegoodman1/raftd/env"
+	"github.com/lni/dragonboat/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+type (
+	// leaderBalancer periodically moves leadership of shards led by this replica to other replicas until each
+	// replica leads its weighted share of the shards. Every replica runs its own balancer, and only ever gives away
+	// leadership, so balancers on different replicas never fight over the same shard.
+	leaderBalancer struct {
+		rm       *RaftManager
+		interval time.Duration
+		cooldown time.Duration
+		// weights are relative leader weights per replica ID, replicas not listed have a weight of 1
+		weights map[uint64]float64
+
+		lastTransfer time.Time
+	}
+)
+
+var (
+	ErrInvalidBalancerWeights = errors.New("invalid leader balancer weights")
+
+	balancerTransfers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "raftd_leader_balancer_transfers_total",
+		Help: "Leadership transfers started by the leader balancer, by result",
+	}, []string{"result"})
+	balancerLedShards = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "raftd_leader_balancer_led_shards",
+		Help: "Number of shards led by this replica as of the last balancer run",
+	})
+	balancerTargetShards = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "raftd_leader_balancer_target_shards",
+		Help: "Weighted number of shards this replica should lead as of the last balancer run",
+	})
+)
+
+// parseBalancerWeights parses a CSV of replicaID=weight pairs
+func parseBalancerWeights(s string) (map[uint64]float64, error) {
+	weights := map[uint64]float64{}
+	if s == "" {
+		return weights, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		idWeightPair := strings.SplitN(pair, "=", 2)
+		if len(idWeightPair) != 2 {
+			return nil, fmt.Errorf("%w: '%s' should be in the format replicaID=weight", ErrInvalidBalancerWeights, pair)
+		}
+		replicaID, err := strconv.ParseUint(idWeightPair[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid replica ID '%s'", ErrInvalidBalancerWeights, idWeightPair[0])
+		}
+		weight, err := strconv.ParseFloat(idWeightPair[1], 64)
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("%w: invalid weight '%s'", ErrInvalidBalancerWeights, idWeightPair[1])
+		}
+		weights[replicaID] = weight
+	}
+
+	return weights, nil
+}
+
+func newLeaderBalancer(rm *RaftManager) (*leaderBalancer, error) {
+	weights, err := parseBalancerWeights(env.Current.LeaderBalanceWeights)
+	if err != nil {
+		return nil, err
+	}
+
+	return &leaderBalancer{
+		rm:       rm,
+		interval: time.Duration(env.Current.LeaderBalanceIntervalSec) * time.Second,
+		cooldown: time.Duration(env.Current.LeaderBalanceCooldownSec) * time.Second,
+		weights:  weights,
+	}, nil
+}
+
+func (b *leaderBalancer) weight(replicaID uint64) float64 {
+	if weight, ok := b.weights[replicaID]; ok {
+		return weight
+	}
+	return 1
+}
+
+func (b *leaderBalancer) run() {
+	if b.interval <= 0 {
+		b.rm.logger.Info().Msg("leader balancer disabled")
+		return
+	}
+
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.rm.closing:
+			return
+		case <-ticker.C:
+		}
+
+		if time.Since(b.lastTransfer) < b.cooldown {
+			continue
+		}
+		b.balance()
+	}
+}
+
+// balance gives away leadership of at most one shard
+func (b *leaderBalancer) balance() {
+	me := env.Current.ReplicaID
+	info := b.rm.nodeHost.GetNodeHostInfo(dragonboat.NodeHostInfoOption{SkipLogInfo: true})
+
+	leaderCounts := map[uint64]int{}
+	replicas := map[uint64]struct{}{}
+	var totalLeaders int
+	for _, shard := range info.ShardInfoList {
+		for replicaID := range shard.Replicas {
+			replicas[replicaID] = struct{}{}
+		}
+		if shard.LeaderID != 0 {
+			leaderCounts[shard.LeaderID]++
+			totalLeaders++
+		}
+	}
+
+	var totalWeight float64
+	for replicaID := range replicas {
+		totalWeight += b.weight(replicaID)
+	}
+	if totalWeight == 0 {
+		return
+	}
+
+	target := float64(totalLeaders) * b.weight(me) / totalWeight
+	balancerLedShards.Set(float64(leaderCounts[me]))
+	balancerTargetShards.Set(target)
+	if float64(leaderCounts[me]) <= math.Ceil(target) {
+		return
+	}
+
+	// Find the shard whose leadership can go to the replica furthest below its share
+	var (
+		bestShard, bestTarget uint64
+		bestLoad              = math.Inf(1)
+	)
+	for _, shard := range info.ShardInfoList {
+		if shard.LeaderID != me || shard.IsNonVoting || shard.IsWitness {
+			continue
+		}
+		for replicaID := range shard.Replicas {
+			weight := b.weight(replicaID)
+			if replicaID == me || weight == 0 {
+				continue
+			}
+			load := float64(leaderCounts[replicaID]+1) / weight
+			// Only move if the target ends up less loaded than we are now, otherwise we would just swap the hotspot
+			if load < float64(leaderCounts[me])/b.weight(me) && load < bestLoad {
+				bestShard, bestTarget, bestLoad = shard.ShardID, replicaID, load
+			}
+		}
+	}
+	if bestTarget == 0 {
+		return
+	}
+
+	logger := b.rm.logger.With().Uint64("ShardID", bestShard).Uint64("Target", bestTarget).Int("Led", leaderCounts[me]).Float64("TargetLed", target).Logger()
+	logger.Info().Msg("leader balancer transferring leadership")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	b.lastTransfer = time.Now()
+	if _, err := b.rm.TransferLeader(ctx, bestShard, bestTarget); err != nil {
+		balancerTransfers.WithLabelValues("failed").Inc()
+		logger.Warn().Err(err).Msg("leader balancer failed to transfer leadership")
+		return
+	}
+	balancerTransfers.WithLabelValues("success").Inc()
+}
@@ -0,0 +1,186 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/danthegoodman1/raftd/env"
+	"github.com/lni/dragonboat/v4/config"
+)
+
+type (
+	// ShardConfig overrides the default raft config for a single shard. Unset fields use the defaults.
+	ShardConfig struct {
+		ElectionRTT            *uint64 `json:",omitempty"`
+		HeartbeatRTT           *uint64 `json:",omitempty"`
+		CheckQuorum            *bool   `json:",omitempty"`
+		PreVote                *bool   `json:",omitempty"`
+		SnapshotEntries        *uint64 `json:",omitempty"`
+		CompactionOverhead     *uint64 `json:",omitempty"`
+		OrderedConfigChange    *bool   `json:",omitempty"`
+		MaxInMemLogSize        *uint64 `json:",omitempty"`
+		SnapshotCompression    *string `json:",omitempty"` // none or snappy
+		EntryCompression       *string `json:",omitempty"` // none or snappy
+		DisableAutoCompactions *bool   `json:",omitempty"`
+		Quiesce                *bool   `json:",omitempty"`
+	}
+)
+
+var (
+	ErrInvalidConfig = errors.New("invalid raft config")
+)
+
+// defaultRaftConfig builds the raft config shared by every shard
+func defaultRaftConfig() (config.Config, error) {
+	snapshotCompression, err := parseCompression(env.Current.RaftSnapshotCompression)
+	if err != nil {
+		return config.Config{}, err
+	}
+	entryCompression, err := parseCompression(env.Current.RaftEntryCompression)
+	if err != nil {
+		return config.Config{}, err
+	}
+
+	rc := config.Config{
+		ReplicaID:               env.Current.ReplicaID,
+		ElectionRTT:             env.Current.RaftElectionRTT,
+		HeartbeatRTT:            env.Current.RaftHeartbeatRTT,
+		CheckQuorum:             env.Current.RaftCheckQuorum,
+		PreVote:                 env.Current.RaftPreVote,
+		SnapshotEntries:         env.Current.RaftSnapshotEntries,
+		CompactionOverhead:      env.Current.RaftCompactionOverhead,
+		OrderedConfigChange:     env.Current.RaftOrderedConfigChange,
+		MaxInMemLogSize:         env.Current.RaftMaxInMemLogSize,
+		SnapshotCompressionType: snapshotCompression,
+		EntryCompressionType:    entryCompression,
+		DisableAutoCompactions:  env.Current.RaftDisableAutoCompactions,
+		Quiesce:                 env.Current.RaftQuiesce,
+		ShardID:                 0, // initial shard
+	}
+	if err := validateRaftConfig(rc); err != nil {
+		return config.Config{}, err
+	}
+
+	return rc, nil
+}
+
+// nodeHostConfig builds the NodeHost config for this replica
+func nodeHostConfig() (config.NodeHostConfig, error) {
+	datadir := filepath.Join(env.Current.RaftStorageDirectory, fmt.Sprintf("node%d", env.Current.ReplicaID))
+	nhc := config.NodeHostConfig{
+		DeploymentID:        env.Current.RaftDeploymentID,
+		WALDir:              datadir,
+		NodeHostDir:         datadir,
+		RTTMillisecond:      env.Current.RaftRTTMillisecond,
+		RaftAddress:         env.Current.RaftListenAddr,
+		MutualTLS:           env.Current.RaftMutualTLS,
+		CAFile:              env.Current.RaftCAFile,
+		CertFile:            env.Current.RaftCertFile,
+		KeyFile:             env.Current.RaftKeyFile,
+		MaxSendQueueSize:    env.Current.RaftMaxSendQueueSize,
+		MaxReceiveQueueSize: env.Current.RaftMaxReceiveQueueSize,
+		// Async proposals report when they are committed
+		NotifyCommit: true,
+	}
+	if env.Current.RaftWALDirectory != "" {
+		nhc.WALDir = env.Current.RaftWALDirectory
+	}
+
+	if err := nhc.Validate(); err != nil {
+		return nhc, fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+
+	return nhc, nil
+}
+
+// Apply returns rc with the overrides applied
+func (sc *ShardConfig) Apply(rc config.Config) (config.Config, error) {
+	if sc == nil {
+		return rc, nil
+	}
+
+	setIfNotNil(&rc.ElectionRTT, sc.ElectionRTT)
+	setIfNotNil(&rc.HeartbeatRTT, sc.HeartbeatRTT)
+	setIfNotNil(&rc.CheckQuorum, sc.CheckQuorum)
+	setIfNotNil(&rc.PreVote, sc.PreVote)
+	setIfNotNil(&rc.SnapshotEntries, sc.SnapshotEntries)
+	setIfNotNil(&rc.CompactionOverhead, sc.CompactionOverhead)
+	setIfNotNil(&rc.OrderedConfigChange, sc.OrderedConfigChange)
+	setIfNotNil(&rc.MaxInMemLogSize, sc.MaxInMemLogSize)
+	setIfNotNil(&rc.DisableAutoCompactions, sc.DisableAutoCompactions)
+	setIfNotNil(&rc.Quiesce, sc.Quiesce)
+
+	var err error
+	if sc.SnapshotCompression != nil {
+		if rc.SnapshotCompressionType, err = parseCompression(*sc.SnapshotCompression); err != nil {
+			return rc, err
+		}
+	}
+	if sc.EntryCompression != nil {
+		if rc.EntryCompressionType, err = parseCompression(*sc.EntryCompression); err != nil {
+			return rc, err
+		}
+	}
+
+	return rc, validateRaftConfig(rc)
+}
+
+func setIfNotNil[T any](dst *T, src *T) {
+	if src != nil {
+		*dst = *src
+	}
+}
+
+func parseCompression(s string) (config.CompressionType, error) {
+	switch s {
+	case "", "none":
+		return config.NoCompression, nil
+	case "snappy":
+		return config.Snappy, nil
+	default:
+		return config.NoCompression, fmt.Errorf("%w: unknown compression '%s', must be none or snappy", ErrInvalidConfig, s)
+	}
+}
+
+// validateRaftConfig checks for combinations dragonboat would reject when starting the shard
+func validateRaftConfig(rc config.Config) error {
+	if err := rc.Validate(); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+
+	return nil
+}
+
+// shardConfig returns the raft config the shard was started with
+func (rm *RaftManager) shardConfig(shardID uint64) config.Config {
+	if rc, ok := rm.shardConfigs.Load(shardID); ok {
+		return rc
+	}
+	return rm.raftConfig
+}
+
+// electionTimeout is the minimum time before followers of the shard will vote for a new leader
+func (rm *RaftManager) electionTimeout(shardID uint64) time.Duration {
+	return time.Duration(rm.shardConfig(shardID).ElectionRTT*rm.rttMillisecond) * time.Millisecond
+}
+
+// CheckConfig validates the raft related settings of the current config without starting anything
+func CheckConfig() error {
+	var errs []error
+	if _, err := defaultRaftConfig(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := nodeHostConfig(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := ParseReadinessPolicy(env.Current.ReadinessPolicy, env.Current.ReadinessShards); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := parseBalancerWeights(env.Current.LeaderBalanceWeights); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
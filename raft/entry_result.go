@@ -0,0 +1,91 @@
+package raft
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/lni/dragonboat/v4/statemachine"
+)
+
+type (
+	// EntryResult is the application's result for an entry from /UpdateEntries
+	EntryResult struct {
+		Value uint64
+		Data  []byte
+		// Status is an HTTP status code, 0 is the same as 200. A status outside of 2xx means the entry was applied,
+		// but logically rejected (e.g. a failed precondition).
+		Status int `json:",omitempty"`
+		// Error explains a rejection
+		Error string `json:",omitempty"`
+	}
+)
+
+// entryResultHeaderSize is the status uint16 and error length uint32 that prefix the data of an encoded result
+const entryResultHeaderSize = 2 + 4
+
+var (
+	ErrInvalidEntryResult = errors.New("invalid entry result")
+)
+
+// Rejected is whether the application applied the entry, but rejected it
+func (r EntryResult) Rejected() bool {
+	return r.Status != 0 && (r.Status < 200 || r.Status > 299)
+}
+
+// HTTPStatus is the status code the application gave the entry, 200 if it gave none
+func (r EntryResult) HTTPStatus() int {
+	if r.Status == 0 {
+		return http.StatusOK
+	}
+	return r.Status
+}
+
+// validateEntryResults checks that results follow the /UpdateEntries protocol for the entries they were returned
+// for. An empty response is allowed, and means every entry has a zero result.
+func validateEntryResults(entries []statemachine.Entry, results []EntryResult) error {
+	if len(results) != 0 && len(results) != len(entries) {
+		return fmt.Errorf("%w: %d results for %d entries, there must be one result for each entry or none", ErrInvalidEntryResult, len(results), len(entries))
+	}
+	for i, result := range results {
+		if result.Status != 0 && (result.Status < 200 || result.Status > 599) {
+			return fmt.Errorf("%w: entry %d has status %d, it must be 0 or 200-599", ErrInvalidEntryResult, entries[i].Index, result.Status)
+		}
+	}
+
+	return nil
+}
+
+// encodeEntryResult packs an EntryResult into the result dragonboat returns to the proposer. All integers are big
+// endian: status uint16, error length uint32, error, then data.
+func encodeEntryResult(result EntryResult) statemachine.Result {
+	data := make([]byte, entryResultHeaderSize, entryResultHeaderSize+len(result.Error)+len(result.Data))
+	binary.BigEndian.PutUint16(data, uint16(result.Status))
+	binary.BigEndian.PutUint32(data[2:], uint32(len(result.Error)))
+	data = append(data, result.Error...)
+	return statemachine.Result{
+		Value: result.Value,
+		Data:  append(data, result.Data...),
+	}
+}
+
+func decodeEntryResult(result statemachine.Result) (EntryResult, error) {
+	if len(result.Data) < entryResultHeaderSize {
+		return EntryResult{}, fmt.Errorf("%w: %d bytes is too short", ErrInvalidEntryResult, len(result.Data))
+	}
+	errorSize := uint64(binary.BigEndian.Uint32(result.Data[2:]))
+	if uint64(len(result.Data)-entryResultHeaderSize) < errorSize {
+		return EntryResult{}, fmt.Errorf("%w: error is truncated", ErrInvalidEntryResult)
+	}
+
+	decoded := EntryResult{
+		Value:  result.Value,
+		Status: int(binary.BigEndian.Uint16(result.Data)),
+		Error:  string(result.Data[entryResultHeaderSize : entryResultHeaderSize+errorSize]),
+	}
+	if data := result.Data[entryResultHeaderSize+errorSize:]; len(data) > 0 {
+		decoded.Data = data
+	}
+	return decoded, nil
+}
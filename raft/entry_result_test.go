@@ -0,0 +1,75 @@
+package raft
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/lni/dragonboat/v4/statemachine"
+)
+
+func TestEntryResultRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		result EntryResult
+	}{
+		{name: "empty", result: EntryResult{}},
+		{name: "value", result: EntryResult{Value: 1 << 63}},
+		{name: "data", result: EntryResult{Value: 1, Data: []byte("data")}},
+		{name: "rejected", result: EntryResult{Value: 2, Status: 409, Error: "already exists"}},
+		{name: "rejected with data", result: EntryResult{Status: 412, Data: []byte{0, 1, 2}, Error: "precondition failed"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			decoded, err := decodeEntryResult(encodeEntryResult(tc.result))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded, tc.result) {
+				t.Fatalf("decoded %+v, want %+v", decoded, tc.result)
+			}
+		})
+	}
+}
+
+func TestDecodeEntryResultMalformed(t *testing.T) {
+	valid := encodeEntryResult(EntryResult{Status: 409, Data: []byte("data"), Error: "error"}).Data
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{name: "empty", data: nil},
+		{name: "truncated header", data: valid[:entryResultHeaderSize-1]},
+		{name: "truncated error", data: valid[:entryResultHeaderSize+len("error")-1]},
+		{name: "huge error length", data: []byte{0, 0, 0xFF, 0xFF, 0xFF, 0xFF, 'a'}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := decodeEntryResult(statemachine.Result{Data: tc.data})
+			if !errors.Is(err, ErrInvalidEntryResult) {
+				t.Fatalf("got result %+v and error %v, want %v", result, err, ErrInvalidEntryResult)
+			}
+		})
+	}
+}
+
+func TestValidateEntryResults(t *testing.T) {
+	entries := []statemachine.Entry{{Index: 1}, {Index: 2}}
+	for _, tc := range []struct {
+		name    string
+		results []EntryResult
+		valid   bool
+	}{
+		{name: "no results", valid: true},
+		{name: "result for each entry", results: []EntryResult{{Value: 1}, {Status: 599, Error: "unavailable"}}, valid: true},
+		{name: "too few results", results: []EntryResult{{Value: 1}}},
+		{name: "too many results", results: []EntryResult{{}, {}, {}}},
+		{name: "status below 200", results: []EntryResult{{}, {Status: 100}}},
+		{name: "status above 599", results: []EntryResult{{Status: 600}, {}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateEntryResults(entries, tc.results)
+			if tc.valid != (err == nil) || (err != nil && !errors.Is(err, ErrInvalidEntryResult)) {
+				t.Fatalf("got error %v", err)
+			}
+		})
+	}
+}
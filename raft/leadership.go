@@ -0,0 +1,103 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+const leaderPollInterval = 10 * time.Millisecond
+
+var (
+	ErrNoTransferTarget = errors.New("no replica to transfer leadership to")
+	ErrInvalidTarget    = errors.New("target is not a voting member of the shard")
+)
+
+// TransferLeader requests that leadership of the shard moves to targetReplicaID, waiting until the new leader is
+// observed. If targetReplicaID is 0, leadership is moved to any other voting member that can take it. Returns the
+// ID of the new leader.
+func (rm *RaftManager) TransferLeader(ctx context.Context, shardID, targetReplicaID uint64) (uint64, error) {
+	// Add deadline if not set
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+	}
+
+	membership, err := rm.GetMembership(ctx, shardID)
+	if err != nil {
+		return 0, err
+	}
+
+	var candidates []uint64
+	for _, member := range membership.Members {
+		if membership.Leader != nil && member.ReplicaID == membership.Leader.ReplicaID {
+			continue
+		}
+		if targetReplicaID == 0 || member.ReplicaID == targetReplicaID {
+			candidates = append(candidates, member.ReplicaID)
+		}
+	}
+
+	if targetReplicaID != 0 {
+		if membership.Leader != nil && membership.Leader.ReplicaID == targetReplicaID {
+			// Already the leader
+			return targetReplicaID, nil
+		}
+		if len(candidates) == 0 {
+			return 0, fmt.Errorf("%w: %d", ErrInvalidTarget, targetReplicaID)
+		}
+	}
+	if len(candidates) == 0 {
+		return 0, ErrNoTransferTarget
+	}
+
+	// Try each candidate in turn, giving each an even share of the remaining time. A follower that is down or
+	// lagging won't take leadership, so we move on to the next one.
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	for i, candidate := range candidates {
+		deadline, _ := ctx.Deadline()
+		attemptCtx, cancel := context.WithTimeout(ctx, time.Until(deadline)/time.Duration(len(candidates)-i))
+		err = rm.transferLeaderTo(attemptCtx, shardID, candidate)
+		cancel()
+		if err == nil {
+			rm.logger.Info().Uint64("ShardID", shardID).Uint64("Leader", candidate).Msg("transferred leadership")
+			return candidate, nil
+		}
+		rm.logger.Warn().Err(err).Uint64("ShardID", shardID).Uint64("Target", candidate).Msg("leadership transfer failed")
+	}
+
+	return 0, fmt.Errorf("error transferring leadership: %w", err)
+}
+
+func (rm *RaftManager) transferLeaderTo(ctx context.Context, shardID, targetReplicaID uint64) error {
+	// A transferee is allowed to bypass the leader lease, so stop serving lease reads
+	progress := rm.getProgress(shardID)
+	progress.leaseExpiry.Store(0)
+
+	if err := rm.nodeHost.RequestLeaderTransfer(shardID, targetReplicaID); err != nil {
+		return fmt.Errorf("error in nodeHost.RequestLeaderTransfer: %w", err)
+	}
+
+	ticker := time.NewTicker(leaderPollInterval)
+	defer ticker.Stop()
+	for {
+		leaderID, _, valid, err := rm.nodeHost.GetLeaderID(shardID)
+		if err != nil {
+			return fmt.Errorf("error in nodeHost.GetLeaderID: %w", err)
+		}
+		if valid && leaderID == targetReplicaID {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for %d to become leader: %w", targetReplicaID, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
@@ -1,11 +1,23 @@
 package raft
 
 import (
+	"sync"
+
 	"github.com/danthegoodman1/raftd/gologger"
 	dragonlogger "github.com/lni/dragonboat/v4/logger"
 	"github.com/rs/zerolog"
 )
 
+var setLoggerFactoryOnce sync.Once
+
+// useRaftLogger routes dragonboat's logs through gologger. Dragonboat panics if the factory is set twice, which
+// happens when a command opens raft data more than once.
+func useRaftLogger() {
+	setLoggerFactoryOnce.Do(func() {
+		dragonlogger.SetLoggerFactory(CreateLogger)
+	})
+}
+
 type RaftGoLogger struct {
 	level  dragonlogger.LogLevel
 	logger zerolog.Logger
@@ -1,14 +1,29 @@
 package raft
 
 import (
+	"cmp"
 	"context"
 	"fmt"
+	"slices"
+	"time"
+
+	"github.com/lni/dragonboat/v4"
+	"github.com/samber/lo"
 )
 
 type (
 	Membership struct {
-		Leader  Member   `json:"leader"`
-		Members []Member `json:"members"`
+		ShardID uint64 `json:"shardID"`
+		// Leader is nil if the leader is not currently known by this replica
+		Leader            *Member  `json:"leader"`
+		Term              uint64   `json:"term"`
+		ConfigChangeIndex uint64   `json:"configChangeIndex"`
+		Members           []Member `json:"members"`
+		NonVoting         []Member `json:"nonVoting"`
+		Witnesses         []Member `json:"witnesses"`
+		Removed           []uint64 `json:"removed"`
+		// Error is set if the membership of this shard could not be fetched when listing all shards
+		Error string `json:"error,omitempty"`
 	}
 
 	Member struct {
@@ -18,13 +33,16 @@ type (
 )
 
 func (rm *RaftManager) GetMembership(ctx context.Context, shard uint64) (*Membership, error) {
-	leader, _, available, err := rm.nodeHost.GetLeaderID(shard)
-	if err != nil {
-		return nil, fmt.Errorf("error getting membership: %e", err)
+	// Add deadline if not set
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
 	}
 
-	if !available {
-		return nil, fmt.Errorf("raft membership not avilable")
+	leader, term, available, err := rm.nodeHost.GetLeaderID(shard)
+	if err != nil {
+		return nil, fmt.Errorf("error getting membership: %w", err)
 	}
 
 	membership, err := rm.nodeHost.SyncGetShardMembership(ctx, shard)
@@ -32,19 +50,67 @@ func (rm *RaftManager) GetMembership(ctx context.Context, shard uint64) (*Member
 		return nil, fmt.Errorf("error in nodeHost.SyncGetShardMembership: %w", err)
 	}
 
-	m := &Membership{}
-	for id, node := range membership.Nodes {
-		if id == leader {
-			m.Leader = Member{
-				ReplicaID: id,
-				Addr:      node,
-			}
+	m := &Membership{
+		ShardID:           shard,
+		Term:              term,
+		ConfigChangeIndex: membership.ConfigChangeID,
+		Members:           toMembers(membership.Nodes),
+		NonVoting:         toMembers(membership.NonVotings),
+		Witnesses:         toMembers(membership.Witnesses),
+		Removed:           lo.Keys(membership.Removed),
+	}
+	slices.Sort(m.Removed)
+
+	if addr, isMember := membership.Nodes[leader]; available && isMember {
+		m.Leader = &Member{
+			ReplicaID: leader,
+			Addr:      addr,
 		}
-		m.Members = append(m.Members, Member{
+	}
+
+	return m, nil
+}
+
+// GetAllMemberships returns the membership of every shard on this replica. Shards whose membership could not be
+// fetched have Error set.
+func (rm *RaftManager) GetAllMemberships(ctx context.Context) []Membership {
+	memberships := make([]Membership, 0)
+	for _, shardID := range rm.ShardIDs() {
+		m, err := rm.GetMembership(ctx, shardID)
+		if err != nil {
+			memberships = append(memberships, Membership{
+				ShardID: shardID,
+				Error:   err.Error(),
+			})
+			continue
+		}
+		memberships = append(memberships, *m)
+	}
+
+	return memberships
+}
+
+// ShardIDs returns the IDs of every shard on this replica in ascending order
+func (rm *RaftManager) ShardIDs() []uint64 {
+	rm.statusMu.Lock()
+	defer rm.statusMu.Unlock()
+
+	shardIDs := lo.Keys(rm.status.Shards)
+	slices.Sort(shardIDs)
+	return shardIDs
+}
+
+func toMembers(nodes map[uint64]dragonboat.Target) []Member {
+	members := make([]Member, 0, len(nodes))
+	for id, addr := range nodes {
+		members = append(members, Member{
 			ReplicaID: id,
-			Addr:      node,
+			Addr:      addr,
 		})
 	}
+	slices.SortFunc(members, func(a, b Member) int {
+		return cmp.Compare(a.ReplicaID, b.ReplicaID)
+	})
 
-	return m, nil
+	return members
 }
@@ -0,0 +1,85 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lni/dragonboat/v4"
+	"github.com/lni/dragonboat/v4/statemachine"
+)
+
+var (
+	ErrProposalDropped  = errors.New("proposal dropped")
+	ErrProposalRejected = errors.New("proposal rejected")
+	ErrProposalAborted  = errors.New("proposal aborted")
+)
+
+// Propose submits cmd to the shard and waits until it has been committed and applied by the application,
+// returning the result that the application provided for the entry in /UpdateEntries.
+func (rm *RaftManager) Propose(ctx context.Context, shardID uint64, cmd []byte) (EntryResult, error) {
+	if _, isSession := decodeSessionEntry(cmd); isSession {
+		return EntryResult{}, fmt.Errorf("%w: commands can not start with the session envelope prefix", ErrInvalidCommand)
+	}
+
+	result, err := rm.propose(ctx, shardID, cmd)
+	if err != nil {
+		return EntryResult{}, err
+	}
+
+	return decodeEntryResult(result)
+}
+
+func (rm *RaftManager) propose(ctx context.Context, shardID uint64, cmd []byte) (statemachine.Result, error) {
+	// Add deadline if not set
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+	}
+
+	deadline, _ := ctx.Deadline()
+	rs, err := rm.nodeHost.Propose(rm.nodeHost.GetNoOPSession(shardID), cmd, time.Until(deadline))
+	if err != nil {
+		return statemachine.Result{}, fmt.Errorf("error in nodeHost.Propose: %w", err)
+	}
+
+	return waitForApplied(ctx, rs)
+}
+
+// waitForApplied waits for the final outcome of a proposal, translating dragonboat's result codes into errors.
+// Unlike dragonboat's sync methods, a dropped proposal is reported as ErrProposalDropped rather than
+// dragonboat.ErrShardNotReady so callers can tell the two apart.
+func waitForApplied(ctx context.Context, rs *dragonboat.RequestState) (statemachine.Result, error) {
+	select {
+	case r := <-rs.AppliedC():
+		return requestResult(rs, r)
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return statemachine.Result{}, dragonboat.ErrTimeout
+		}
+		return statemachine.Result{}, ctx.Err()
+	}
+}
+
+// requestResult translates the final outcome of a proposal into its result or an error
+func requestResult(rs *dragonboat.RequestState, r dragonboat.RequestResult) (statemachine.Result, error) {
+	switch {
+	case r.Completed():
+		rs.Release()
+		return r.GetResult(), nil
+	case r.Timeout():
+		return statemachine.Result{}, dragonboat.ErrTimeout
+	case r.Dropped():
+		return statemachine.Result{}, ErrProposalDropped
+	case r.Rejected():
+		return statemachine.Result{}, ErrProposalRejected
+	case r.Terminated():
+		return statemachine.Result{}, dragonboat.ErrShardClosed
+	case r.Aborted():
+		return statemachine.Result{}, ErrProposalAborted
+	default:
+		return statemachine.Result{}, fmt.Errorf("unknown proposal result: %+v", r)
+	}
+}
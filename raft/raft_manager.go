@@ -6,11 +6,9 @@ import (
 	"errors"
 	"fmt"
 	"github.com/danthegoodman1/raftd/syncx"
-	"net/url"
 	"os"
 	"path/filepath"
-	"strconv"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/danthegoodman1/raftd/utils"
@@ -19,9 +17,8 @@ import (
 	"github.com/danthegoodman1/raftd/gologger"
 	"github.com/lni/dragonboat/v4"
 	"github.com/lni/dragonboat/v4/config"
-	dragonlogger "github.com/lni/dragonboat/v4/logger"
-	"github.com/lni/dragonboat/v4/statemachine"
 	"github.com/rs/zerolog"
+	"github.com/samber/lo"
 )
 
 const replicaStatusFile = "replica_status.json"
@@ -30,37 +27,76 @@ type (
 	RaftManager struct {
 		nodeHost *dragonboat.NodeHost
 		logger   zerolog.Logger
-		Ready    *syncx.Map[uint64, bool]
+		Ready    *syncx.Map[uint64, ShardState]
+
+		// progress tracks the local apply and read freshness of each shard
+		progress       syncx.Map[uint64, *shardProgress]
+		rttMillisecond uint64
+		// shardConfigs are the raft configs of the running shards, with their overrides applied
+		shardConfigs syncx.Map[uint64, config.Config]
+		appBackend   appBackend
+		// proposals tracks async proposals made on this replica
+		proposals *proposalStore
+		// raftConfig is the base config for every shard started on this replica
+		raftConfig config.Config
+
+		statusMu   sync.Mutex
+		status     raftReplicaStatus
+		statusPath string
+
+		readinessPolicy ReadinessPolicy
+		closing         chan struct{}
 	}
 
 	raftReplicaStatus struct {
-		Shards    map[uint64]struct{}
+		Shards    map[uint64]shardStatus
 		ReplicaID uint64
 	}
+
+	shardStatus struct {
+		// InitialMembers is the member set the shard was created with, empty if this replica joined the shard
+		InitialMembers map[uint64]dragonboat.Target `json:",omitempty"`
+		// Witnesses are the initial witnesses of the shard, which are added by the leader once the shard starts
+		Witnesses map[uint64]dragonboat.Target `json:",omitempty"`
+		Join      bool
+		// IsWitness is set if this replica is a witness of the shard, which has no state machine
+		IsWitness bool `json:",omitempty"`
+		// IsNonVoting is set if this replica joined the shard as a non-voting replica. It stays set once the replica
+		// is promoted, as dragonboat replays it joining as one when it restarts.
+		IsNonVoting bool `json:",omitempty"`
+		// Config overrides the default raft config for this shard
+		Config *ShardConfig `json:",omitempty"`
+	}
 )
 
 var (
-	ErrInvalidPeer = errors.New("invalid peer")
+	ErrNotNonVoting   = errors.New("not a non-voting replica")
+	ErrReplicaLagging = errors.New("replica is too far behind the leader")
+
+	ErrInvalidReplicaType = errors.New("invalid replica type")
 )
 
-func NewRaftManager(readyMap *syncx.Map[uint64, bool]) (*RaftManager, error) {
+func NewRaftManager(readyMap *syncx.Map[uint64, ShardState]) (*RaftManager, error) {
 	logger := gologger.NewLogger().With().Str("Service", "RaftManager").Logger()
 
 	// Create raft storage directory if it doesn't exist
-	if err := os.MkdirAll(env.RaftStorageDirectory, 0755); err != nil {
+	if err := os.MkdirAll(env.Current.RaftStorageDirectory, 0755); err != nil {
 		return nil, fmt.Errorf("error creating raft storage directory: %w", err)
 	}
+	if err := removeSnapshotExports(); err != nil {
+		return nil, fmt.Errorf("error removing snapshot exports: %w", err)
+	}
 
 	// Load or create replica status
-	statusPath := filepath.Join(env.RaftStorageDirectory, replicaStatusFile)
+	statusPath := filepath.Join(env.Current.RaftStorageDirectory, replicaStatusFile)
 	var status raftReplicaStatus
 
 	if data, err := os.ReadFile(statusPath); err != nil {
 		if os.IsNotExist(err) {
 			// Initialize new status with shard 0
 			status = raftReplicaStatus{
-				Shards:    map[uint64]struct{}{0: {}},
-				ReplicaID: env.ReplicaID,
+				Shards:    map[uint64]shardStatus{0: {}},
+				ReplicaID: env.Current.ReplicaID,
 			}
 			// Save the initial status
 			if data, err := json.Marshal(status); err != nil {
@@ -75,94 +111,116 @@ func NewRaftManager(readyMap *syncx.Map[uint64, bool]) (*RaftManager, error) {
 		return nil, fmt.Errorf("error unmarshaling replica status: %w", err)
 	}
 
-	if env.ReplicaID != status.ReplicaID {
-		logger.Fatal().Msgf("detected different replica IDs: %d != %d. If this is intentional, you must wipe the raft storage directory (you will lose all data on this replica!)", env.ReplicaID, status.ReplicaID)
+	if status.Shards == nil {
+		status.Shards = map[uint64]shardStatus{}
+	}
+
+	if env.Current.ReplicaID != status.ReplicaID {
+		logger.Fatal().Msgf("detected different replica IDs: %d != %d. If this is intentional, you must wipe the raft storage directory (you will lose all data on this replica!)", env.Current.ReplicaID, status.ReplicaID)
 	}
 
-	// Validate the application url
-	_, err := url.Parse(env.ApplicationURL)
+	readinessPolicy, err := ParseReadinessPolicy(env.Current.ReadinessPolicy, env.Current.ReadinessShards)
 	if err != nil {
-		return nil, fmt.Errorf("error parsing application url: %w", err)
-	}
-
-	// TODO when a shard is started, mark it ready
-	readyMap.Store(0, true)
-
-	// TODO allow customization of configuration options (esp snapshot entries)
-	rc := config.Config{
-		ReplicaID:          env.ReplicaID,
-		ElectionRTT:        10,
-		HeartbeatRTT:       1,
-		CheckQuorum:        true,
-		SnapshotEntries:    1000,
-		CompactionOverhead: 5,
-		ShardID:            0, // initial shard
-	}
-	datadir := filepath.Join(env.RaftStorageDirectory, fmt.Sprintf("node%d", env.ReplicaID))
-	nhc := config.NodeHostConfig{
-		WALDir:         datadir,
-		NodeHostDir:    datadir,
-		RTTMillisecond: 3,
-		RaftAddress:    env.RaftListenAddr,
-	}
-	dragonlogger.SetLoggerFactory(CreateLogger)
-	nh, err := dragonboat.NewNodeHost(nhc)
+		return nil, err
+	}
+
+	rc, err := defaultRaftConfig()
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	nhc, err := nodeHostConfig()
+	if err != nil {
+		return nil, err
 	}
 
-	initialMembers := map[uint64]dragonboat.Target{}
-	for _, peerPair := range strings.Split(env.RaftInitialMembers, ",") {
-		idAddrPair := strings.SplitN(peerPair, "=", 2)
-		if len(idAddrPair) != 2 {
-			return nil, fmt.Errorf("invalid peer pair '%s', should be in the format replicaID=addr: %w", peerPair, ErrInvalidPeer)
+	// Check the overrides of every shard up front, rather than failing them one by one once the node host is up
+	for shardID, shard := range status.Shards {
+		if _, err := shard.Config.Apply(rc); err != nil {
+			return nil, fmt.Errorf("invalid config for shard %d: %w", shardID, err)
 		}
+	}
 
-		replicaID, err := strconv.ParseInt(idAddrPair[0], 10, 64)
-		if err != nil {
-			return nil, fmt.Errorf("error parsing peer node ID: %w", err)
-		}
+	backend, err := newAppBackend()
+	if err != nil {
+		return nil, err
+	}
 
-		initialMembers[uint64(replicaID)] = idAddrPair[1]
+	useRaftLogger()
+	nh, err := dragonboat.NewNodeHost(nhc)
+	if err != nil {
+		panic(err)
 	}
 
-	if len(initialMembers) > 0 {
-		logger.Debug().Interface("raft initial members", initialMembers).Msg("Using raft initial members")
+	rm := &RaftManager{
+		nodeHost:        nh,
+		logger:          logger,
+		Ready:           readyMap,
+		progress:        syncx.NewMap[uint64, *shardProgress](),
+		rttMillisecond:  nhc.RTTMillisecond,
+		shardConfigs:    syncx.NewMap[uint64, config.Config](),
+		appBackend:      backend,
+		proposals:       newProposalStore(),
+		raftConfig:      rc,
+		status:          status,
+		statusPath:      statusPath,
+		readinessPolicy: readinessPolicy,
+		closing:         make(chan struct{}),
+	}
+
+	initialMembers, initialWitnesses, err := env.ParseMembers(env.Current.RaftInitialMembers)
+	if err != nil {
+		return nil, err
 	}
 
-	// Check if we are one of the initial members or not
-	join := false
-	if !strings.Contains(env.RaftInitialMembers, env.RaftListenAddr) {
-		// We are not an initial member, and are thus joining
-		join = true
-		initialMembers = nil
+	if len(initialMembers) > 0 {
+		logger.Debug().Interface("raft initial members", initialMembers).Interface("raft initial witnesses", initialWitnesses).Msg("Using raft initial members")
 	}
 
-	// TODO recover each shard
-	err = nh.StartOnDiskReplica(initialMembers, join, func(shardID uint64, replicaID uint64) statemachine.IOnDiskStateMachine {
-		return createStateMachine(shardID, replicaID, logger, readyMap)
-	}, rc)
+	// Shard 0 is bootstrapped from the initial members. This also records them for replicas that persisted
+	// shard 0 before its config was stored.
+	rm.statusMu.Lock()
+	if shard, exists := rm.status.Shards[0]; !exists || (len(shard.InitialMembers) == 0 && !shard.Join) {
+		rm.status.Shards[0] = newShardStatus(initialMembers, initialWitnesses)
+		err = rm.saveStatus()
+	}
+	rm.statusMu.Unlock()
 	if err != nil {
-		return nil, fmt.Errorf("error in StartOnDiskCluster: %w", err)
+		return nil, fmt.Errorf("error saving replica status: %w", err)
 	}
 
-	rm := &RaftManager{
-		nodeHost: nh,
-		logger:   logger,
-		Ready:    readyMap,
+	// A shard failing to start should not take down the healthy ones
+	if started := rm.recoverShards(); started == 0 {
+		return nil, fmt.Errorf("no shards were able to start")
+	}
+
+	go rm.monitorReadiness()
+
+	balancer, err := newLeaderBalancer(rm)
+	if err != nil {
+		return nil, fmt.Errorf("error creating leader balancer: %w", err)
 	}
+	go balancer.run()
 
 	return rm, nil
 }
 
 func (rm *RaftManager) Shutdown() error {
+	rm.Ready.Range(func(shardID uint64, state ShardState) bool {
+		if state != ShardStateFailed {
+			rm.Ready.Store(shardID, ShardStateClosing)
+		}
+		return true
+	})
+	// Closing cancels state machine calls that are waiting for the application
+	close(rm.closing)
 	rm.nodeHost.Close()
 	// todo stop processing new requests
-	// todo stop/abandon any outgoing state machine operations
 	return nil
 }
 
-func (rm *RaftManager) RecruitReplica(ctx context.Context, replicaID, shardID uint64, replicaAddr string) error {
+// RecruitReplica adds a replica to the shard. Non-voting replicas receive the log but do not count towards quorum,
+// and can later be promoted with PromoteReplica once they have caught up. Witnesses vote but have no state machine.
+func (rm *RaftManager) RecruitReplica(ctx context.Context, replicaID, shardID uint64, replicaAddr string, nonVoting, witness bool) error {
 	// Add deadline if not set
 	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
 		var cancel context.CancelFunc
@@ -170,9 +228,77 @@ func (rm *RaftManager) RecruitReplica(ctx context.Context, replicaID, shardID ui
 		defer cancel()
 	}
 
+	if nonVoting && witness {
+		return fmt.Errorf("%w: a replica can not be both non-voting and a witness", ErrInvalidReplicaType)
+	}
+	if nonVoting {
+		return rm.nodeHost.SyncRequestAddNonVoting(ctx, shardID, replicaID, replicaAddr, 0)
+	}
+	if witness {
+		return rm.nodeHost.SyncRequestAddWitness(ctx, shardID, replicaID, replicaAddr, 0)
+	}
+
 	return rm.nodeHost.SyncRequestAddReplica(ctx, shardID, replicaID, replicaAddr, 0)
 }
 
+// PromoteReplica turns this replica from a non-voting member of the shard into a voter. It waits until the applied
+// index of this replica is within maxLag entries of the leader's commit index before requesting the promotion.
+func (rm *RaftManager) PromoteReplica(ctx context.Context, shardID, maxLag uint64) error {
+	// Add deadline if not set
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+	}
+
+	membership, err := rm.GetMembership(ctx, shardID)
+	if err != nil {
+		return err
+	}
+	self, isNonVoting := lo.Find(membership.NonVoting, func(member Member) bool {
+		return member.ReplicaID == env.Current.ReplicaID
+	})
+	if !isNonVoting {
+		return fmt.Errorf("%w: replica %d in shard %d", ErrNotNonVoting, env.Current.ReplicaID, shardID)
+	}
+
+	ticker := time.NewTicker(leaderPollInterval)
+	defer ticker.Stop()
+	for {
+		applied, localCommitIndex, err := rm.appliedIndex(ctx, shardID)
+		if err != nil {
+			return err
+		}
+		commitIndex, known, err := rm.leaderCommitIndex(shardID, localCommitIndex)
+		if err != nil {
+			return err
+		}
+		if known && (applied >= commitIndex || commitIndex-applied <= maxLag) {
+			break
+		}
+		if !known {
+			commitIndex = localCommitIndex
+			// Confirming the leader's commit index also waits for this replica to apply it, so it is given
+			// an election timeout at a time to not hold up the check against maxLag
+			readCtx, cancel := context.WithTimeout(ctx, rm.electionTimeout(shardID))
+			err := rm.readIndex(readCtx, shardID)
+			cancel()
+			if err == nil {
+				continue
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: applied index %d, commit index %d: %w", ErrReplicaLagging, applied, commitIndex, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+
+	// Adding a non-voting member with the same address promotes it
+	return rm.nodeHost.SyncRequestAddReplica(ctx, shardID, env.Current.ReplicaID, self.Addr, 0)
+}
+
 func (rm *RaftManager) RemoveReplica(ctx context.Context, replicaID, shardID uint64) error {
 	// Add deadline if not set
 	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
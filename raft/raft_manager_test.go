@@ -0,0 +1,209 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/danthegoodman1/raftd/env"
+	"github.com/danthegoodman1/raftd/syncx"
+)
+
+// testApp is an in memory application that keeps the commands it applied. Its snapshots are the commands.
+type testApp struct {
+	mu       sync.Mutex
+	applied  uint64
+	commands []string
+}
+
+func newTestApp(t *testing.T) (*testApp, string) {
+	app := &testApp{}
+	srv := httptest.NewServer(app)
+	t.Cleanup(srv.Close)
+	return app, srv.URL
+}
+
+func (a *testApp) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/LastLogIndex":
+		_ = json.NewEncoder(w).Encode(map[string]any{"LastLogIndex": a.applied})
+	case "/UpdateEntries":
+		var req struct{ Entries []updateEntry }
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		results := make([]EntryResult, len(req.Entries))
+		for i, entry := range req.Entries {
+			a.applied = entry.Index
+			a.commands = append(a.commands, string(entry.Cmd))
+			results[i] = EntryResult{Value: entry.Index, Data: []byte("applied " + string(entry.Cmd))}
+		}
+		_ = json.NewEncoder(w).Encode(updateResponse{Results: results})
+	case "/Read":
+		_ = json.NewEncoder(w).Encode(a.commands)
+	case "/SaveSnapshot":
+		data, _ := json.Marshal(a.commands)
+		_ = json.NewEncoder(w).Encode(struct {
+			Applied  uint64
+			Commands json.RawMessage
+		}{a.applied, data})
+	case "/RecoverFromSnapshot":
+		var snapshot struct {
+			Applied  uint64
+			Commands []string
+		}
+		if err := json.Unmarshal(body, &snapshot); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.applied, a.commands = snapshot.Applied, snapshot.Commands
+	default:
+		_, _ = w.Write([]byte("{}"))
+	}
+}
+
+func (a *testApp) state() (uint64, []string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.applied, append([]string(nil), a.commands...)
+}
+
+// freeAddr returns a local address that nothing listens on
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// setTestEnv loads a config for a replica in dir whose shard 0 has the initial members
+func setTestEnv(t testing.TB, dir string, replicaID uint64, raftAddr, members, appURL string) {
+	t.Setenv("REPLICA_ID", fmt.Sprint(replicaID))
+	t.Setenv("RAFT_DIR", dir)
+	t.Setenv("RAFT_LISTEN_ADDR", raftAddr)
+	t.Setenv("RAFT_INITIAL_MEMBERS", members)
+	t.Setenv("APP_URL", appURL)
+	t.Setenv("HTTP_LISTEN_ADDR", "127.0.0.1:0")
+	t.Setenv("LEADER_BALANCE_INTERVAL_SEC", "0")
+	if _, _, err := env.Load(""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startTestReplica starts replica 1 in dir as the only member of shard 0
+func startTestReplica(t *testing.T, dir, appURL string) *RaftManager {
+	raftAddr := freeAddr(t)
+	setTestEnv(t, dir, 1, raftAddr, "1="+raftAddr, appURL)
+	return newTestRaftManager(t)
+}
+
+func newTestRaftManager(t *testing.T) *RaftManager {
+	readyMap := syncx.NewMap[uint64, ShardState]()
+	rm, err := NewRaftManager(&readyMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		select {
+		case <-rm.closing:
+		default:
+			_ = rm.Shutdown()
+		}
+	})
+	return rm
+}
+
+// waitFor fails the test if cond does not hold within the timeout
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func waitForShardState(t *testing.T, rm *RaftManager, shardID uint64, want ShardState) {
+	t.Helper()
+	waitFor(t, 10*time.Second, fmt.Sprintf("shard %d to be %s", shardID, want), func() bool {
+		state, _ := rm.Ready.Load(shardID)
+		return state == want
+	})
+}
+
+func mustPropose(t *testing.T, rm *RaftManager, shardID uint64, cmd string) EntryResult {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result, err := rm.Propose(ctx, shardID, []byte(cmd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestShardReadyWhenLogEndsInInternalEntries(t *testing.T) {
+	_, appURL := newTestApp(t)
+	rm := startTestReplica(t, t.TempDir(), appURL)
+
+	// The log of a new shard is only its bootstrap config change and the leader's no-op, which the application
+	// never sees
+	waitForShardState(t, rm, 0, ShardStateReady)
+
+	applied, commitIndex, err := rm.appliedIndex(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied != commitIndex {
+		t.Fatalf("applied index %d, commit index %d", applied, commitIndex)
+	}
+
+	result := mustPropose(t, rm, 0, "a")
+	if applied, _, _ := rm.appliedIndex(context.Background(), 0); applied != result.Value {
+		t.Fatalf("applied index %d after applying entry %d", applied, result.Value)
+	}
+}
+
+func TestShardReadyAfterRestart(t *testing.T) {
+	app, appURL := newTestApp(t)
+	dir := t.TempDir()
+	rm := startTestReplica(t, dir, appURL)
+	waitForShardState(t, rm, 0, ShardStateReady)
+	mustPropose(t, rm, 0, "a")
+
+	// The log now ends in a config change, and the new leader appends a no-op after it
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := rm.RecruitReplica(ctx, 2, 0, freeAddr(t), true, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := rm.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	rm = newTestRaftManager(t)
+	waitForShardState(t, rm, 0, ShardStateReady)
+	if _, commands := app.state(); len(commands) != 1 {
+		t.Fatalf("application has commands %v, want 1", commands)
+	}
+}
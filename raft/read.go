@@ -0,0 +1,403 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/danthegoodman1/raftd/env"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lni/dragonboat/v4/raftpb"
+)
+
+type (
+	ReadConsistency string
+
+	// ReadOptions control how a read is served. MaxStaleness and MaxLag are only used for ReadConsistencyBounded,
+	// and at least one of them must be set.
+	ReadOptions struct {
+		Consistency  ReadConsistency
+		MaxStaleness time.Duration
+		MaxLag       uint64
+	}
+
+	// shardProgress tracks how fresh the local replica of a shard is
+	shardProgress struct {
+		// applied is the index of the last entry applied by the application. Entries the application never sees are
+		// only counted once appliedIndex has found them after it.
+		applied atomic.Uint64
+		// appliedMu guards appliedC, which is closed the next time applied changes
+		appliedMu sync.Mutex
+		appliedC  chan struct{}
+		// syncedAt is the unix nano start time of the last successful ReadIndex. Everything committed before
+		// this time has been applied locally.
+		syncedAt atomic.Int64
+		// syncedCommit is a lower bound of the leader's commit index at syncedAt, which followers can not see
+		syncedCommit atomic.Uint64
+		// leaseExpiry is the unix nano time until which this replica holds the leader lease for leaseTerm
+		leaseExpiry atomic.Int64
+		leaseTerm   atomic.Uint64
+		// logQueryMu serializes queries of the committed log, see committedEntries
+		logQueryMu sync.Mutex
+	}
+)
+
+const (
+	// ReadConsistencyLinearizable confirms with a quorum (ReadIndex) before reading
+	ReadConsistencyLinearizable ReadConsistency = "linearizable"
+	// ReadConsistencyLease reads on the leader without a quorum round trip while it holds the leader lease
+	ReadConsistencyLease ReadConsistency = "lease"
+	// ReadConsistencyStale reads the local replica without any freshness guarantee
+	ReadConsistencyStale ReadConsistency = "stale"
+	// ReadConsistencyBounded reads the local replica if it is within MaxStaleness and/or MaxLag of the leader,
+	// otherwise it falls back to a linearizable read
+	ReadConsistencyBounded ReadConsistency = "bounded"
+
+	// leaseSafetyFactor shortens the lease to account for clock drift between replicas
+	leaseSafetyFactor = 0.8
+	// appliedScanSize limits the size of the committed entries appliedIndex checks at once
+	appliedScanSize = 1 << 20
+)
+
+var (
+	ErrInvalidConsistency = errors.New("invalid read consistency")
+	ErrNotLeader          = errors.New("not the leader")
+)
+
+func ParseReadConsistency(s string) (ReadConsistency, error) {
+	switch c := ReadConsistency(s); c {
+	case "":
+		return ReadConsistencyLinearizable, nil
+	case ReadConsistencyLinearizable, ReadConsistencyLease, ReadConsistencyStale, ReadConsistencyBounded:
+		return c, nil
+	default:
+		return "", fmt.Errorf("%w: '%s'", ErrInvalidConsistency, s)
+	}
+}
+
+func (rm *RaftManager) getProgress(shardID uint64) *shardProgress {
+	progress, _ := rm.progress.LoadOrStore(shardID, &shardProgress{})
+	return progress
+}
+
+// Read performs a read on the shard with the requested consistency, relaying the query to the application's
+// /Read endpoint
+func (rm *RaftManager) Read(ctx context.Context, shardID uint64, query ReadQuery, opts ReadOptions) (ReadResult, error) {
+	// Add deadline if not set
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+	}
+
+	var (
+		res any
+		err error
+	)
+	switch opts.Consistency {
+	case ReadConsistencyLinearizable, "":
+		res, err = rm.linearizableRead(ctx, shardID, query)
+	case ReadConsistencyLease:
+		res, err = rm.leaseRead(ctx, shardID, query)
+	case ReadConsistencyStale:
+		res, err = rm.staleRead(shardID, query)
+	case ReadConsistencyBounded:
+		res, err = rm.boundedRead(ctx, shardID, query, opts)
+	default:
+		return ReadResult{}, fmt.Errorf("%w: '%s'", ErrInvalidConsistency, opts.Consistency)
+	}
+	if err != nil {
+		return ReadResult{}, err
+	}
+
+	return res.(ReadResult), nil
+}
+
+// linearizableRead performs a ReadIndex read, recording when this replica was last known to be in sync
+func (rm *RaftManager) linearizableRead(ctx context.Context, shardID uint64, query ReadQuery) (any, error) {
+	start := time.Now()
+	res, err := rm.nodeHost.SyncRead(ctx, shardID, query)
+	if err != nil {
+		return nil, fmt.Errorf("error in nodeHost.SyncRead: %w", err)
+	}
+
+	rm.setSynced(shardID, start)
+	return res, nil
+}
+
+// readIndex confirms the leader's commit index with a quorum and waits until the local replica has applied it,
+// without reading from the application
+func (rm *RaftManager) readIndex(ctx context.Context, shardID uint64) error {
+	start := time.Now()
+	deadline, _ := ctx.Deadline()
+	rs, err := rm.nodeHost.ReadIndex(shardID, time.Until(deadline))
+	if err != nil {
+		return fmt.Errorf("error in nodeHost.ReadIndex: %w", err)
+	}
+	if _, err := waitForApplied(ctx, rs); err != nil {
+		return err
+	}
+
+	rm.setSynced(shardID, start)
+	return nil
+}
+
+// setSynced records a ReadIndex that started at start. It completed once the local replica applied the leader's
+// commit index.
+func (rm *RaftManager) setSynced(shardID uint64, start time.Time) {
+	progress := rm.getProgress(shardID)
+	progress.syncedAt.Store(start.UnixNano())
+	storeMax(&progress.syncedCommit, progress.applied.Load())
+}
+
+func (rm *RaftManager) staleRead(shardID uint64, query ReadQuery) (any, error) {
+	res, err := rm.nodeHost.StaleRead(shardID, query)
+	if err != nil {
+		return nil, fmt.Errorf("error in nodeHost.StaleRead: %w", err)
+	}
+
+	return res, nil
+}
+
+// leaseRead serves the read locally on the leader while it holds the leader lease. With CheckQuorum enabled,
+// followers that have heard from the leader within the election timeout will not vote for another candidate, so
+// a ReadIndex that succeeded at time t proves no other leader can exist before t + electionTimeout.
+func (rm *RaftManager) leaseRead(ctx context.Context, shardID uint64, query ReadQuery) (any, error) {
+	leaderID, term, valid, err := rm.nodeHost.GetLeaderID(shardID)
+	if err != nil {
+		return nil, fmt.Errorf("error in nodeHost.GetLeaderID: %w", err)
+	}
+	if !valid || leaderID != env.Current.ReplicaID {
+		return nil, fmt.Errorf("%w: leader is %d", ErrNotLeader, leaderID)
+	}
+
+	if !rm.shardConfig(shardID).CheckQuorum {
+		// Followers may vote for a new leader at any time, so there is no lease to rely on
+		return rm.linearizableRead(ctx, shardID, query)
+	}
+
+	progress := rm.getProgress(shardID)
+	if progress.leaseTerm.Load() != term || time.Now().UnixNano() >= progress.leaseExpiry.Load() {
+		// Renew the lease with a quorum round trip, which also serves this read
+		start := time.Now()
+		res, err := rm.linearizableRead(ctx, shardID, query)
+		if err != nil {
+			return nil, err
+		}
+
+		progress.leaseTerm.Store(term)
+		progress.leaseExpiry.Store(start.Add(time.Duration(float64(rm.electionTimeout(shardID)) * leaseSafetyFactor)).UnixNano())
+		return res, nil
+	}
+
+	// The leader may have committed entries it has not yet applied. They are all in its log, as the leader only
+	// commits entries once they are saved locally.
+	lastIndex, err := rm.lastLogIndex(shardID)
+	if err != nil {
+		return nil, err
+	}
+	if err := rm.waitForAppliedIndex(ctx, shardID, lastIndex); err != nil {
+		return nil, err
+	}
+
+	return rm.staleRead(shardID, query)
+}
+
+// boundedRead serves the read locally if the replica is within the requested bounds, otherwise performs a
+// linearizable read (which brings it back within bounds for subsequent reads)
+func (rm *RaftManager) boundedRead(ctx context.Context, shardID uint64, query ReadQuery, opts ReadOptions) (any, error) {
+	if opts.MaxStaleness <= 0 && opts.MaxLag == 0 {
+		return nil, fmt.Errorf("%w: bounded reads require a max staleness or max lag", ErrInvalidConsistency)
+	}
+
+	withinBounds := true
+	progress := rm.getProgress(shardID)
+	if opts.MaxStaleness > 0 {
+		syncedAt := time.Unix(0, progress.syncedAt.Load())
+		withinBounds = withinBounds && time.Since(syncedAt) <= opts.MaxStaleness
+	}
+	if opts.MaxLag > 0 {
+		// The local log ends at or after the local commit index, so this may overestimate the lag
+		lastIndex, err := rm.lastLogIndex(shardID)
+		if err != nil {
+			return nil, err
+		}
+		commitIndex, known, err := rm.leaderCommitIndex(shardID, lastIndex)
+		if err != nil {
+			return nil, err
+		}
+		applied := progress.applied.Load()
+		withinBounds = withinBounds && known && (applied >= commitIndex || commitIndex-applied <= opts.MaxLag)
+	}
+
+	if !withinBounds {
+		return rm.linearizableRead(ctx, shardID, query)
+	}
+
+	return rm.staleRead(shardID, query)
+}
+
+// leaderCommitIndex returns the leader's commit index as far as the local replica can tell, given its own commit
+// index or an index past it. Followers only learn the leader's commit index up to the entries they have replicated, so they also use the
+// one their last ReadIndex confirmed, for up to an election timeout. After that, the leader may have committed much
+// more, and the commit index is not known until the next ReadIndex.
+func (rm *RaftManager) leaderCommitIndex(shardID, localCommitIndex uint64) (uint64, bool, error) {
+	leaderID, _, valid, err := rm.nodeHost.GetLeaderID(shardID)
+	if err != nil {
+		return 0, false, fmt.Errorf("error in nodeHost.GetLeaderID: %w", err)
+	}
+	if !valid {
+		return 0, false, nil
+	}
+	if leaderID == env.Current.ReplicaID {
+		return localCommitIndex, true, nil
+	}
+
+	progress := rm.getProgress(shardID)
+	if time.Since(time.Unix(0, progress.syncedAt.Load())) > rm.electionTimeout(shardID) {
+		return 0, false, nil
+	}
+	return max(localCommitIndex, progress.syncedCommit.Load()), true, nil
+}
+
+// appliedIndex returns the index up to which the local replica has applied the log, and its commit index. The state
+// machine only sees application entries, so config changes and empty entries (such as the no-op of a new leader)
+// committed after the last entry it applied are counted as applied, as there is nothing in them for the application.
+func (rm *RaftManager) appliedIndex(ctx context.Context, shardID uint64) (uint64, uint64, error) {
+	progress := rm.getProgress(shardID)
+	applied := progress.applied.Load()
+	entries, commitIndex, err := rm.committedEntries(ctx, shardID, applied+1)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsConfigChange() && !entry.IsEmpty() {
+			break
+		}
+		applied = entry.Index
+	}
+
+	progress.advanceApplied(applied)
+	return applied, commitIndex, nil
+}
+
+// waitForAppliedIndex waits until the local replica has applied the log up to index. The state machine counts the
+// entries it applies as it goes. Entries it never sees at the end of the log are only counted by appliedIndex, which
+// is checked when nothing was applied for a round trip.
+func (rm *RaftManager) waitForAppliedIndex(ctx context.Context, shardID, index uint64) error {
+	progress := rm.getProgress(shardID)
+	idle := time.Duration(rm.rttMillisecond) * time.Millisecond
+	timer := time.NewTimer(idle)
+	defer timer.Stop()
+	for {
+		// Taken before checking applied, so an entry applied in between is not missed
+		changed := progress.appliedChanged()
+		if progress.applied.Load() >= index {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("error waiting for the replica to apply index %d: %w", index, ctx.Err())
+		case <-changed:
+		case <-timer.C:
+			if _, _, err := rm.appliedIndex(ctx, shardID); err != nil {
+				return err
+			}
+		}
+		timer.Reset(idle)
+	}
+}
+
+// lastLogIndex returns the index of the last entry saved in the local replica's log, which is at least its commit
+// index
+func (rm *RaftManager) lastLogIndex(shardID uint64) (uint64, error) {
+	logReader, err := rm.nodeHost.GetLogReader(shardID)
+	if err != nil {
+		return 0, fmt.Errorf("error in nodeHost.GetLogReader: %w", err)
+	}
+	_, lastIndex := logReader.GetRange()
+	return lastIndex, nil
+}
+
+// snapshotIndex returns the index of the latest snapshot of the local replica, which the state machine may be
+// recovering from
+func (rm *RaftManager) snapshotIndex(shardID uint64) (uint64, error) {
+	logReader, err := rm.nodeHost.GetLogReader(shardID)
+	if err != nil {
+		return 0, fmt.Errorf("error in nodeHost.GetLogReader: %w", err)
+	}
+	return logReader.Snapshot().Index, nil
+}
+
+// committedEntries returns the committed entries of the local replica from index on, up to appliedScanSize bytes
+// of them, and its commit index. Entries that were compacted are not returned. Reads do not call it on every request,
+// as it queries the log on the shard's worker, one query at a time.
+func (rm *RaftManager) committedEntries(ctx context.Context, shardID, index uint64) ([]raftpb.Entry, uint64, error) {
+	progress := rm.getProgress(shardID)
+	// dragonboat serves one log query per shard at a time
+	progress.logQueryMu.Lock()
+	defer progress.logQueryMu.Unlock()
+
+	rs, err := rm.nodeHost.QueryRaftLog(shardID, index, math.MaxUint64, appliedScanSize)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error in nodeHost.QueryRaftLog: %w", err)
+	}
+	select {
+	case r := <-rs.CompletedC:
+		if !r.Completed() && !r.RequestOutOfRange() {
+			_, err := requestResult(rs, r)
+			return nil, 0, fmt.Errorf("error in nodeHost.QueryRaftLog: %w", err)
+		}
+		// Queries from past the commit index are out of range, but still have the range of the committed log
+		entries, logRange := r.RaftLogs()
+		return entries, logRange.LastIndex - 1, nil
+	case <-ctx.Done():
+		return nil, 0, fmt.Errorf("error waiting for nodeHost.QueryRaftLog: %w", ctx.Err())
+	}
+}
+
+// setApplied stores the index of the last entry the state machine applied, waking up the reads waiting for it
+func (p *shardProgress) setApplied(index uint64) {
+	p.applied.Store(index)
+	p.notifyApplied()
+}
+
+// advanceApplied raises the applied index to index, unless it is already past it
+func (p *shardProgress) advanceApplied(index uint64) {
+	storeMax(&p.applied, index)
+	p.notifyApplied()
+}
+
+// appliedChanged returns a channel that is closed the next time the applied index changes
+func (p *shardProgress) appliedChanged() <-chan struct{} {
+	p.appliedMu.Lock()
+	defer p.appliedMu.Unlock()
+	if p.appliedC == nil {
+		p.appliedC = make(chan struct{})
+	}
+	return p.appliedC
+}
+
+func (p *shardProgress) notifyApplied() {
+	p.appliedMu.Lock()
+	defer p.appliedMu.Unlock()
+	if p.appliedC != nil {
+		close(p.appliedC)
+		p.appliedC = nil
+	}
+}
+
+// storeMax raises v to value, unless it is already past it
+func storeMax(v *atomic.Uint64, value uint64) {
+	for {
+		current := v.Load()
+		if current >= value || v.CompareAndSwap(current, value) {
+			return
+		}
+	}
+}
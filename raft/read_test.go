@@ -0,0 +1,130 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startRestartedReplica starts a replica whose log ends in a config change, with the no-op of its new leader after
+// it, which the application has never seen
+func startRestartedReplica(t *testing.T) *RaftManager {
+	_, appURL := newTestApp(t)
+	rm := startTestReplica(t, t.TempDir(), appURL)
+	waitForShardState(t, rm, 0, ShardStateReady)
+	mustPropose(t, rm, 0, "a")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := rm.RecruitReplica(ctx, 2, 0, freeAddr(t), true, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := rm.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	rm = newTestRaftManager(t)
+	waitForShardState(t, rm, 0, ShardStateReady)
+	return rm
+}
+
+func readCommands(t *testing.T, rm *RaftManager, opts ReadOptions) []string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	res, err := rm.Read(ctx, 0, ReadQuery{}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var commands []string
+	if err := json.Unmarshal(res.Body, &commands); err != nil {
+		t.Fatal(err)
+	}
+	return commands
+}
+
+func TestLeaseReadAfterInternalEntries(t *testing.T) {
+	rm := startRestartedReplica(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := rm.RecruitReplica(ctx, 3, 0, freeAddr(t), true, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first read renews the lease, the second is served under it
+	for range 2 {
+		if commands := readCommands(t, rm, ReadOptions{Consistency: ReadConsistencyLease}); !slices.Equal(commands, []string{"a"}) {
+			t.Fatalf("read %v", commands)
+		}
+	}
+	if time.Now().UnixNano() >= rm.getProgress(0).leaseExpiry.Load() {
+		t.Fatal("lease was not taken")
+	}
+}
+
+func TestBoundedReadMaxLag(t *testing.T) {
+	rm := startRestartedReplica(t)
+
+	// The leader has applied everything it committed, so the read is served locally without a quorum check
+	if commands := readCommands(t, rm, ReadOptions{Consistency: ReadConsistencyBounded, MaxLag: 1}); !slices.Equal(commands, []string{"a"}) {
+		t.Fatalf("read %v", commands)
+	}
+	if syncedAt := rm.getProgress(0).syncedAt.Load(); syncedAt != 0 {
+		t.Fatalf("bounded read within max lag made a quorum check at %d", syncedAt)
+	}
+}
+
+func TestLeaseReadsDoNotSerialize(t *testing.T) {
+	const readers = 8
+	var (
+		gated   atomic.Bool
+		arrived atomic.Int64
+		all     = make(chan struct{})
+	)
+	app := &testApp{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/Read" && gated.Load() {
+			// No read returns before every read has reached the application
+			if arrived.Add(1) == readers {
+				close(all)
+			}
+			select {
+			case <-all:
+			case <-time.After(5 * time.Second):
+				http.Error(w, "reads were serialized", http.StatusInternalServerError)
+				return
+			}
+		}
+		app.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	rm := startTestReplica(t, t.TempDir(), srv.URL)
+	waitForShardState(t, rm, 0, ShardStateReady)
+	mustPropose(t, rm, 0, "a")
+	readCommands(t, rm, ReadOptions{Consistency: ReadConsistencyLease})
+	syncedAt := rm.getProgress(0).syncedAt.Load()
+
+	gated.Store(true)
+	errs := make(chan error, readers)
+	for range readers {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			_, err := rm.Read(ctx, 0, ReadQuery{}, ReadOptions{Consistency: ReadConsistencyLease})
+			errs <- err
+		}()
+	}
+	for range readers {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rm.getProgress(0).syncedAt.Load() != syncedAt {
+		t.Fatal("lease reads made a quorum check")
+	}
+}
@@ -0,0 +1,168 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// ShardState is the lifecycle state of the local replica of a shard
+	ShardState string
+
+	ReadinessMode string
+
+	// ReadinessPolicy decides which shards must be ready for the replica to be considered ready
+	ReadinessPolicy struct {
+		Mode ReadinessMode `json:"mode"`
+		// Shards are the required shards for ReadinessModeShards
+		Shards []uint64 `json:"shards,omitempty"`
+	}
+
+	ReadinessReport struct {
+		Ready  bool                  `json:"ready"`
+		Policy ReadinessPolicy       `json:"policy"`
+		Shards map[uint64]ShardState `json:"shards"`
+	}
+)
+
+const (
+	ShardStateBooting    ShardState = "booting"
+	ShardStateRecovering ShardState = "recovering_from_snapshot"
+	ShardStateCatchingUp ShardState = "catching_up"
+	ShardStateReady      ShardState = "ready"
+	// ShardStatePaused means the shard is waiting for the application to become available again
+	ShardStatePaused  ShardState = "paused"
+	ShardStateClosing ShardState = "closing"
+	ShardStateClosed  ShardState = "closed"
+	ShardStateFailed  ShardState = "failed"
+
+	// ReadinessModeAll requires every shard on the replica to be ready
+	ReadinessModeAll ReadinessMode = "all"
+	// ReadinessModeShards requires only the shards listed in the policy to be ready
+	ReadinessModeShards ReadinessMode = "shards"
+	// ReadinessModeAny requires at least one shard to be ready
+	ReadinessModeAny ReadinessMode = "any"
+
+	readinessPollInterval = 100 * time.Millisecond
+)
+
+var (
+	ErrInvalidReadinessPolicy = errors.New("invalid readiness policy")
+)
+
+// ParseReadinessPolicy parses a readiness mode and a CSV of required shard IDs
+func ParseReadinessPolicy(mode, shards string) (ReadinessPolicy, error) {
+	policy := ReadinessPolicy{Mode: ReadinessMode(mode)}
+	switch policy.Mode {
+	case "":
+		policy.Mode = ReadinessModeAll
+	case ReadinessModeAll, ReadinessModeAny:
+	case ReadinessModeShards:
+		for _, raw := range strings.Split(shards, ",") {
+			shardID, err := strconv.ParseUint(strings.TrimSpace(raw), 10, 64)
+			if err != nil {
+				return policy, fmt.Errorf("%w: invalid shard ID '%s'", ErrInvalidReadinessPolicy, raw)
+			}
+			policy.Shards = append(policy.Shards, shardID)
+		}
+	default:
+		return policy, fmt.Errorf("%w: unknown mode '%s'", ErrInvalidReadinessPolicy, mode)
+	}
+
+	return policy, nil
+}
+
+// Readiness evaluates the readiness policy against the current state of every shard
+func (rm *RaftManager) Readiness() ReadinessReport {
+	report := ReadinessReport{
+		Policy: rm.readinessPolicy,
+		Shards: map[uint64]ShardState{},
+	}
+	rm.Ready.Range(func(shardID uint64, state ShardState) bool {
+		report.Shards[shardID] = state
+		return true
+	})
+
+	switch rm.readinessPolicy.Mode {
+	case ReadinessModeAny:
+		for _, state := range report.Shards {
+			if state == ShardStateReady {
+				report.Ready = true
+				break
+			}
+		}
+	case ReadinessModeShards:
+		report.Ready = true
+		for _, shardID := range rm.readinessPolicy.Shards {
+			report.Ready = report.Ready && report.Shards[shardID] == ShardStateReady
+		}
+	default:
+		report.Ready = len(report.Shards) > 0
+		for _, state := range report.Shards {
+			report.Ready = report.Ready && state == ShardStateReady
+		}
+	}
+
+	return report
+}
+
+// RequiredShards returns the shards that the readiness policy depends on
+func (r ReadinessReport) RequiredShards() []uint64 {
+	if r.Policy.Mode == ReadinessModeShards {
+		return r.Policy.Shards
+	}
+
+	shardIDs := make([]uint64, 0, len(r.Shards))
+	for shardID := range r.Shards {
+		shardIDs = append(shardIDs, shardID)
+	}
+	slices.Sort(shardIDs)
+	return shardIDs
+}
+
+// monitorReadiness promotes catching up shards to ready once they have applied everything the leader has
+// told them is committed
+func (rm *RaftManager) monitorReadiness() {
+	ticker := time.NewTicker(readinessPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rm.closing:
+			return
+		case <-ticker.C:
+		}
+
+		rm.Ready.Range(func(shardID uint64, state ShardState) bool {
+			if state != ShardStateCatchingUp {
+				return true
+			}
+
+			_, _, leaderKnown, err := rm.nodeHost.GetLeaderID(shardID)
+			if err != nil || !leaderKnown {
+				return true
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), readinessPollInterval)
+			applied, commitIndex, err := rm.appliedIndex(ctx, shardID)
+			cancel()
+			if err != nil {
+				return true
+			}
+			if applied >= commitIndex {
+				rm.setShardState(shardID, ShardStateCatchingUp, ShardStateReady)
+			}
+			return true
+		})
+	}
+}
+
+// setShardState transitions the shard to the new state only if it is currently in the expected state
+func (rm *RaftManager) setShardState(shardID uint64, expected, state ShardState) {
+	if rm.Ready.CompareAndSwap(shardID, expected, state) {
+		rm.logger.Debug().Uint64("ShardID", shardID).Str("State", string(state)).Msg("shard state changed")
+	}
+}
@@ -0,0 +1,42 @@
+package raft
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseReadinessPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		mode   string
+		shards string
+		want   ReadinessPolicy
+		err    error
+	}{
+		{name: "default", want: ReadinessPolicy{Mode: ReadinessModeAll}},
+		{name: "all", mode: "all", want: ReadinessPolicy{Mode: ReadinessModeAll}},
+		{name: "any ignores shards", mode: "any", shards: "1", want: ReadinessPolicy{Mode: ReadinessModeAny}},
+		{name: "shards", mode: "shards", shards: "0, 2,7", want: ReadinessPolicy{Mode: ReadinessModeShards, Shards: []uint64{0, 2, 7}}},
+		{name: "no shards", mode: "shards", err: ErrInvalidReadinessPolicy},
+		{name: "invalid shard", mode: "shards", shards: "1,a", err: ErrInvalidReadinessPolicy},
+		{name: "negative shard", mode: "shards", shards: "-1", err: ErrInvalidReadinessPolicy},
+		{name: "unknown mode", mode: "some", err: ErrInvalidReadinessPolicy},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			policy, err := ParseReadinessPolicy(tc.mode, tc.shards)
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Fatalf("got policy %+v and error %v, want %v", policy, err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(policy, tc.want) {
+				t.Fatalf("got policy %+v, want %+v", policy, tc.want)
+			}
+		})
+	}
+}
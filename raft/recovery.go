@@ -0,0 +1,261 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"time"
+
+	"github.com/danthegoodman1/raftd/env"
+	"github.com/danthegoodman1/raftd/gologger"
+	"github.com/danthegoodman1/raftd/syncx"
+	"github.com/danthegoodman1/raftd/utils"
+	"github.com/lni/dragonboat/v4"
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/tools"
+)
+
+// recoveryAuditFile is the append only log of quorum loss recoveries in RAFT_DIR, one JSON RecoveryRecord per line
+const recoveryAuditFile = "recovery_audit.jsonl"
+
+// recoveryPollInterval is how often the shard is checked while waiting for it to apply what it has committed
+const recoveryPollInterval = 100 * time.Millisecond
+
+type (
+	RecoveryEvent string
+
+	// RecoveryRecord is an audit record of a quorum loss recovery
+	RecoveryRecord struct {
+		Time     time.Time
+		Event    RecoveryEvent
+		Hostname string
+		// User is the OS user that ran the recovery
+		User      string
+		ShardID   uint64
+		ReplicaID uint64
+		// Index and Term are the state of the shard that was kept, everything after it on other replicas is lost
+		Index uint64
+		Term  uint64
+		// PreviousMembership is the membership of the shard before the recovery
+		PreviousMembership SnapshotMembership
+		Members            []Member
+		// Error is set for failed recoveries
+		Error string `json:",omitempty"`
+	}
+)
+
+const (
+	RecoveryStarted   RecoveryEvent = "started"
+	RecoveryCompleted RecoveryEvent = "completed"
+	RecoveryFailed    RecoveryEvent = "failed"
+)
+
+// RecoverShard forcibly replaces the membership of a shard that lost its quorum with members, keeping the state of
+// this replica. Anything the shard committed that this replica did not apply is lost, and the former members must
+// never be started again with their old data. raftd must not be running on this replica, but the application must
+// be.
+//
+// The shard is started on its own to apply everything this replica knows is committed, then its state is exported
+// and imported with the new membership, so it joins the new membership when raftd starts. If archive is not nil, the
+// exported state is also written to it as an archive for the other new members to `raftd import`.
+//
+// Every recovery is recorded in RAFT_DIR/recovery_audit.jsonl.
+func RecoverShard(ctx context.Context, shardID uint64, members map[uint64]string, archive io.Writer) (*RecoveryRecord, error) {
+	ctx, cancel := snapshotContext(ctx)
+	defer cancel()
+
+	if err := checkImportMembers(members); err != nil {
+		return nil, err
+	}
+	status, err := readReplicaStatus()
+	if err != nil {
+		return nil, err
+	}
+	shard, exists := status.Shards[shardID]
+	if !exists {
+		return nil, fmt.Errorf("%w: %d is not on this replica", dragonboat.ErrShardNotFound, shardID)
+	}
+	if shard.IsWitness {
+		return nil, fmt.Errorf("shard %d: %w, recover from a replica with a state machine", shardID, ErrWitness)
+	}
+
+	nhc, err := nodeHostConfig()
+	if err != nil {
+		return nil, err
+	}
+	exportDir, err := newExportDir("recover-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(exportDir)
+
+	snapshotDir, export, err := exportOfflineShard(ctx, nhc, shardID, shard, ArchiveShardExportDir(exportDir, shardID))
+	if err != nil {
+		return nil, err
+	}
+
+	record := newRecoveryRecord(export.SnapshotMetadata, members)
+	if err := appendRecoveryRecord(record); err != nil {
+		return nil, err
+	}
+	fail := func(err error) (*RecoveryRecord, error) {
+		failed := record
+		failed.Time = time.Now()
+		failed.Event = RecoveryFailed
+		failed.Error = err.Error()
+		return nil, errors.Join(err, appendRecoveryRecord(failed))
+	}
+
+	if archive != nil {
+		if _, err := WriteArchive(archive, exportDir, map[uint64]uint64{shardID: export.Index}); err != nil {
+			return fail(err)
+		}
+	}
+
+	if err := tools.ImportSnapshot(nhc, snapshotDir, members, env.Current.ReplicaID); err != nil {
+		return fail(fmt.Errorf("error in tools.ImportSnapshot: %w", err))
+	}
+	// The imported membership is recorded by dragonboat, so the shard is started as if it joined
+	status.Shards[shardID] = shardStatus{
+		Join:   true,
+		Config: shard.Config,
+	}
+	data, err := json.Marshal(status)
+	if err != nil {
+		return fail(fmt.Errorf("error marshaling replica status: %w", err))
+	}
+	if err := utils.WriteFileAtomic(filepath.Join(env.Current.RaftStorageDirectory, replicaStatusFile), data, 0644); err != nil {
+		return fail(fmt.Errorf("error writing replica status: %w", err))
+	}
+
+	record.Time = time.Now()
+	record.Event = RecoveryCompleted
+	if err := appendRecoveryRecord(record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// exportOfflineShard starts a node host with only the shard, waits for it to apply everything this replica knows is
+// committed, and exports it to dir. The shard can not make progress without its quorum, so nothing is committed
+// while it runs.
+func exportOfflineShard(ctx context.Context, nhc config.NodeHostConfig, shardID uint64, shard shardStatus, dir string) (string, *SnapshotExport, error) {
+	rc, err := defaultRaftConfig()
+	if err != nil {
+		return "", nil, err
+	}
+	backend, err := newAppBackend()
+	if err != nil {
+		return "", nil, err
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return "", nil, fmt.Errorf("error in os.Mkdir: %w", err)
+	}
+
+	useRaftLogger()
+	nh, err := dragonboat.NewNodeHost(nhc)
+	if err != nil {
+		return "", nil, fmt.Errorf("error in dragonboat.NewNodeHost, raftd must be stopped: %w", err)
+	}
+	defer nh.Close()
+
+	readyMap := syncx.NewMap[uint64, ShardState]()
+	rm := &RaftManager{
+		nodeHost:     nh,
+		logger:       gologger.NewLogger().With().Str("Service", "RaftRecovery").Logger(),
+		Ready:        &readyMap,
+		progress:     syncx.NewMap[uint64, *shardProgress](),
+		shardConfigs: syncx.NewMap[uint64, config.Config](),
+		appBackend:   backend,
+		raftConfig:   rc,
+	}
+	// The initial witnesses were added long ago, or will never be now
+	shard.Witnesses = nil
+	if err := rm.startShard(shardID, shard); err != nil {
+		return "", nil, err
+	}
+	if err := rm.waitForCommitted(ctx, shardID); err != nil {
+		return "", nil, err
+	}
+
+	export, err := rm.exportSnapshotTo(ctx, shardID, dir)
+	if err != nil {
+		return "", nil, err
+	}
+	// Only the metadata is needed, the snapshot is imported from its directory
+	if err := export.Payload.Close(); err != nil {
+		return "", nil, fmt.Errorf("error closing snapshot payload: %w", err)
+	}
+
+	return ExportedSnapshotDir(dir, export.Index), export, nil
+}
+
+// waitForCommitted waits until the shard has applied everything this replica knows is committed
+func (rm *RaftManager) waitForCommitted(ctx context.Context, shardID uint64) error {
+	ticker := time.NewTicker(recoveryPollInterval)
+	defer ticker.Stop()
+	for {
+		if state, _ := rm.Ready.Load(shardID); state == ShardStateFailed {
+			return fmt.Errorf("shard %d failed to start, check the logs", shardID)
+		}
+		applied, commitIndex, err := rm.appliedIndex(ctx, shardID)
+		if err == nil && applied >= commitIndex {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if err != nil {
+				return fmt.Errorf("shard %d: %w", shardID, err)
+			}
+			return fmt.Errorf("shard %d applied up to %d of %d committed entries: %w", shardID, applied, commitIndex, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+func newRecoveryRecord(metadata SnapshotMetadata, members map[uint64]string) RecoveryRecord {
+	record := RecoveryRecord{
+		Time:               time.Now(),
+		Event:              RecoveryStarted,
+		ShardID:            metadata.ShardID,
+		ReplicaID:          env.Current.ReplicaID,
+		Index:              metadata.Index,
+		Term:               metadata.Term,
+		PreviousMembership: metadata.Membership,
+		Members:            toMembers(members),
+	}
+	record.Hostname, _ = os.Hostname()
+	if u, err := user.Current(); err == nil {
+		record.User = u.Username
+	}
+
+	return record
+}
+
+// appendRecoveryRecord appends the record to the audit log, syncing it before returning
+func appendRecoveryRecord(record RecoveryRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("error marshaling recovery record: %w", err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(env.Current.RaftStorageDirectory, recoveryAuditFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening recovery audit log: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("error writing recovery audit log: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("error syncing recovery audit log: %w", err)
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,66 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danthegoodman1/raftd/env"
+)
+
+func TestRecoverShardEndingInConfigChange(t *testing.T) {
+	app, appURL := newTestApp(t)
+	dir := t.TempDir()
+	rm := startTestReplica(t, dir, appURL)
+	waitForShardState(t, rm, 0, ShardStateReady)
+	mustPropose(t, rm, 0, "a")
+
+	// The replica that will never come back, which the application never hears of
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := rm.RecruitReplica(ctx, 2, 0, freeAddr(t), false, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := rm.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	record, err := RecoverShard(ctx, 0, map[uint64]string{env.Current.ReplicaID: env.Current.RaftListenAddr}, &archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Event != RecoveryCompleted || len(record.PreviousMembership.Members) != 2 {
+		t.Fatalf("unexpected recovery record %+v", record)
+	}
+	if archive.Len() == 0 {
+		t.Fatal("archive is empty")
+	}
+	audit, err := os.ReadFile(filepath.Join(dir, recoveryAuditFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(audit), "\n"); lines != 2 {
+		t.Fatalf("audit log has %d records, want started and completed", lines)
+	}
+
+	// The shard has its quorum back and kept its state
+	rm = newTestRaftManager(t)
+	waitForShardState(t, rm, 0, ShardStateReady)
+	mustPropose(t, rm, 0, "b")
+	if _, commands := app.state(); !slices.Equal(commands, []string{"a", "b"}) {
+		t.Fatalf("application has commands %v", commands)
+	}
+	membership, err := rm.GetMembership(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(membership.Members) != 1 || membership.Members[0].ReplicaID != env.Current.ReplicaID {
+		t.Fatalf("unexpected membership %+v", membership)
+	}
+}
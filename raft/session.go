@@ -0,0 +1,420 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/danthegoodman1/raftd/env"
+	"github.com/danthegoodman1/raftd/utils"
+	"github.com/lni/dragonboat/v4/statemachine"
+)
+
+// Client sessions give proposals exactly-once semantics. dragonboat only supports no-op sessions for on disk state
+// machines, so raftd tracks sessions itself: session operations are proposed as entries wrapped in an envelope,
+// which every replica applies to its session table in log order. The table is persisted next to the replica
+// status, and is included in snapshots so every replica makes the same decisions.
+
+type (
+	sessionOp byte
+
+	// sessionEntry is a decoded session envelope
+	sessionEntry struct {
+		op        sessionOp
+		sessionID uint64
+		series    uint64
+		cmd       []byte
+	}
+
+	// sessionStatus is the Value of the result of a session entry
+	sessionStatus uint64
+
+	// sessionTable is the session state of a shard on this replica
+	sessionTable struct {
+		// Index is the index of the last entry reflected in the table
+		Index    uint64
+		Sessions map[uint64]*clientSession
+		// Pending are session proposals that were sent to the application before their results were saved, by entry
+		// index. If the application has applied them when the replica restarts, their results are lost.
+		Pending map[uint64]pendingProposal `json:",omitempty"`
+	}
+
+	clientSession struct {
+		// Series is the last series that was applied
+		Series uint64
+		// Result is the application's result of Series, returned to retries of it
+		Result EntryResult
+		// ResultLost is set if Series was applied, but raftd crashed before saving its result
+		ResultLost bool `json:",omitempty"`
+		// LastUsed is the index of the last entry that used the session, the least recently used session is
+		// evicted when there are too many
+		LastUsed uint64
+	}
+
+	pendingProposal struct {
+		SessionID uint64
+		Series    uint64
+	}
+)
+
+const (
+	sessionOpRegister sessionOp = iota + 1
+	sessionOpUnregister
+	sessionOpPropose
+)
+
+const (
+	sessionStatusApplied sessionStatus = iota + 1
+	sessionStatusDuplicate
+	sessionStatusNotFound
+	sessionStatusStale
+	sessionStatusResultLost
+	sessionStatusExists
+)
+
+const (
+	// sessionMagic prefixes session entries, application commands must not start with it
+	sessionMagic = "\x00raftd-session\x00"
+	// sessionHeaderSize is the size of the envelope before the command
+	sessionHeaderSize = len(sessionMagic) + 1 + 8 + 8
+
+	// maxSessionsPerShard is the number of sessions kept per shard before the least recently used is evicted
+	maxSessionsPerShard = 4096
+	// maxSessionID keeps session IDs exact as JSON numbers
+	maxSessionID = 1<<53 - 1
+
+	sessionsDir = "sessions"
+)
+
+var (
+	ErrSessionNotFound   = errors.New("session not found, it was closed or evicted")
+	ErrSessionSeriesUsed = errors.New("session series was already applied")
+	ErrSessionResultLost = errors.New("session series was applied, but its result was lost")
+	ErrInvalidSeries     = errors.New("invalid session series")
+	ErrInvalidCommand    = errors.New("invalid command")
+)
+
+func encodeSessionEntry(entry sessionEntry) []byte {
+	buf := make([]byte, sessionHeaderSize, sessionHeaderSize+len(entry.cmd))
+	copy(buf, sessionMagic)
+	buf[len(sessionMagic)] = byte(entry.op)
+	binary.BigEndian.PutUint64(buf[len(sessionMagic)+1:], entry.sessionID)
+	binary.BigEndian.PutUint64(buf[len(sessionMagic)+9:], entry.series)
+	return append(buf, entry.cmd...)
+}
+
+// decodeSessionEntry returns the session envelope of cmd, if it has one
+func decodeSessionEntry(cmd []byte) (sessionEntry, bool) {
+	if len(cmd) < sessionHeaderSize || !bytes.HasPrefix(cmd, []byte(sessionMagic)) {
+		return sessionEntry{}, false
+	}
+
+	return sessionEntry{
+		op:        sessionOp(cmd[len(sessionMagic)]),
+		sessionID: binary.BigEndian.Uint64(cmd[len(sessionMagic)+1:]),
+		series:    binary.BigEndian.Uint64(cmd[len(sessionMagic)+9:]),
+		cmd:       cmd[sessionHeaderSize:],
+	}, true
+}
+
+// encodeSessionResult wraps the application's result of a session proposal
+func encodeSessionResult(status sessionStatus, result statemachine.Result) statemachine.Result {
+	data := make([]byte, 8, 8+len(result.Data))
+	binary.BigEndian.PutUint64(data, result.Value)
+	return statemachine.Result{
+		Value: uint64(status),
+		Data:  append(data, result.Data...),
+	}
+}
+
+func decodeSessionResult(result statemachine.Result) (sessionStatus, statemachine.Result) {
+	status := sessionStatus(result.Value)
+	if len(result.Data) < 8 {
+		return status, statemachine.Result{}
+	}
+
+	return status, statemachine.Result{
+		Value: binary.BigEndian.Uint64(result.Data),
+		Data:  result.Data[8:],
+	}
+}
+
+func newSessionTable() *sessionTable {
+	return &sessionTable{Sessions: map[uint64]*clientSession{}}
+}
+
+func sessionTablePath(shardID uint64) string {
+	return filepath.Join(env.Current.RaftStorageDirectory, sessionsDir, fmt.Sprintf("%d.json", shardID))
+}
+
+// loadSessionTable reads the persisted session table of a shard, returning an empty one if there is none
+func loadSessionTable(path string) (*sessionTable, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return newSessionTable(), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading session table: %w", err)
+	}
+
+	return unmarshalSessionTable(data)
+}
+
+func unmarshalSessionTable(data []byte) (*sessionTable, error) {
+	table := newSessionTable()
+	if err := json.Unmarshal(data, table); err != nil {
+		return nil, fmt.Errorf("error unmarshaling session table: %w", err)
+	}
+	if table.Sessions == nil {
+		table.Sessions = map[uint64]*clientSession{}
+	}
+
+	return table, nil
+}
+
+func (t *sessionTable) save(path string) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return fmt.Errorf("error marshaling session table: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("error creating sessions directory: %w", err)
+	}
+	if err := utils.WriteFileAtomic(path, data, 0644); err != nil {
+		return fmt.Errorf("error writing session table: %w", err)
+	}
+
+	return nil
+}
+
+// resolvePending settles the proposals that were pending when the replica stopped. Those the application has
+// applied keep their series with a lost result, the rest are sent again when their entries are replayed.
+func (t *sessionTable) resolvePending(appliedIndex uint64) bool {
+	changed := false
+	for index, pending := range t.Pending {
+		if index > appliedIndex {
+			continue
+		}
+		if session, exists := t.Sessions[pending.SessionID]; exists && session.Series == pending.Series {
+			session.Result = EntryResult{}
+			session.ResultLost = true
+		}
+		delete(t.Pending, index)
+		changed = true
+	}
+	if len(t.Pending) == 0 {
+		t.Pending = nil
+	}
+
+	return changed
+}
+
+// register adds a session, evicting the least recently used one if there are too many
+func (t *sessionTable) register(sessionID, index uint64) sessionStatus {
+	if _, exists := t.Sessions[sessionID]; exists {
+		return sessionStatusExists
+	}
+
+	if len(t.Sessions) >= maxSessionsPerShard {
+		var evictID uint64
+		var evict *clientSession
+		for id, session := range t.Sessions {
+			// Ties are broken by ID so every replica evicts the same session
+			if evict == nil || session.LastUsed < evict.LastUsed || (session.LastUsed == evict.LastUsed && id < evictID) {
+				evictID, evict = id, session
+			}
+		}
+		delete(t.Sessions, evictID)
+	}
+
+	t.Sessions[sessionID] = &clientSession{LastUsed: index}
+	return sessionStatusApplied
+}
+
+// applyUpdate applies the session entries of a batch to the table, returning the positions of the entries that
+// must be sent to the application, and whether the table changed. Results of session entries are set on entries,
+// except for proposals that are sent to the application and their duplicates in the same batch, by position of the
+// proposal they duplicate, which are set by finishUpdate.
+func (t *sessionTable) applyUpdate(entries []statemachine.Entry) (forward []int, duplicates map[int]int, changed bool) {
+	// forwarded is the position of the entry sent for each session's current series in this batch
+	forwarded := map[uint64]int{}
+	duplicates = map[int]int{}
+	for i, entry := range entries {
+		sessionEntry, isSession := decodeSessionEntry(entry.Cmd)
+		if !isSession {
+			forward = append(forward, i)
+			continue
+		}
+
+		if entry.Index <= t.Index {
+			// This entry is being replayed after a restart and is already reflected in the table. It is only sent
+			// again if the application never got it.
+			if pending, exists := t.Pending[entry.Index]; exists {
+				forward = append(forward, i)
+				forwarded[pending.SessionID] = i
+			}
+			continue
+		}
+
+		changed = true
+		switch sessionEntry.op {
+		case sessionOpRegister:
+			entries[i].Result = statemachine.Result{Value: uint64(t.register(sessionEntry.sessionID, entry.Index))}
+		case sessionOpUnregister:
+			delete(t.Sessions, sessionEntry.sessionID)
+			entries[i].Result = statemachine.Result{Value: uint64(sessionStatusApplied)}
+		case sessionOpPropose:
+			session, exists := t.Sessions[sessionEntry.sessionID]
+			switch {
+			case !exists:
+				entries[i].Result = statemachine.Result{Value: uint64(sessionStatusNotFound)}
+			case sessionEntry.series < session.Series:
+				entries[i].Result = statemachine.Result{Value: uint64(sessionStatusStale)}
+			case sessionEntry.series == session.Series:
+				session.LastUsed = entry.Index
+				if source, inBatch := forwarded[sessionEntry.sessionID]; inBatch {
+					duplicates[i] = source
+				} else if session.ResultLost {
+					entries[i].Result = statemachine.Result{Value: uint64(sessionStatusResultLost)}
+				} else {
+					entries[i].Result = encodeSessionResult(sessionStatusDuplicate, encodeEntryResult(session.Result))
+				}
+			default:
+				session.Series = sessionEntry.series
+				session.Result = EntryResult{}
+				session.ResultLost = false
+				session.LastUsed = entry.Index
+				forward = append(forward, i)
+				forwarded[sessionEntry.sessionID] = i
+				if t.Pending == nil {
+					t.Pending = map[uint64]pendingProposal{}
+				}
+				t.Pending[entry.Index] = pendingProposal{SessionID: sessionEntry.sessionID, Series: sessionEntry.series}
+			}
+		default:
+			// Unknown ops are ignored so every replica does the same thing
+			entries[i].Result = statemachine.Result{}
+		}
+	}
+	if len(entries) > 0 && entries[len(entries)-1].Index > t.Index {
+		t.Index = entries[len(entries)-1].Index
+	}
+
+	return forward, duplicates, changed
+}
+
+// finishUpdate stores the application's results of the session proposals in the batch once it has applied them,
+// returning whether the table changed. The results of forwarded entries must already be set on entries.
+func (t *sessionTable) finishUpdate(entries []statemachine.Entry, forward []int, duplicates map[int]int) (changed bool) {
+	for _, i := range forward {
+		sessionEntry, isSession := decodeSessionEntry(entries[i].Cmd)
+		if !isSession {
+			continue
+		}
+		if pending, exists := t.Pending[entries[i].Index]; exists {
+			delete(t.Pending, entries[i].Index)
+			changed = true
+			if session, exists := t.Sessions[pending.SessionID]; exists && session.Series == sessionEntry.series {
+				// Results were encoded by the state machine, so they always decode
+				session.Result, _ = decodeEntryResult(entries[i].Result)
+			}
+		}
+		entries[i].Result = encodeSessionResult(sessionStatusApplied, entries[i].Result)
+	}
+	for i, source := range duplicates {
+		_, result := decodeSessionResult(entries[source].Result)
+		entries[i].Result = encodeSessionResult(sessionStatusDuplicate, result)
+	}
+	if len(t.Pending) == 0 {
+		t.Pending = nil
+	}
+
+	return changed
+}
+
+// OpenSession registers a new client session on the shard, returning its ID
+func (rm *RaftManager) OpenSession(ctx context.Context, shardID uint64) (uint64, error) {
+	// Add deadline if not set
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+	}
+
+	for {
+		sessionID := rand.Uint64N(maxSessionID) + 1
+		result, err := rm.propose(ctx, shardID, encodeSessionEntry(sessionEntry{op: sessionOpRegister, sessionID: sessionID}))
+		if err != nil {
+			return 0, err
+		}
+		// Pick another ID on the off chance it is taken
+		if sessionStatus(result.Value) != sessionStatusExists {
+			return sessionID, nil
+		}
+	}
+}
+
+// CloseSession unregisters a client session, after which its proposals fail with ErrSessionNotFound
+func (rm *RaftManager) CloseSession(ctx context.Context, shardID, sessionID uint64) error {
+	// Add deadline if not set
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+	}
+
+	_, err := rm.propose(ctx, shardID, encodeSessionEntry(sessionEntry{op: sessionOpUnregister, sessionID: sessionID}))
+	return err
+}
+
+// ProposeInSession submits cmd in a client session. Each new command must use a higher series than the last, and a
+// retry must reuse the series of the command it retries. A retry of a command that was already applied returns
+// the result of the original with duplicate set, instead of being applied again.
+func (rm *RaftManager) ProposeInSession(ctx context.Context, shardID, sessionID, series uint64, cmd []byte) (result EntryResult, duplicate bool, err error) {
+	if series == 0 {
+		return EntryResult{}, false, fmt.Errorf("%w: series must be >= 1", ErrInvalidSeries)
+	}
+	// Add deadline if not set
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+	}
+
+	rawResult, err := rm.propose(ctx, shardID, encodeSessionEntry(sessionEntry{
+		op:        sessionOpPropose,
+		sessionID: sessionID,
+		series:    series,
+		cmd:       cmd,
+	}))
+	if err != nil {
+		return EntryResult{}, false, err
+	}
+
+	return sessionProposalResult(sessionID, rawResult)
+}
+
+// sessionProposalResult unwraps the result of a session proposal
+func sessionProposalResult(sessionID uint64, rawResult statemachine.Result) (EntryResult, bool, error) {
+	status, rawResult := decodeSessionResult(rawResult)
+	switch status {
+	case sessionStatusApplied, sessionStatusDuplicate:
+		result, err := decodeEntryResult(rawResult)
+		return result, status == sessionStatusDuplicate, err
+	case sessionStatusNotFound:
+		return EntryResult{}, false, fmt.Errorf("%w: %d", ErrSessionNotFound, sessionID)
+	case sessionStatusStale:
+		return EntryResult{}, false, fmt.Errorf("%w: a later series was already applied", ErrSessionSeriesUsed)
+	case sessionStatusResultLost:
+		return EntryResult{}, true, ErrSessionResultLost
+	default:
+		return EntryResult{}, false, fmt.Errorf("unknown session result status %d", status)
+	}
+}
@@ -0,0 +1,294 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v4/statemachine"
+)
+
+func sessionLogEntry(index uint64, op sessionOp, sessionID, series uint64) statemachine.Entry {
+	return statemachine.Entry{
+		Index: index,
+		Cmd:   encodeSessionEntry(sessionEntry{op: op, sessionID: sessionID, series: series, cmd: []byte("cmd")}),
+	}
+}
+
+// applyBatch applies a batch like the state machine, with the application returning the entry index as the value
+func applyBatch(table *sessionTable, entries []statemachine.Entry) (forward []int, changed bool) {
+	forward, duplicates, changed := table.applyUpdate(entries)
+	for _, i := range forward {
+		entries[i].Result = encodeEntryResult(EntryResult{Value: entries[i].Index})
+	}
+	finished := table.finishUpdate(entries, forward, duplicates)
+	return forward, changed || finished
+}
+
+// sessionStatuses returns the session status of every entry, 0 for entries without a session
+func sessionStatuses(entries []statemachine.Entry) []sessionStatus {
+	statuses := make([]sessionStatus, len(entries))
+	for i, entry := range entries {
+		if _, isSession := decodeSessionEntry(entry.Cmd); isSession {
+			statuses[i], _ = decodeSessionResult(entry.Result)
+		}
+	}
+	return statuses
+}
+
+func TestSessionTableApply(t *testing.T) {
+	table := newSessionTable()
+	entries := []statemachine.Entry{
+		sessionLogEntry(1, sessionOpRegister, 7, 0),
+		sessionLogEntry(2, sessionOpRegister, 7, 0),
+		sessionLogEntry(3, sessionOpPropose, 7, 1),
+		{Index: 4, Cmd: []byte("no session")},
+		sessionLogEntry(5, sessionOpPropose, 7, 1),
+		sessionLogEntry(6, sessionOpPropose, 7, 2),
+		sessionLogEntry(7, sessionOpPropose, 7, 1),
+		sessionLogEntry(8, sessionOpPropose, 8, 1),
+		sessionLogEntry(9, sessionOpUnregister, 7, 0),
+		sessionLogEntry(10, sessionOpPropose, 7, 3),
+	}
+	forward, changed := applyBatch(table, entries)
+	if !changed {
+		t.Fatal("table did not change")
+	}
+	if want := []int{2, 3, 5}; !reflect.DeepEqual(forward, want) {
+		t.Fatalf("forwarded entries %v, want %v", forward, want)
+	}
+
+	want := []sessionStatus{
+		sessionStatusApplied,
+		sessionStatusExists,
+		sessionStatusApplied,
+		0,
+		sessionStatusDuplicate,
+		sessionStatusApplied,
+		sessionStatusStale,
+		sessionStatusNotFound,
+		sessionStatusApplied,
+		sessionStatusNotFound,
+	}
+	if statuses := sessionStatuses(entries); !reflect.DeepEqual(statuses, want) {
+		t.Fatalf("statuses %v, want %v", statuses, want)
+	}
+
+	result, duplicate, err := sessionProposalResult(7, entries[2].Result)
+	if err != nil || duplicate || result.Value != 3 {
+		t.Fatalf("applied proposal returned %+v, duplicate %t, error %v", result, duplicate, err)
+	}
+	// A duplicate in the same batch returns the result of the original
+	result, duplicate, err = sessionProposalResult(7, entries[4].Result)
+	if err != nil || !duplicate || result.Value != 3 {
+		t.Fatalf("duplicate returned %+v, duplicate %t, error %v", result, duplicate, err)
+	}
+
+	if table.Index != 10 || len(table.Sessions) != 0 || table.Pending != nil {
+		t.Fatalf("table is at %d with %d sessions and pending %v", table.Index, len(table.Sessions), table.Pending)
+	}
+}
+
+func TestSessionTableDuplicate(t *testing.T) {
+	table := newSessionTable()
+	applyBatch(table, []statemachine.Entry{sessionLogEntry(1, sessionOpRegister, 7, 0)})
+	proposal := []statemachine.Entry{sessionLogEntry(2, sessionOpPropose, 7, 1)}
+	forward, duplicates, _ := table.applyUpdate(proposal)
+	proposal[0].Result = encodeEntryResult(EntryResult{Value: 2, Status: 409, Data: []byte("data"), Error: "rejected"})
+	if !table.finishUpdate(proposal, forward, duplicates) {
+		t.Fatal("storing the result did not change the table")
+	}
+
+	retry := []statemachine.Entry{sessionLogEntry(3, sessionOpPropose, 7, 1)}
+	if forward, _ := applyBatch(table, retry); len(forward) != 0 {
+		t.Fatalf("retry was forwarded to the application")
+	}
+	if status, _ := decodeSessionResult(retry[0].Result); status != sessionStatusDuplicate {
+		t.Fatalf("retry has status %d", status)
+	}
+	_, original := decodeSessionResult(proposal[0].Result)
+	_, duplicate := decodeSessionResult(retry[0].Result)
+	if !reflect.DeepEqual(duplicate, original) {
+		t.Fatalf("retry returned %v, the original returned %v", duplicate, original)
+	}
+}
+
+func TestProposeInSessionDuplicate(t *testing.T) {
+	app, appURL := newTestApp(t)
+	dir := t.TempDir()
+	rm := startTestReplica(t, dir, appURL)
+	waitForShardState(t, rm, 0, ShardStateReady)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	sessionID, err := rm.OpenSession(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	propose := func() ([]byte, bool) {
+		t.Helper()
+		result, duplicate, err := rm.ProposeInSession(ctx, 0, sessionID, 1, []byte("a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := json.Marshal(result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response, duplicate
+	}
+	first, duplicate := propose()
+	if duplicate {
+		t.Fatal("first proposal is a duplicate")
+	}
+	second, duplicate := propose()
+	if !duplicate || !bytes.Equal(second, first) {
+		t.Fatalf("retry returned %s, duplicate %t, the original returned %s", second, duplicate, first)
+	}
+
+	// The result is kept across restarts
+	if err := rm.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	rm = newTestRaftManager(t)
+	waitForShardState(t, rm, 0, ShardStateReady)
+	if third, duplicate := propose(); !duplicate || !bytes.Equal(third, first) {
+		t.Fatalf("retry after a restart returned %s, duplicate %t, the original returned %s", third, duplicate, first)
+	}
+	if _, commands := app.state(); !slices.Equal(commands, []string{"a"}) {
+		t.Fatalf("application applied %v", commands)
+	}
+}
+
+func TestSessionTableReplay(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// appliedIndex is the last index the application applied before the replica crashed
+		appliedIndex uint64
+		forward      []int
+		err          error
+	}{
+		{name: "application did not apply the batch", appliedIndex: 1, forward: []int{0, 2}},
+		{name: "application applied the batch", appliedIndex: 4, err: ErrSessionResultLost},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			table := newSessionTable()
+			applyBatch(table, []statemachine.Entry{sessionLogEntry(1, sessionOpRegister, 7, 0)})
+
+			// The replica crashes once the table is saved before the application call
+			batch := func() []statemachine.Entry {
+				return []statemachine.Entry{
+					sessionLogEntry(2, sessionOpPropose, 7, 1),
+					sessionLogEntry(3, sessionOpPropose, 7, 1),
+					{Index: 4, Cmd: []byte("no session")},
+				}
+			}
+			table.applyUpdate(batch())
+			path := filepath.Join(t.TempDir(), "sessions.json")
+			if err := table.save(path); err != nil {
+				t.Fatal(err)
+			}
+			loaded, err := loadSessionTable(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(loaded, table) {
+				t.Fatalf("loaded %+v, saved %+v", loaded, table)
+			}
+			loaded.resolvePending(tc.appliedIndex)
+
+			// Entries the application applied are not replayed
+			var replayed []statemachine.Entry
+			for _, entry := range batch() {
+				if entry.Index > tc.appliedIndex {
+					replayed = append(replayed, entry)
+				}
+			}
+			forward, _ := applyBatch(loaded, replayed)
+			if !reflect.DeepEqual(forward, tc.forward) {
+				t.Fatalf("forwarded entries %v, want %v", forward, tc.forward)
+			}
+			if loaded.Pending != nil {
+				t.Fatalf("pending %v after the replay", loaded.Pending)
+			}
+
+			retry := []statemachine.Entry{sessionLogEntry(5, sessionOpPropose, 7, 1)}
+			applyBatch(loaded, retry)
+			result, duplicate, err := sessionProposalResult(7, retry[0].Result)
+			if !duplicate || !errors.Is(err, tc.err) || (tc.err == nil && result.Value != 2) {
+				t.Fatalf("retry returned %+v, duplicate %t, error %v", result, duplicate, err)
+			}
+
+			// A batch that is only replayed leaves the table alone
+			if _, changed := applyBatch(loaded, []statemachine.Entry{sessionLogEntry(5, sessionOpPropose, 7, 1)}); changed {
+				t.Fatal("replaying an entry changed the table")
+			}
+		})
+	}
+}
+
+func TestSessionTableEviction(t *testing.T) {
+	table := newSessionTable()
+	var index uint64
+	for sessionID := uint64(1); sessionID <= maxSessionsPerShard; sessionID++ {
+		index++
+		applyBatch(table, []statemachine.Entry{sessionLogEntry(index, sessionOpRegister, sessionID, 0)})
+	}
+	// Session 1 is used, so 2 is the least recently used
+	index++
+	applyBatch(table, []statemachine.Entry{sessionLogEntry(index, sessionOpPropose, 1, 1)})
+
+	index++
+	entries := []statemachine.Entry{sessionLogEntry(index, sessionOpRegister, maxSessionsPerShard+1, 0)}
+	applyBatch(table, entries)
+	if status, _ := decodeSessionResult(entries[0].Result); status != sessionStatusApplied {
+		t.Fatalf("register returned status %d", status)
+	}
+	if len(table.Sessions) != maxSessionsPerShard {
+		t.Fatalf("table has %d sessions", len(table.Sessions))
+	}
+	for _, sessionID := range []uint64{1, 3, maxSessionsPerShard + 1} {
+		if _, exists := table.Sessions[sessionID]; !exists {
+			t.Fatalf("session %d was evicted", sessionID)
+		}
+	}
+
+	index++
+	entries = []statemachine.Entry{sessionLogEntry(index, sessionOpPropose, 2, 1)}
+	applyBatch(table, entries)
+	if _, _, err := sessionProposalResult(2, entries[0].Result); err == nil {
+		t.Fatal("proposal in the evicted session succeeded")
+	}
+
+	// Sessions that were last used by the same entry are evicted by ID, so every replica evicts the same one
+	table = newSessionTable()
+	for sessionID := uint64(maxSessionsPerShard); sessionID > 0; sessionID-- {
+		table.Sessions[sessionID] = &clientSession{LastUsed: 1}
+	}
+	table.Index = 1
+	applyBatch(table, []statemachine.Entry{sessionLogEntry(2, sessionOpRegister, maxSessionsPerShard+1, 0)})
+	if _, exists := table.Sessions[1]; exists {
+		t.Fatal("session 1 was not evicted")
+	}
+}
+
+func TestLoadSessionTableWithoutResults(t *testing.T) {
+	// Tables written while sessions did not keep results still load, with empty results
+	table, err := unmarshalSessionTable([]byte(`{"Index":5,"Sessions":{"7":{"Series":2,"LastUsed":5}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &sessionTable{
+		Index:    5,
+		Sessions: map[uint64]*clientSession{7: {Series: 2, LastUsed: 5}},
+	}
+	if !reflect.DeepEqual(table, want) {
+		t.Fatalf("loaded %+v, want %+v", table, want)
+	}
+}
@@ -0,0 +1,226 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/danthegoodman1/raftd/env"
+	"github.com/danthegoodman1/raftd/utils"
+	"github.com/lni/dragonboat/v4"
+	"github.com/lni/dragonboat/v4/statemachine"
+	"github.com/samber/lo"
+)
+
+var (
+	ErrShardExists = errors.New("shard already exists")
+)
+
+// CreateShard starts a new shard on this replica. This must be called on every replica in members and witnesses to
+// bootstrap the shard. Witnesses are added by the leader once the shard has started. If this replica is not in
+// members or witnesses, it will join the shard and must be recruited by the leader.
+func (rm *RaftManager) CreateShard(shardID uint64, members, witnesses map[uint64]dragonboat.Target, shardConfig *ShardConfig) error {
+	if _, err := shardConfig.Apply(rm.raftConfig); err != nil {
+		return err
+	}
+
+	rm.statusMu.Lock()
+	defer rm.statusMu.Unlock()
+
+	if _, exists := rm.status.Shards[shardID]; exists {
+		return fmt.Errorf("%w: %d", ErrShardExists, shardID)
+	}
+
+	shard := newShardStatus(members, witnesses)
+	shard.Config = shardConfig
+
+	if err := rm.startShard(shardID, shard); err != nil {
+		// The shard was never persisted, so it must not hold back readiness
+		rm.Ready.Delete(shardID)
+		return err
+	}
+
+	rm.status.Shards[shardID] = shard
+	if err := rm.saveStatus(); err != nil {
+		// The shard is running, but we won't remember it on restart, so stop it to keep things consistent
+		if stopErr := rm.nodeHost.StopShard(shardID); stopErr != nil {
+			rm.logger.Error().Err(stopErr).Uint64("ShardID", shardID).Msg("error stopping shard after failing to save replica status")
+		}
+		rm.Ready.Delete(shardID)
+		delete(rm.status.Shards, shardID)
+		return err
+	}
+
+	rm.logger.Info().Uint64("ShardID", shardID).Bool("Join", shard.Join).Msg("created shard")
+	return nil
+}
+
+// newShardStatus determines how this replica should start a shard with the given initial members
+func newShardStatus(members, witnesses map[uint64]dragonboat.Target) shardStatus {
+	if _, isWitness := witnesses[env.Current.ReplicaID]; isWitness {
+		// Witnesses are added to the shard by the leader, so they always join
+		return shardStatus{Join: true, IsWitness: true}
+	}
+	if _, isMember := members[env.Current.ReplicaID]; !isMember {
+		return shardStatus{Join: true, IsNonVoting: env.Current.RaftJoinNonVoting}
+	}
+
+	return shardStatus{
+		InitialMembers: members,
+		Witnesses:      witnesses,
+	}
+}
+
+// recoverShards starts every shard recorded in the replica status, returning how many started successfully.
+// Shards that fail to start are logged and left not ready.
+func (rm *RaftManager) recoverShards() int {
+	rm.statusMu.Lock()
+	defer rm.statusMu.Unlock()
+
+	shardIDs := lo.Keys(rm.status.Shards)
+	slices.Sort(shardIDs)
+
+	started := 0
+	for _, shardID := range shardIDs {
+		shard := rm.status.Shards[shardID]
+		if err := rm.startShard(shardID, shard); err != nil {
+			rm.logger.Error().Err(err).Uint64("ShardID", shardID).Msg("error starting shard, it will not be available")
+			rm.Ready.Store(shardID, ShardStateFailed)
+			continue
+		}
+		rm.logger.Debug().Uint64("ShardID", shardID).Bool("Join", shard.Join).Msg("started shard")
+		started++
+	}
+
+	return started
+}
+
+// startShard starts the local replica of a shard
+func (rm *RaftManager) startShard(shardID uint64, shard shardStatus) error {
+	rc, err := shard.Config.Apply(rm.raftConfig)
+	if err != nil {
+		rm.Ready.Store(shardID, ShardStateFailed)
+		return err
+	}
+	rc.ShardID = shardID
+
+	initialMembers := shard.InitialMembers
+	if shard.Join {
+		initialMembers = nil
+	}
+
+	// The state machine moves the shard along once it opens
+	rm.Ready.Store(shardID, ShardStateBooting)
+
+	factory := func(shardID uint64, replicaID uint64) statemachine.IOnDiskStateMachine {
+		return createStateMachine(shardID, replicaID, rm.logger, rm.appBackend, rm.Ready, rm.getProgress(shardID), func() (uint64, error) {
+			return rm.snapshotIndex(shardID)
+		}, rm.closing)
+	}
+	// A non-voting replica must know it is one before it is added to the membership
+	rc.IsNonVoting = shard.IsNonVoting
+	if shard.IsWitness {
+		// Witnesses never talk to the application
+		rc.IsWitness = true
+		rc.SnapshotEntries = 0
+		factory = func(shardID uint64, replicaID uint64) statemachine.IOnDiskStateMachine {
+			return &witnessStateMachine{}
+		}
+	}
+
+	err = rm.nodeHost.StartOnDiskReplica(initialMembers, shard.Join, factory, rc)
+	if errors.Is(err, dragonboat.ErrShardAlreadyExist) {
+		return fmt.Errorf("%w: %d", ErrShardExists, shardID)
+	}
+	if err != nil {
+		rm.Ready.Store(shardID, ShardStateFailed)
+		return fmt.Errorf("error in StartOnDiskReplica: %w", err)
+	}
+	rm.shardConfigs.Store(shardID, rc)
+
+	if shard.IsWitness {
+		// There is nothing for a witness to catch up on
+		rm.Ready.Store(shardID, ShardStateReady)
+	}
+	if len(shard.Witnesses) > 0 {
+		go rm.addInitialWitnesses(shardID, shard.Witnesses)
+	}
+
+	return nil
+}
+
+// addInitialWitnesses adds the initial witnesses of a shard once this replica is its leader. Every initial member
+// runs this until the witnesses show up in the membership, so it completes regardless of who becomes leader.
+func (rm *RaftManager) addInitialWitnesses(shardID uint64, witnesses map[uint64]dragonboat.Target) {
+	logger := rm.logger.With().Uint64("ShardID", shardID).Logger()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rm.closing:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		done, err := rm.addMissingWitnesses(ctx, shardID, witnesses)
+		cancel()
+		if err != nil {
+			logger.Warn().Err(err).Msg("error adding initial witnesses, will retry")
+		}
+		if done {
+			return
+		}
+	}
+}
+
+// addMissingWitnesses adds any witnesses that are not yet in the shard if this replica is the leader, returning
+// whether every witness is now in the shard (or was removed from it).
+func (rm *RaftManager) addMissingWitnesses(ctx context.Context, shardID uint64, witnesses map[uint64]dragonboat.Target) (bool, error) {
+	membership, err := rm.GetMembership(ctx, shardID)
+	if err != nil {
+		return false, err
+	}
+
+	var missing []uint64
+	for replicaID := range witnesses {
+		isWitness := lo.ContainsBy(membership.Witnesses, func(member Member) bool {
+			return member.ReplicaID == replicaID
+		})
+		if !isWitness && !lo.Contains(membership.Removed, replicaID) {
+			missing = append(missing, replicaID)
+		}
+	}
+	if len(missing) == 0 {
+		return true, nil
+	}
+	if membership.Leader == nil || membership.Leader.ReplicaID != env.Current.ReplicaID {
+		return false, nil
+	}
+
+	for _, replicaID := range missing {
+		if err := rm.nodeHost.SyncRequestAddWitness(ctx, shardID, replicaID, witnesses[replicaID], 0); err != nil {
+			return false, fmt.Errorf("error in nodeHost.SyncRequestAddWitness: %w", err)
+		}
+		rm.logger.Info().Uint64("ShardID", shardID).Uint64("ReplicaID", replicaID).Msg("added initial witness")
+	}
+
+	return true, nil
+}
+
+// saveStatus persists the replica status, statusMu must be held
+func (rm *RaftManager) saveStatus() error {
+	data, err := json.Marshal(rm.status)
+	if err != nil {
+		return fmt.Errorf("error marshaling replica status: %w", err)
+	}
+
+	if err := utils.WriteFileAtomic(rm.statusPath, data, 0644); err != nil {
+		return fmt.Errorf("error writing replica status: %w", err)
+	}
+
+	return nil
+}
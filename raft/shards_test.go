@@ -0,0 +1,28 @@
+package raft
+
+import (
+	"testing"
+
+	"github.com/lni/dragonboat/v4"
+)
+
+func TestCreateShardFailureLeavesReadiness(t *testing.T) {
+	_, appURL := newTestApp(t)
+	rm := startTestReplica(t, t.TempDir(), appURL)
+	waitForShardState(t, rm, 0, ShardStateReady)
+	before := rm.Readiness()
+	if !before.Ready {
+		t.Fatalf("replica is not ready: %+v", before)
+	}
+
+	members := map[uint64]dragonboat.Target{1: "127.0.0.1:1", 2: "not an address"}
+	if err := rm.CreateShard(1, members, nil, nil); err == nil {
+		t.Fatal("created a shard with an invalid member address")
+	}
+	if state, exists := rm.Ready.Load(1); exists {
+		t.Fatalf("failed shard has state %s", state)
+	}
+	if after := rm.Readiness(); !after.Ready || len(after.Shards) != len(before.Shards) {
+		t.Fatalf("readiness changed from %+v to %+v", before, after)
+	}
+}
@@ -0,0 +1,301 @@
+package raft
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/danthegoodman1/raftd/env"
+	"github.com/lni/dragonboat/v4"
+	"github.com/lni/dragonboat/v4/raftpb"
+	"github.com/samber/lo"
+)
+
+// snapshotExportsDir holds the snapshots exported to stream them with ExportSnapshot, under RAFT_DIR
+const snapshotExportsDir = "snapshot-exports"
+
+type (
+	SnapshotOptions struct {
+		// ExportPath is an existing directory to export the snapshot to, for backups or quorum recovery
+		ExportPath string
+		// Compact removes every log entry covered by the snapshot, instead of keeping RAFT_COMPACTION_OVERHEAD of
+		// them. Not supported when exporting.
+		Compact bool
+	}
+
+	// SnapshotMetadata is the raft state a snapshot was taken at
+	SnapshotMetadata struct {
+		ShardID uint64
+		Index   uint64
+		Term    uint64
+		// Membership is the membership of the shard as of Index
+		Membership SnapshotMembership
+	}
+
+	SnapshotMembership struct {
+		ConfigChangeIndex uint64
+		Members           []Member
+		NonVoting         []Member
+		Witnesses         []Member
+		Removed           []uint64
+	}
+
+	// SnapshotExport is an exported snapshot being streamed. Closing the payload removes the export.
+	SnapshotExport struct {
+		SnapshotMetadata
+		// Payload is the snapshot the application wrote in /SaveSnapshot
+		Payload io.ReadCloser
+	}
+
+	// SnapshotInfo describes a snapshot retained by this replica
+	SnapshotInfo struct {
+		SnapshotMetadata
+		// Size is the total size of the snapshot's files in bytes
+		Size int64
+	}
+
+	// exportedPayload removes the export directory once the payload is closed
+	exportedPayload struct {
+		io.ReadCloser
+		dir string
+	}
+)
+
+var (
+	ErrInvalidSnapshotOptions = errors.New("invalid snapshot options")
+
+	// snapshotShardDirPattern matches dragonboat's per shard snapshot directories, snapshot-<shard>-<replica>
+	snapshotShardDirPattern = regexp.MustCompile(`^snapshot-(\d+)-(\d+)$`)
+	// snapshotDirPattern matches finished snapshot directories, in progress ones have a suffix
+	snapshotDirPattern = regexp.MustCompile(`^snapshot-[0-9A-F]{16}$`)
+)
+
+// ExportedSnapshotDir is the directory dragonboat exports the snapshot at index to, under exportPath
+func ExportedSnapshotDir(exportPath string, index uint64) string {
+	return filepath.Join(exportPath, snapshotDirName(index))
+}
+
+// snapshotContext adds the SNAPSHOT_REQUEST_TIMEOUT_SEC deadline if ctx has none
+func snapshotContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, hasDeadline := ctx.Deadline(); hasDeadline {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(env.Current.SnapshotRequestTimeoutSec)*time.Second)
+}
+
+// CreateSnapshot takes a snapshot of the shard on this replica, returning its index. Exported snapshots are written
+// to opts.ExportPath, and are not used by raftd itself.
+func (rm *RaftManager) CreateSnapshot(ctx context.Context, shardID uint64, opts SnapshotOptions) (uint64, error) {
+	ctx, cancel := snapshotContext(ctx)
+	defer cancel()
+
+	if opts.ExportPath != "" {
+		if opts.Compact {
+			return 0, fmt.Errorf("%w: exported snapshots can not compact the log", ErrInvalidSnapshotOptions)
+		}
+		if info, err := os.Stat(opts.ExportPath); err != nil || !info.IsDir() {
+			return 0, fmt.Errorf("%w: export path '%s' is not an existing directory", ErrInvalidSnapshotOptions, opts.ExportPath)
+		}
+	}
+
+	index, err := rm.nodeHost.SyncRequestSnapshot(ctx, shardID, dragonboat.SnapshotOption{
+		ExportPath: opts.ExportPath,
+		Exported:   opts.ExportPath != "",
+		// A compaction overhead of 0 compacts every entry up to the snapshot
+		OverrideCompactionOverhead: opts.Compact,
+		CompactionOverhead:         0,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error in nodeHost.SyncRequestSnapshot: %w", err)
+	}
+
+	rm.logger.Info().Uint64("ShardID", shardID).Uint64("Index", index).Str("ExportPath", opts.ExportPath).Bool("Compact", opts.Compact).Msg("created snapshot")
+	return index, nil
+}
+
+// ExportSnapshot takes an exported snapshot of the shard, returning its metadata and the application's payload.
+// Local snapshots only hold raftd's state, since the application keeps its own state, so a new snapshot is always
+// taken. The caller must close the payload.
+func (rm *RaftManager) ExportSnapshot(ctx context.Context, shardID uint64) (*SnapshotExport, error) {
+	dir, err := newExportDir(fmt.Sprintf("%d-", shardID))
+	if err != nil {
+		return nil, err
+	}
+
+	export, err := rm.exportSnapshotTo(ctx, shardID, dir)
+	if err != nil {
+		if removeErr := os.RemoveAll(dir); removeErr != nil {
+			rm.logger.Error().Err(removeErr).Str("Dir", dir).Msg("error removing snapshot export")
+		}
+		return nil, err
+	}
+
+	export.Payload = &exportedPayload{ReadCloser: export.Payload, dir: dir}
+	return export, nil
+}
+
+func (rm *RaftManager) exportSnapshotTo(ctx context.Context, shardID uint64, dir string) (*SnapshotExport, error) {
+	index, err := rm.CreateSnapshot(ctx, shardID, SnapshotOptions{ExportPath: dir})
+	if err != nil {
+		return nil, err
+	}
+
+	snapshotDir := ExportedSnapshotDir(dir, index)
+	ss, err := readSnapshotMetadata(snapshotDir)
+	if err != nil {
+		return nil, err
+	}
+	if ss.Witness {
+		return nil, ErrWitness
+	}
+
+	payload, err := openSnapshotPayload(filepath.Join(snapshotDir, filepath.Base(ss.Filepath)))
+	if err != nil {
+		return nil, err
+	}
+
+	return &SnapshotExport{
+		SnapshotMetadata: newSnapshotMetadata(ss),
+		Payload:          payload,
+	}, nil
+}
+
+// newExportDir creates a directory to export snapshots to under RAFT_DIR/snapshot-exports, which is cleared when
+// raftd starts
+func newExportDir(prefix string) (string, error) {
+	exportsDir := filepath.Join(env.Current.RaftStorageDirectory, snapshotExportsDir)
+	if err := os.MkdirAll(exportsDir, 0755); err != nil {
+		return "", fmt.Errorf("error in os.MkdirAll: %w", err)
+	}
+	dir, err := os.MkdirTemp(exportsDir, prefix)
+	if err != nil {
+		return "", fmt.Errorf("error in os.MkdirTemp: %w", err)
+	}
+
+	return dir, nil
+}
+
+// removeSnapshotExports removes exports left behind by a previous run
+func removeSnapshotExports() error {
+	return os.RemoveAll(filepath.Join(env.Current.RaftStorageDirectory, snapshotExportsDir))
+}
+
+// ListSnapshots lists the snapshots retained by this replica for the shard, or for every shard if shardID is nil,
+// ordered by shard and index
+func (rm *RaftManager) ListSnapshots(shardID *uint64) ([]SnapshotInfo, error) {
+	snapshots := make([]SnapshotInfo, 0)
+	err := filepath.WalkDir(rm.nodeHost.NodeHostConfig().NodeHostDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		match := snapshotShardDirPattern.FindStringSubmatch(d.Name())
+		if match == nil {
+			return nil
+		}
+
+		dirShardID, _ := strconv.ParseUint(match[1], 10, 64)
+		if shardID == nil || *shardID == dirShardID {
+			shardSnapshots, err := listShardSnapshots(path)
+			if err != nil {
+				return err
+			}
+			snapshots = append(snapshots, shardSnapshots...)
+		}
+		return filepath.SkipDir
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error in filepath.WalkDir: %w", err)
+	}
+
+	slices.SortFunc(snapshots, func(a, b SnapshotInfo) int {
+		return cmp.Or(cmp.Compare(a.ShardID, b.ShardID), cmp.Compare(a.Index, b.Index))
+	})
+	return snapshots, nil
+}
+
+func listShardSnapshots(dir string) ([]SnapshotInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error in os.ReadDir: %w", err)
+	}
+
+	var snapshots []SnapshotInfo
+	for _, entry := range entries {
+		if !entry.IsDir() || !snapshotDirPattern.MatchString(entry.Name()) {
+			continue
+		}
+		snapshotDir := filepath.Join(dir, entry.Name())
+		ss, err := readSnapshotMetadata(snapshotDir)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Removed by compaction while listing
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		size, err := dirSize(snapshotDir)
+		if err != nil {
+			return nil, err
+		}
+
+		snapshots = append(snapshots, SnapshotInfo{
+			SnapshotMetadata: newSnapshotMetadata(ss),
+			Size:             size,
+		})
+	}
+
+	return snapshots, nil
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+
+	return size, err
+}
+
+func newSnapshotMetadata(ss raftpb.Snapshot) SnapshotMetadata {
+	removed := lo.Keys(ss.Membership.Removed)
+	slices.Sort(removed)
+	return SnapshotMetadata{
+		ShardID: ss.ShardID,
+		Index:   ss.Index,
+		Term:    ss.Term,
+		Membership: SnapshotMembership{
+			ConfigChangeIndex: ss.Membership.ConfigChangeId,
+			Members:           toMembers(ss.Membership.Addresses),
+			NonVoting:         toMembers(ss.Membership.NonVotings),
+			Witnesses:         toMembers(ss.Membership.Witnesses),
+			Removed:           removed,
+		},
+	}
+}
+
+func (p *exportedPayload) Close() error {
+	return errors.Join(p.ReadCloser.Close(), os.RemoveAll(p.dir))
+}
@@ -0,0 +1,196 @@
+package raft
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/snappy"
+	"github.com/lni/dragonboat/v4/raftpb"
+)
+
+// Dragonboat's snapshot files, which are read to stream exported snapshots. Dragonboat only has a reader for them
+// internally, so the parts of the format raftd needs are implemented here.
+//
+// A snapshot directory holds the snapshot file and a metadata file. The metadata file is an 8 byte hash followed by
+// a marshaled raftpb.Snapshot.
+//
+// The snapshot file is a header padded to 1024 bytes (header length uint64, raftpb.SnapshotHeader, crc32), then
+// blocks of up to 2MiB each followed by their crc32, then a 16 byte tail (total size uint64, magic). Integers are
+// little endian. Once decompressed, the blocks hold dragonboat's client sessions, then raftd's snapshot (see
+// snapshot_header.go).
+const (
+	snapshotMetadataFile = "snapshot.metadata"
+
+	snapshotFileHeaderSize = 1024
+	snapshotFileBlockSize  = 2 * 1024 * 1024
+	snapshotFileTailSize   = 16
+	snapshotFileVersion    = 2
+	crc32Size              = 4
+)
+
+var snapshotFileMagic = []byte{0x3F, 0x5B, 0xCB, 0xF1, 0xFA, 0xBA, 0x81, 0x9F}
+
+type (
+	// blockReader reads the payload of a snapshot file, checking the crc32 of every block
+	blockReader struct {
+		r     io.Reader
+		block []byte
+		// buf is reused for every block
+		buf []byte
+	}
+
+	// snapshotPayloadReader is the application's snapshot in a snapshot file
+	snapshotPayloadReader struct {
+		io.Reader
+		file *os.File
+	}
+)
+
+// snapshotDirName is the name dragonboat gives the directory of the snapshot at index
+func snapshotDirName(index uint64) string {
+	return fmt.Sprintf("snapshot-%016X", index)
+}
+
+// readSnapshotMetadata reads the metadata file of a snapshot directory
+func readSnapshotMetadata(dir string) (raftpb.Snapshot, error) {
+	data, err := os.ReadFile(filepath.Join(dir, snapshotMetadataFile))
+	if err != nil {
+		return raftpb.Snapshot{}, fmt.Errorf("error in os.ReadFile: %w", err)
+	}
+	if len(data) < 8 {
+		return raftpb.Snapshot{}, fmt.Errorf("%w: metadata is %d bytes", ErrInvalidSnapshot, len(data))
+	}
+	hash := md5.Sum(data[8:])
+	if !bytes.Equal(data[:8], hash[8:]) {
+		return raftpb.Snapshot{}, fmt.Errorf("%w: metadata hash mismatch", ErrInvalidSnapshot)
+	}
+
+	var ss raftpb.Snapshot
+	if err := ss.Unmarshal(data[8:]); err != nil {
+		return raftpb.Snapshot{}, fmt.Errorf("%w: unmarshaling metadata: %w", ErrInvalidSnapshot, err)
+	}
+	return ss, nil
+}
+
+// openSnapshotPayload opens a snapshot file, returning a reader of the application's snapshot in it. The caller is
+// responsible for closing the reader.
+func openSnapshotPayload(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error in os.Open: %w", err)
+	}
+	r, err := readSnapshotFile(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &snapshotPayloadReader{Reader: r, file: f}, nil
+}
+
+func readSnapshotFile(f *os.File) (io.Reader, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("error in f.Stat: %w", err)
+	}
+	payloadSize := info.Size() - snapshotFileHeaderSize - snapshotFileTailSize
+	if payloadSize < 0 {
+		return nil, fmt.Errorf("%w: snapshot file is %d bytes", ErrInvalidSnapshot, info.Size())
+	}
+
+	tail := make([]byte, snapshotFileTailSize)
+	if _, err := f.ReadAt(tail, info.Size()-snapshotFileTailSize); err != nil {
+		return nil, fmt.Errorf("%w: reading tail: %w", ErrInvalidSnapshot, err)
+	}
+	if !bytes.Equal(tail[8:], snapshotFileMagic) {
+		return nil, fmt.Errorf("%w: bad magic number", ErrInvalidSnapshot)
+	}
+
+	headerBytes := make([]byte, snapshotFileHeaderSize)
+	if _, err := io.ReadFull(f, headerBytes); err != nil {
+		return nil, fmt.Errorf("%w: reading header: %w", ErrInvalidSnapshot, err)
+	}
+	headerSize := binary.LittleEndian.Uint64(headerBytes)
+	if headerSize > snapshotFileHeaderSize-8-crc32Size {
+		return nil, fmt.Errorf("%w: header is %d bytes", ErrInvalidSnapshot, headerSize)
+	}
+	var header raftpb.SnapshotHeader
+	if err := header.Unmarshal(headerBytes[8 : 8+headerSize]); err != nil {
+		return nil, fmt.Errorf("%w: unmarshaling header: %w", ErrInvalidSnapshot, err)
+	}
+	if header.Version != snapshotFileVersion {
+		return nil, fmt.Errorf("%w: unsupported snapshot file version %d", ErrInvalidSnapshot, header.Version)
+	}
+	if header.ChecksumType != raftpb.CRC32IEEE {
+		return nil, fmt.Errorf("%w: unsupported checksum type %d", ErrInvalidSnapshot, header.ChecksumType)
+	}
+
+	var r io.Reader = &blockReader{
+		r:   io.LimitReader(f, payloadSize),
+		buf: make([]byte, snapshotFileBlockSize+crc32Size),
+	}
+	switch header.CompressionType {
+	case raftpb.NoCompression:
+	case raftpb.Snappy:
+		r = snappy.NewReader(r)
+	default:
+		return nil, fmt.Errorf("%w: unsupported compression type %d", ErrInvalidSnapshot, header.CompressionType)
+	}
+
+	if err := skipDragonboatSessions(r); err != nil {
+		return nil, err
+	}
+	_, app, err := readSnapshotHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	return app, nil
+}
+
+// skipDragonboatSessions reads past dragonboat's client sessions, of which there are none since raftd only
+// proposes with no-op sessions
+func skipDragonboatSessions(r io.Reader) error {
+	header := make([]byte, 8+8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return fmt.Errorf("%w: reading dragonboat sessions: %w", ErrInvalidSnapshot, err)
+	}
+	if count := binary.LittleEndian.Uint64(header[8:]); count != 0 {
+		return fmt.Errorf("%w: snapshot has %d dragonboat sessions", ErrInvalidSnapshot, count)
+	}
+
+	return nil
+}
+
+func (br *blockReader) Read(p []byte) (int, error) {
+	if len(br.block) == 0 {
+		n, err := io.ReadFull(br.r, br.buf)
+		if err == io.EOF {
+			return 0, io.EOF
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return 0, fmt.Errorf("error reading snapshot block: %w", err)
+		}
+		if n <= crc32Size {
+			return 0, fmt.Errorf("%w: block is %d bytes", ErrInvalidSnapshot, n)
+		}
+		block, checksum := br.buf[:n-crc32Size], br.buf[n-crc32Size:n]
+		if crc32.ChecksumIEEE(block) != binary.BigEndian.Uint32(checksum) {
+			return 0, fmt.Errorf("%w: block checksum mismatch", ErrInvalidSnapshot)
+		}
+		br.block = block
+	}
+
+	n := copy(p, br.block)
+	br.block = br.block[n:]
+	return n, nil
+}
+
+func (r *snapshotPayloadReader) Close() error {
+	return r.file.Close()
+}
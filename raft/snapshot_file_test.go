@@ -0,0 +1,107 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// exportTestSnapshot takes an exported snapshot of a shard whose application snapshot spans several blocks of the
+// snapshot file
+func exportTestSnapshot(t *testing.T, compression string) (*RaftManager, *SnapshotExport, []string) {
+	t.Setenv("RAFT_SNAPSHOT_COMPRESSION", compression)
+	_, appURL := newTestApp(t)
+	rm := startTestReplica(t, t.TempDir(), appURL)
+	waitForShardState(t, rm, 0, ShardStateReady)
+	var commands []string
+	for _, c := range "abcde" {
+		cmd := strings.Repeat(string(c), snapshotFileBlockSize/2)
+		mustPropose(t, rm, 0, cmd)
+		commands = append(commands, cmd)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	export, err := rm.ExportSnapshot(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = export.Payload.Close() })
+	return rm, export, commands
+}
+
+// TestReadExportedSnapshotFile pins the parts of dragonboat's snapshot file format raftd reads to snapshots that
+// dragonboat exported
+func TestReadExportedSnapshotFile(t *testing.T) {
+	for _, compression := range []string{"none", "snappy"} {
+		t.Run(compression, func(t *testing.T) {
+			_, export, commands := exportTestSnapshot(t, compression)
+			if export.Index == 0 {
+				t.Fatal("exported snapshot has no index")
+			}
+
+			payload, err := io.ReadAll(export.Payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var snapshot struct {
+				Applied  uint64
+				Commands []string
+			}
+			if err := json.Unmarshal(payload, &snapshot); err != nil {
+				t.Fatalf("payload is not the application's snapshot: %v", err)
+			}
+			if !slices.Equal(snapshot.Commands, commands) {
+				t.Fatalf("snapshot has %d commands, want %d", len(snapshot.Commands), len(commands))
+			}
+			if snapshot.Applied > export.Index {
+				t.Fatalf("application applied %d in a snapshot at %d", snapshot.Applied, export.Index)
+			}
+		})
+	}
+}
+
+func TestReadCorruptSnapshotFile(t *testing.T) {
+	rm, _, _ := exportTestSnapshot(t, "none")
+	dir := t.TempDir()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	index, err := rm.CreateSnapshot(ctx, 0, SnapshotOptions{ExportPath: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := readSnapshotMetadata(ExportedSnapshotDir(dir, index))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ss.Index != index {
+		t.Fatalf("metadata has index %d, snapshot is at %d", ss.Index, index)
+	}
+
+	path := filepath.Join(ExportedSnapshotDir(dir, index), filepath.Base(ss.Filepath))
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flip a byte in the second block
+	data[snapshotFileHeaderSize+snapshotFileBlockSize+crc32Size+10] ^= 0xFF
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := openSnapshotPayload(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer payload.Close()
+	if _, err := io.ReadAll(payload); !errors.Is(err, ErrInvalidSnapshot) {
+		t.Fatalf("reading a corrupt snapshot returned %v, want %v", err, ErrInvalidSnapshot)
+	}
+}
@@ -0,0 +1,78 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Snapshots written by raftd start with a header holding raftd's own state of the shard, followed by the
+// application's snapshot. Snapshots without the header were written before it existed, and are entirely the
+// application's.
+//
+// Header: magic, version uint32, sessions length uint64, sessions (JSON session table). Integers are big endian.
+const (
+	snapshotMagic   = "\x00raftd-snapshot\x00"
+	snapshotVersion = 1
+
+	// maxSnapshotSessionsSize guards against allocating a corrupt length
+	maxSnapshotSessionsSize = 1 << 30
+)
+
+var (
+	ErrInvalidSnapshot = errors.New("invalid snapshot")
+)
+
+type (
+	// snapshotState is what PrepareSnapshot captures for SaveSnapshot
+	snapshotState struct {
+		app      any
+		sessions []byte
+	}
+)
+
+func writeSnapshotHeader(w io.Writer, sessions []byte) error {
+	header := make([]byte, len(snapshotMagic)+4+8, len(snapshotMagic)+4+8+len(sessions))
+	copy(header, snapshotMagic)
+	binary.BigEndian.PutUint32(header[len(snapshotMagic):], snapshotVersion)
+	binary.BigEndian.PutUint64(header[len(snapshotMagic)+4:], uint64(len(sessions)))
+	if _, err := w.Write(append(header, sessions...)); err != nil {
+		return fmt.Errorf("error writing snapshot header: %w", err)
+	}
+
+	return nil
+}
+
+// readSnapshotHeader reads the header of a snapshot, returning the sessions (nil if the snapshot has no header)
+// and a reader of the application's snapshot
+func readSnapshotHeader(r io.Reader) ([]byte, io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(snapshotMagic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, nil, fmt.Errorf("error reading snapshot header: %w", err)
+	}
+	if !bytes.Equal(magic, []byte(snapshotMagic)) {
+		return nil, br, nil
+	}
+
+	header := make([]byte, len(snapshotMagic)+4+8)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, nil, fmt.Errorf("%w: reading header: %w", ErrInvalidSnapshot, err)
+	}
+	if version := binary.BigEndian.Uint32(header[len(snapshotMagic):]); version != snapshotVersion {
+		return nil, nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidSnapshot, version)
+	}
+	size := binary.BigEndian.Uint64(header[len(snapshotMagic)+4:])
+	if size > maxSnapshotSessionsSize {
+		return nil, nil, fmt.Errorf("%w: sessions are %d bytes", ErrInvalidSnapshot, size)
+	}
+	sessions := make([]byte, size)
+	if _, err := io.ReadFull(br, sessions); err != nil {
+		return nil, nil, fmt.Errorf("%w: reading sessions: %w", ErrInvalidSnapshot, err)
+	}
+
+	return sessions, br, nil
+}
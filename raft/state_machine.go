@@ -1,7 +1,6 @@
 package raft
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -10,177 +9,209 @@ import (
 	"github.com/danthegoodman1/raftd/syncx"
 	"github.com/lni/dragonboat/v4/statemachine"
 	"github.com/rs/zerolog"
-	"github.com/samber/lo"
 	"io"
 	"net/http"
-	"time"
 )
 
 type (
 	OnDiskStateMachine struct {
-		APPUrl     string
+		backend    appBackend
+		timeouts   appTimeouts
 		shardID    uint64
 		replicaID  uint64
 		shouldSync bool
 		closed     bool
 		logger     zerolog.Logger
-		readyMap   *syncx.Map[uint64, bool]
+		readyMap   *syncx.Map[uint64, ShardState]
+		progress   *shardProgress
+		// snapshotIndex returns the index of the latest snapshot of this replica
+		snapshotIndex func() (uint64, error)
+		// ctx is canceled once the replica is closing, so calls waiting for the application stop
+		ctx    context.Context
+		cancel context.CancelFunc
+		// sessions is loaded in Open
+		sessions     *sessionTable
+		sessionsPath string
+	}
+
+	// eofReader keeps returning io.EOF once it was returned. Dragonboat's snapshot reader returns zeros if it is read
+	// again after io.EOF, which buffered readers and the HTTP client do.
+	eofReader struct {
+		r   io.Reader
+		eof bool
 	}
 )
 
-func createStateMachine(shardID, replicaID uint64, logger zerolog.Logger, readyMap *syncx.Map[uint64, bool]) statemachine.IOnDiskStateMachine {
+func createStateMachine(shardID, replicaID uint64, logger zerolog.Logger, backend appBackend, readyMap *syncx.Map[uint64, ShardState], progress *shardProgress, snapshotIndex func() (uint64, error), closing <-chan struct{}) statemachine.IOnDiskStateMachine {
 	childLogger := logger.With().Uint64("ShardID", shardID).Uint64("ReplicaID", replicaID).Str("Service", "RaftStateMachine").Logger()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelOnStop(ctx, cancel, closing)
 	return &OnDiskStateMachine{
-		shardID:    shardID,
-		replicaID:  replicaID,
-		APPUrl:     env.ApplicationURL,
-		shouldSync: env.RaftSync,
-		logger:     childLogger,
-		readyMap:   readyMap,
+		backend:       backend,
+		timeouts:      appTimeoutsFromEnv(),
+		shardID:       shardID,
+		replicaID:     replicaID,
+		shouldSync:    env.Current.RaftSync,
+		logger:        childLogger,
+		readyMap:      readyMap,
+		progress:      progress,
+		snapshotIndex: snapshotIndex,
+		ctx:           ctx,
+		cancel:        cancel,
+		sessionsPath:  sessionTablePath(shardID),
 	}
 }
 
-var (
-	ErrHighStatusCode = errors.New("high status code")
-)
-
-const (
-	timeout          = time.Second // todo make customizable
-	snapshotTimeout  = time.Minute // todo make customizable
-	jsonContentType  = "application/json"
-	bytesContentType = "application/octet-stream"
-)
-
-func genHighStatusCodeError(statusCode int, body io.Reader) error {
-	allBytes, err := io.ReadAll(body)
-	if err != nil {
-		return fmt.Errorf("error in io.ReadAll: %w", err)
+// replica identifies this replica to the application. While the application is down, calls that wait for it pause
+// the shard.
+func (o *OnDiskStateMachine) replica() appReplica {
+	return appReplica{
+		shardID:   o.shardID,
+		replicaID: o.replicaID,
+		onPause: func(callback appCallback) {
+			o.logger.Warn().Str("Callback", string(callback)).Msg("application is unavailable, pausing shard")
+			if !o.readyMap.CompareAndSwap(o.shardID, ShardStateReady, ShardStatePaused) {
+				o.readyMap.CompareAndSwap(o.shardID, ShardStateCatchingUp, ShardStatePaused)
+			}
+		},
+		onResume: func(callback appCallback) {
+			o.logger.Info().Str("Callback", string(callback)).Msg("application is available, resuming shard")
+			o.readyMap.CompareAndSwap(o.shardID, ShardStatePaused, ShardStateCatchingUp)
+		},
 	}
-
-	return fmt.Errorf("%w (%d): %s", ErrHighStatusCode, statusCode, string(allBytes)[:100])
 }
 
-func doReqWithContext[T any](ctx context.Context, shardID, replicaID uint64, url string, contentType string, body io.Reader) (T, error) {
-	// todo add some light backoff retry
-	var defaultResponse T
-
-	req, err := http.NewRequestWithContext(ctx, "POST", url, body)
-	if err != nil {
-		return defaultResponse, fmt.Errorf("error in NewRequestWithContext: %w", err)
-	}
-	req.Header.Set("raftd-node-id", fmt.Sprint(shardID))
-	req.Header.Set("raftd-replica-id", fmt.Sprint(replicaID))
-	if contentType != "" {
-		req.Header.Set("content-type", contentType)
-	}
+func (o *OnDiskStateMachine) Open(stopc <-chan struct{}) (uint64, error) {
+	o.logger.Debug().Msg("calling open")
+	ctx, cancel := context.WithCancel(o.ctx)
+	defer cancel()
+	cancelOnStop(ctx, cancel, stopc)
 
-	res, err := http.DefaultClient.Do(req)
+	sessions, err := loadSessionTable(o.sessionsPath)
 	if err != nil {
-		return defaultResponse, fmt.Errorf("error in http.Do: %w", err)
-	}
-	defer res.Body.Close()
-
-	if res.StatusCode > 299 {
-		return defaultResponse, genHighStatusCodeError(res.StatusCode, res.Body)
+		o.readyMap.Store(o.shardID, ShardStateFailed)
+		return 0, err
 	}
 
-	var resBody T
-	resBytes, err := io.ReadAll(res.Body)
+	lastLogIndex, err := o.backend.LastLogIndex(ctx, o.replica())
 	if err != nil {
-		return defaultResponse, fmt.Errorf("error in io.ReadAll: %w", err)
+		o.readyMap.Store(o.shardID, ShardStateFailed)
+		return 0, fmt.Errorf("error in backend.LastLogIndex: %w", err)
 	}
 
-	err = json.Unmarshal(resBytes, &resBody)
-	if err != nil {
-		return defaultResponse, fmt.Errorf("error in json.Unmarshal: %w", err)
+	// Pending proposals the application applied before the replica stopped are not replayed, so their results are
+	// gone
+	if sessions.resolvePending(lastLogIndex) {
+		if err := sessions.save(o.sessionsPath); err != nil {
+			o.readyMap.Store(o.shardID, ShardStateFailed)
+			return 0, err
+		}
 	}
+	o.sessions = sessions
 
-	return resBody, nil
+	o.progress.setApplied(lastLogIndex)
+	o.readyMap.Store(o.shardID, ShardStateCatchingUp)
+	return lastLogIndex, nil
 }
 
-func (o *OnDiskStateMachine) Open(stopc <-chan struct{}) (uint64, error) {
-	o.logger.Debug().Msg("calling open")
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-
-	// Create a goroutine to cancel the context if stopc is triggered
-	go func() {
-		select {
-		case <-stopc:
-			cancel()
-		case <-ctx.Done():
-			return
+func (o *OnDiskStateMachine) Update(entries []statemachine.Entry) ([]statemachine.Entry, error) {
+	o.logger.Debug().Msg("calling update")
+	forward, duplicates, sessionsChanged := o.sessions.applyUpdate(entries)
+	if sessionsChanged {
+		// Saved before the application sees the batch, so a crash can not lose track of session proposals it applied
+		if err := o.sessions.save(o.sessionsPath); err != nil {
+			return entries, err
 		}
-	}()
+	}
 
-	res, err := doReqWithContext[struct {
-		LastLogIndex uint64
-	}](ctx, o.shardID, o.replicaID, o.APPUrl+"/LastLogIndex", "", nil)
-	if err != nil {
-		return 0, fmt.Errorf("error in NewRequestWithContext: %w", err)
+	// Session operations and duplicate proposals are handled by raftd, the rest go to the application without
+	// their session envelope
+	appEntries := make([]statemachine.Entry, len(forward))
+	for i, entryIndex := range forward {
+		appEntries[i] = entries[entryIndex]
+		if sessionEntry, isSession := decodeSessionEntry(appEntries[i].Cmd); isSession {
+			appEntries[i].Cmd = sessionEntry.cmd
+		}
 	}
 
-	return res.LastLogIndex, nil
-}
+	if len(appEntries) > 0 {
+		// If the application is down when the replica closes, the batch fails, which stops the process rather than
+		// waiting for the application forever. The entries are sent again on restart.
+		results, err := o.backend.UpdateEntries(o.ctx, o.replica(), appEntries)
+		if err != nil {
+			return entries, fmt.Errorf("error in backend.UpdateEntries: %w", err)
+		}
 
-type (
-	updateEntry struct {
-		Index uint64
-		Cmd   []byte
-	}
-	updateResponse struct {
-		Results []statemachine.Result
-	}
-)
+		if err := validateEntryResults(appEntries, results); err != nil {
+			// The entries were applied, so the batch can not be retried. Every proposer gets the error instead.
+			o.logger.Error().Err(err).Uint64("FirstIndex", appEntries[0].Index).Uint64("LastIndex", appEntries[len(appEntries)-1].Index).Msg("application broke the /UpdateEntries protocol, failing the results of the batch")
+			results = make([]EntryResult, len(appEntries))
+			for i := range results {
+				results[i] = EntryResult{
+					Status: http.StatusInternalServerError,
+					Error:  fmt.Sprintf("application protocol error: %s", err),
+				}
+			}
+		}
 
-func (o *OnDiskStateMachine) Update(entries []statemachine.Entry) ([]statemachine.Entry, error) {
-	o.logger.Debug().Msg("calling update")
-	jsonBytes, err := json.Marshal(map[string]any{
-		"Entries": lo.Map(entries, func(entry statemachine.Entry, index int) updateEntry {
-			return updateEntry{
-				Index: entry.Index,
-				Cmd:   entry.Cmd,
+		for i, entryIndex := range forward {
+			var result EntryResult
+			if len(results) > 0 {
+				result = results[i]
 			}
-		}),
-	})
-	if err != nil {
-		return entries, fmt.Errorf("error in json.Marshal: %w", err)
+			entries[entryIndex].Result = encodeEntryResult(result)
+		}
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-
-	res, err := doReqWithContext[updateResponse](ctx, o.shardID, o.replicaID, o.APPUrl+"/UpdateEntries", jsonContentType, bytes.NewReader(jsonBytes))
-	if err != nil {
-		return entries, fmt.Errorf("error in NewRequestWithContext: %w", err)
+	if o.sessions.finishUpdate(entries, forward, duplicates) {
+		// Saved again with the results of the session proposals, for retries of them
+		if err := o.sessions.save(o.sessionsPath); err != nil {
+			return entries, err
+		}
 	}
 
-	// If we have a body with the same length, we will use that those responses
-	if len(res.Results) == len(entries) {
-		for i := range res.Results {
-			entries[i].Result = res.Results[i]
-		}
+	if len(entries) > 0 {
+		o.progress.setApplied(entries[len(entries)-1].Index)
 	}
 
 	return entries, nil
 }
 
+type (
+	// ReadQuery is relayed byte-for-byte to the application's /Read endpoint
+	ReadQuery struct {
+		ContentType string
+		Body        []byte
+	}
+	// ReadResult is the exact response of the application's /Read endpoint
+	ReadResult struct {
+		ContentType string
+		Body        []byte
+	}
+)
+
+var ErrInvalidQuery = errors.New("invalid query")
+
 func (o *OnDiskStateMachine) Lookup(i interface{}) (interface{}, error) {
 	o.logger.Debug().Msg("calling lookup")
-	jsonBytes, err := json.Marshal(i)
-	if err != nil {
-		return nil, fmt.Errorf("error in json.Marshal: %w", err)
+	query, ok := i.(ReadQuery)
+	if !ok {
+		return nil, fmt.Errorf("%w: expected ReadQuery, got %T", ErrInvalidQuery, i)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
+	if query.ContentType == "" && len(query.Body) > 0 {
+		query.ContentType = bytesContentType
+	}
 
-	res, err := doReqWithContext[any](ctx, o.shardID, o.replicaID, o.APPUrl+"/Read", jsonContentType, bytes.NewReader(jsonBytes))
+	// Reads fail rather than pause while the application is down
+	replica := o.replica()
+	replica.onPause, replica.onResume = nil, nil
+	result, err := o.backend.Read(o.ctx, replica, query)
 	if err != nil {
-		return 0, fmt.Errorf("error in NewRequestWithContext: %w", err)
+		return nil, fmt.Errorf("error in backend.Read: %w", err)
 	}
 
-	return res, nil
+	return result, nil
 }
 
 func (o *OnDiskStateMachine) Sync() error {
@@ -192,12 +223,8 @@ func (o *OnDiskStateMachine) Sync() error {
 		return nil
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-
-	_, err := doReqWithContext[any](ctx, o.shardID, o.replicaID, o.APPUrl+"/Sync", "", nil)
-	if err != nil {
-		return fmt.Errorf("error in NewRequestWithContext: %w", err)
+	if err := o.backend.Sync(o.ctx, o.replica()); err != nil {
+		return fmt.Errorf("error in backend.Sync: %w", err)
 	}
 
 	return nil
@@ -205,71 +232,94 @@ func (o *OnDiskStateMachine) Sync() error {
 
 func (o *OnDiskStateMachine) PrepareSnapshot() (interface{}, error) {
 	o.logger.Info().Msg("calling PrepareSnapshot")
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
+	state, err := o.backend.PrepareSnapshot(o.ctx, o.replica())
+	if err != nil {
+		return 0, fmt.Errorf("error in backend.PrepareSnapshot: %w", err)
+	}
 
-	res, err := doReqWithContext[any](ctx, o.shardID, o.replicaID, o.APPUrl+"/PrepareSnapshot", "", nil)
+	// The sessions are captured now, since updates continue while the snapshot is saved
+	sessions, err := json.Marshal(o.sessions)
 	if err != nil {
-		return 0, fmt.Errorf("error in NewRequestWithContext: %w", err)
+		return 0, fmt.Errorf("error marshaling session table: %w", err)
 	}
 
-	return res, nil
+	return snapshotState{app: state, sessions: sessions}, nil
 }
 
-func (o *OnDiskStateMachine) SaveSnapshot(i interface{}, writer io.Writer, i2 <-chan struct{}) error {
+func (o *OnDiskStateMachine) SaveSnapshot(i interface{}, writer io.Writer, stopc <-chan struct{}) error {
 	o.logger.Info().Msg("calling SaveSnapshot")
-	jsonBytes, err := json.Marshal(i)
-	if err != nil {
-		return fmt.Errorf("error in json.Marshal: %w", err)
+	state, ok := i.(snapshotState)
+	if !ok {
+		return fmt.Errorf("%w: expected snapshotState, got %T", ErrInvalidSnapshot, i)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), snapshotTimeout)
+	ctx, touch, cancel := withIdleTimeout(o.ctx, o.timeouts.SaveSnapshotIdle)
 	defer cancel()
+	cancelOnStop(ctx, cancel, stopc)
 
-	req, err := http.NewRequestWithContext(ctx, "POST", o.APPUrl+"/Snapshot", bytes.NewReader(jsonBytes))
-	if err != nil {
-		return fmt.Errorf("error in NewRequestWithContext: %w", err)
+	if err := writeSnapshotHeader(writer, state.sessions); err != nil {
+		return err
 	}
-	req.Header.Set("content-type", jsonContentType)
-
-	res, err := http.DefaultClient.Do(req)
+	err := o.backend.SaveSnapshot(ctx, o.replica(), state.app, &idleWriter{w: writer, touch: touch})
 	if err != nil {
-		return fmt.Errorf("error in http.Do: %w", err)
+		return fmt.Errorf("error in backend.SaveSnapshot: %w", timeoutCause(ctx, err))
 	}
-	defer res.Body.Close()
 
-	if res.StatusCode > 299 {
-		return genHighStatusCodeError(res.StatusCode, res.Body)
-	}
+	return nil
+}
 
-	_, err = io.Copy(writer, res.Body)
+func (o *OnDiskStateMachine) RecoverFromSnapshot(reader io.Reader, stopc <-chan struct{}) error {
+	o.logger.Info().Msg("calling RecoverFromSnapshot")
+	o.readyMap.Store(o.shardID, ShardStateRecovering)
+	err := o.recoverFromSnapshot(reader, stopc)
 	if err != nil {
-		return fmt.Errorf("error in io.Copy: %w", err)
+		o.readyMap.Store(o.shardID, ShardStateFailed)
+		return err
 	}
 
+	o.readyMap.Store(o.shardID, ShardStateCatchingUp)
 	return nil
 }
 
-func (o *OnDiskStateMachine) RecoverFromSnapshot(reader io.Reader, i <-chan struct{}) error {
-	o.logger.Info().Msg("calling RecoverFromSnapshot")
-	ctx, cancel := context.WithTimeout(context.Background(), snapshotTimeout)
+func (o *OnDiskStateMachine) recoverFromSnapshot(reader io.Reader, stopc <-chan struct{}) error {
+	// The idle timer also covers the time the application takes to respond after reading the whole snapshot
+	ctx, touch, cancel := withIdleTimeout(o.ctx, o.timeouts.RecoverSnapshotIdle)
 	defer cancel()
+	cancelOnStop(ctx, cancel, stopc)
 
-	req, err := http.NewRequestWithContext(ctx, "POST", o.APPUrl+"/RecoverFromSnapshot", reader)
+	sessionsData, appReader, err := readSnapshotHeader(&idleReader{r: &eofReader{r: reader}, touch: touch})
 	if err != nil {
-		return fmt.Errorf("error in NewRequestWithContext: %w", err)
+		return err
+	}
+	sessions := newSessionTable()
+	if sessionsData != nil {
+		if sessions, err = unmarshalSessionTable(sessionsData); err != nil {
+			return err
+		}
 	}
-	req.Header.Set("content-type", bytesContentType)
 
-	res, err := http.DefaultClient.Do(req)
+	err = o.backend.RecoverFromSnapshot(ctx, o.replica(), appReader)
 	if err != nil {
-		return fmt.Errorf("error in http.Do: %w", err)
+		return fmt.Errorf("error in backend.RecoverFromSnapshot: %w", timeoutCause(ctx, err))
+	}
+
+	// The table is replaced once the application has the matching state
+	if err := sessions.save(o.sessionsPath); err != nil {
+		return err
 	}
-	defer res.Body.Close()
+	o.sessions = sessions
 
-	if res.StatusCode > 299 {
-		return genHighStatusCodeError(res.StatusCode, res.Body)
+	// The application now has the state of the snapshot, which may be behind what was applied before. The snapshot
+	// can end in entries the application never sees, so it is applied up to the snapshot index.
+	lastLogIndex, err := o.backend.LastLogIndex(ctx, o.replica())
+	if err != nil {
+		return fmt.Errorf("error in backend.LastLogIndex: %w", err)
+	}
+	snapshotIndex, err := o.snapshotIndex()
+	if err != nil {
+		return fmt.Errorf("error in snapshotIndex: %w", err)
 	}
+	o.progress.setApplied(max(lastLogIndex, snapshotIndex))
 
 	return nil
 }
@@ -278,7 +328,18 @@ func (o *OnDiskStateMachine) Close() error {
 	// We do nothing here, since we want to force the application to be resilient to crashes
 	o.logger.Info().Msg("calling Close")
 	o.closed = true
-	// TODO for each shard, make not ready
-	o.readyMap.Store(0, false)
+	o.cancel()
+	o.readyMap.Store(o.shardID, ShardStateClosed)
 	return nil
 }
+
+func (r *eofReader) Read(p []byte) (int, error) {
+	if r.eof {
+		return 0, io.EOF
+	}
+	n, err := r.r.Read(p)
+	if errors.Is(err, io.EOF) {
+		r.eof = true
+	}
+	return n, err
+}
@@ -0,0 +1,53 @@
+package raft
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/danthegoodman1/raftd/syncx"
+	"github.com/lni/dragonboat/v4/statemachine"
+	"github.com/rs/zerolog"
+)
+
+func TestUpdateStopsWaitingWhenClosing(t *testing.T) {
+	// The application is down, and /UpdateEntries is retried forever by default
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(srv.Close)
+	t.Setenv("APP_BREAKER_FAILURE_THRESHOLD", "0")
+	t.Setenv("APP_UPDATE_MAX_RETRIES", "-1")
+	setTestEnv(t, t.TempDir(), 1, "127.0.0.1:1", "1=127.0.0.1:1", srv.URL)
+	backend, err := newAppBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readyMap := syncx.NewMap[uint64, ShardState]()
+	closing := make(chan struct{})
+	sm := createStateMachine(0, 1, zerolog.Nop(), backend, &readyMap, &shardProgress{}, func() (uint64, error) { return 0, nil }, closing).(*OnDiskStateMachine)
+	sm.sessions = newSessionTable()
+
+	errC := make(chan error, 1)
+	go func() {
+		_, err := sm.Update([]statemachine.Entry{{Index: 1, Cmd: []byte("a")}})
+		errC <- err
+	}()
+	select {
+	case err := <-errC:
+		t.Fatalf("update returned %v while the application is down", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(closing)
+	select {
+	case err := <-errC:
+		if err == nil {
+			t.Fatal("update succeeded while the application is down")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("update kept waiting for the application after the replica started closing")
+	}
+}
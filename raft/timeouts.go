@@ -0,0 +1,113 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/danthegoodman1/raftd/env"
+)
+
+type (
+	// appTimeouts are the timeouts for each application callback, 0 disables a timeout
+	appTimeouts struct {
+		Open            time.Duration
+		Update          time.Duration
+		Read            time.Duration
+		Sync            time.Duration
+		PrepareSnapshot time.Duration
+		// SaveSnapshot and RecoverFromSnapshot are idle timeouts, since snapshots can take arbitrarily long to stream
+		SaveSnapshotIdle    time.Duration
+		RecoverSnapshotIdle time.Duration
+	}
+
+	// idleReader resets its idle timer whenever bytes are read
+	idleReader struct {
+		r     io.Reader
+		touch func()
+	}
+
+	// idleWriter resets its idle timer whenever bytes are written
+	idleWriter struct {
+		w     io.Writer
+		touch func()
+	}
+)
+
+var ErrIdleTimeout = errors.New("no bytes transferred within the idle timeout")
+
+func appTimeoutsFromEnv() appTimeouts {
+	return appTimeouts{
+		Open:                time.Duration(env.Current.AppOpenTimeoutMs) * time.Millisecond,
+		Update:              time.Duration(env.Current.AppUpdateTimeoutMs) * time.Millisecond,
+		Read:                time.Duration(env.Current.AppReadTimeoutMs) * time.Millisecond,
+		Sync:                time.Duration(env.Current.AppSyncTimeoutMs) * time.Millisecond,
+		PrepareSnapshot:     time.Duration(env.Current.AppPrepareSnapshotTimeoutMs) * time.Millisecond,
+		SaveSnapshotIdle:    time.Duration(env.Current.AppSaveSnapshotIdleTimeoutSec) * time.Second,
+		RecoverSnapshotIdle: time.Duration(env.Current.AppRecoverSnapshotIdleTimeoutSec) * time.Second,
+	}
+}
+
+// withTimeout is context.WithTimeout, where a timeout of 0 means no timeout
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// withIdleTimeout returns a context that is canceled with ErrIdleTimeout if touch is not called within timeout.
+// A timeout of 0 means no timeout.
+func withIdleTimeout(ctx context.Context, timeout time.Duration) (context.Context, func(), context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	if timeout <= 0 {
+		return ctx, func() {}, func() { cancel(context.Canceled) }
+	}
+
+	timer := time.AfterFunc(timeout, func() {
+		cancel(ErrIdleTimeout)
+	})
+	touch := func() {
+		timer.Reset(timeout)
+	}
+	return ctx, touch, func() {
+		timer.Stop()
+		cancel(context.Canceled)
+	}
+}
+
+// cancelOnStop cancels the context when dragonboat closes stopc
+func cancelOnStop(ctx context.Context, cancel context.CancelFunc, stopc <-chan struct{}) {
+	go func() {
+		select {
+		case <-stopc:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+}
+
+// timeoutCause returns the idle timeout error instead of a generic context error if the idle timeout fired
+func timeoutCause(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); errors.Is(cause, ErrIdleTimeout) {
+		return cause
+	}
+	return err
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.touch()
+	}
+	return n, err
+}
+
+func (w *idleWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if n > 0 {
+		w.touch()
+	}
+	return n, err
+}
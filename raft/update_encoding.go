@@ -0,0 +1,160 @@
+package raft
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/lni/dragonboat/v4/statemachine"
+)
+
+// The binary framing of /UpdateEntries. All integers are big endian.
+//
+// Request:  count uint32, then count times: index uint64, cmd length uint32, cmd
+// Response: count uint32, then count times: value uint64, status uint16, data length uint32, error length uint32,
+// data, error
+const (
+	// binaryContentType is used for both the request and response. The response is decoded according to its own
+	// content-type, so an application can keep responding with JSON.
+	binaryContentType = "application/x-raftd-binary"
+
+	// UpdateEncodingJSON encodes /UpdateEntries as JSON, with base64 commands
+	UpdateEncodingJSON = "json"
+	// UpdateEncodingBinary encodes /UpdateEntries with length prefixed binary framing
+	UpdateEncodingBinary = "binary"
+
+	frameCountSize        = 4
+	frameHeaderSize       = 8 + 4
+	frameResultHeaderSize = 8 + 2 + 4 + 4
+)
+
+var (
+	ErrInvalidFrame = errors.New("invalid binary frame")
+)
+
+// entriesReader encodes entries as it is read, so the batch is never copied into a buffer
+type entriesReader struct {
+	entries []statemachine.Entry
+	// pending are the bytes of the current frame header that have not been read yet
+	pending []byte
+	// cmd is the rest of the current entry's cmd
+	cmd       []byte
+	header    [frameHeaderSize]byte
+	remaining int
+}
+
+func newEntriesReader(entries []statemachine.Entry) *entriesReader {
+	r := &entriesReader{
+		entries:   entries,
+		remaining: frameCountSize,
+	}
+	for _, entry := range entries {
+		r.remaining += frameHeaderSize + len(entry.Cmd)
+	}
+	binary.BigEndian.PutUint32(r.header[:frameCountSize], uint32(len(entries)))
+	r.pending = r.header[:frameCountSize]
+	return r
+}
+
+// Len is the number of bytes left to read
+func (r *entriesReader) Len() int {
+	return r.remaining
+}
+
+func (r *entriesReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		switch {
+		case len(r.pending) > 0:
+			copied := copy(p[n:], r.pending)
+			r.pending = r.pending[copied:]
+			n += copied
+		case len(r.cmd) > 0:
+			copied := copy(p[n:], r.cmd)
+			r.cmd = r.cmd[copied:]
+			n += copied
+		case len(r.entries) > 0:
+			entry := r.entries[0]
+			r.entries = r.entries[1:]
+			binary.BigEndian.PutUint64(r.header[:8], entry.Index)
+			binary.BigEndian.PutUint32(r.header[8:], uint32(len(entry.Cmd)))
+			r.pending = r.header[:]
+			r.cmd = entry.Cmd
+		default:
+			r.remaining -= n
+			if n == 0 {
+				return 0, io.EOF
+			}
+			return n, nil
+		}
+	}
+
+	r.remaining -= n
+	return n, nil
+}
+
+// validateFrameEntries checks that every cmd fits in the length prefix
+func validateFrameEntries(entries []statemachine.Entry) error {
+	if uint64(len(entries)) > math.MaxUint32 {
+		return fmt.Errorf("%w: %d entries is too many", ErrInvalidFrame, len(entries))
+	}
+	for _, entry := range entries {
+		if uint64(len(entry.Cmd)) > math.MaxUint32 {
+			return fmt.Errorf("%w: cmd of entry %d is too large", ErrInvalidFrame, entry.Index)
+		}
+	}
+
+	return nil
+}
+
+// decodeResults reads the binary framed results of /UpdateEntries
+func decodeResults(r io.Reader) ([]EntryResult, error) {
+	var header [frameResultHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:frameCountSize]); err != nil {
+		return nil, fmt.Errorf("%w: reading result count: %w", ErrInvalidFrame, err)
+	}
+	count := binary.BigEndian.Uint32(header[:frameCountSize])
+
+	// The count is not trusted for preallocation, since a corrupt one could be huge
+	var results []EntryResult
+	for i := uint32(0); i < count; i++ {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, fmt.Errorf("%w: reading result %d: %w", ErrInvalidFrame, i, err)
+		}
+		result := EntryResult{
+			Value:  binary.BigEndian.Uint64(header[:8]),
+			Status: int(binary.BigEndian.Uint16(header[8:10])),
+		}
+		data, err := readFrameBytes(r, binary.BigEndian.Uint32(header[10:14]))
+		if err != nil {
+			return nil, fmt.Errorf("%w: reading result %d data: %w", ErrInvalidFrame, i, err)
+		}
+		result.Data = data
+		errorMessage, err := readFrameBytes(r, binary.BigEndian.Uint32(header[14:]))
+		if err != nil {
+			return nil, fmt.Errorf("%w: reading result %d error: %w", ErrInvalidFrame, i, err)
+		}
+		result.Error = string(errorMessage)
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// readFrameBytes reads a length prefixed field, nil if it is empty
+func readFrameBytes(r io.Reader, size uint32) ([]byte, error) {
+	if size == 0 {
+		return nil, nil
+	}
+	data, err := io.ReadAll(io.LimitReader(r, int64(size)))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != int(size) {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	return data, nil
+}
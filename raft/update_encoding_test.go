@@ -0,0 +1,280 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"testing/iotest"
+
+	"github.com/danthegoodman1/raftd/syncx"
+	"github.com/lni/dragonboat/v4/statemachine"
+	"github.com/rs/zerolog"
+	"github.com/samber/lo"
+)
+
+// decodeEntries reads a binary framed /UpdateEntries request like an application would
+func decodeEntries(r io.Reader) ([]updateEntry, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:frameCountSize]); err != nil {
+		return nil, err
+	}
+	count := binary.BigEndian.Uint32(header[:frameCountSize])
+	entries := make([]updateEntry, 0, count)
+	for i := uint32(0); i < count; i++ {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, err
+		}
+		cmd, err := readFrameBytes(r, binary.BigEndian.Uint32(header[8:]))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, updateEntry{Index: binary.BigEndian.Uint64(header[:8]), Cmd: cmd})
+	}
+	if n, _ := r.Read(make([]byte, 1)); n != 0 {
+		return nil, errors.New("trailing bytes after the last entry")
+	}
+
+	return entries, nil
+}
+
+// encodeResults writes binary framed /UpdateEntries results like an application would
+func encodeResults(results []EntryResult) []byte {
+	buf := binary.BigEndian.AppendUint32(nil, uint32(len(results)))
+	for _, result := range results {
+		buf = binary.BigEndian.AppendUint64(buf, result.Value)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(result.Status))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(result.Data)))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(result.Error)))
+		buf = append(buf, result.Data...)
+		buf = append(buf, result.Error...)
+	}
+
+	return buf
+}
+
+func TestEntriesReaderRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		entries []statemachine.Entry
+	}{
+		{name: "no entries"},
+		{name: "empty cmd", entries: []statemachine.Entry{{Index: 1}}},
+		{name: "batch", entries: []statemachine.Entry{
+			{Index: 7, Cmd: []byte("a")},
+			{Index: 8},
+			{Index: 9, Cmd: bytes.Repeat([]byte("b"), 100_000)},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			want := lo.Map(tc.entries, func(entry statemachine.Entry, _ int) updateEntry {
+				return updateEntry{Index: entry.Index, Cmd: lo.Ternary(len(entry.Cmd) == 0, nil, entry.Cmd)}
+			})
+
+			// Reading a byte at a time splits every header and cmd
+			for name, reader := range map[string]func(*entriesReader) io.Reader{
+				"whole":        func(r *entriesReader) io.Reader { return r },
+				"byte by byte": func(r *entriesReader) io.Reader { return iotest.OneByteReader(r) },
+			} {
+				r := newEntriesReader(tc.entries)
+				size := r.Len()
+				encoded, err := io.ReadAll(reader(r))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(encoded) != size {
+					t.Fatalf("%s: read %d bytes, Len was %d", name, len(encoded), size)
+				}
+				if r.Len() != 0 {
+					t.Fatalf("%s: Len is %d after reading everything", name, r.Len())
+				}
+				got, err := decodeEntries(bytes.NewReader(encoded))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("%s: decoded %v, want %v", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeResultsRoundTrip(t *testing.T) {
+	results := []EntryResult{
+		{Value: 1},
+		{Value: 2, Status: 409, Data: []byte("conflict"), Error: "already exists"},
+		{Value: 1 << 63, Data: bytes.Repeat([]byte{0}, 100_000)},
+	}
+	got, err := decodeResults(iotest.HalfReader(bytes.NewReader(encodeResults(results))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, results) {
+		t.Fatalf("decoded %v, want %v", got, results)
+	}
+
+	got, err = decodeResults(bytes.NewReader(encodeResults(nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("decoded %v from an empty batch", got)
+	}
+}
+
+func TestDecodeResultsMalformed(t *testing.T) {
+	valid := encodeResults([]EntryResult{{Value: 1, Status: 200, Data: []byte("data"), Error: "error"}})
+	for _, tc := range []struct {
+		name  string
+		frame []byte
+	}{
+		{name: "empty", frame: nil},
+		{name: "truncated count", frame: valid[:frameCountSize-1]},
+		{name: "missing result", frame: valid[:frameCountSize]},
+		{name: "truncated result header", frame: valid[:frameCountSize+frameResultHeaderSize-1]},
+		{name: "truncated data", frame: valid[:frameCountSize+frameResultHeaderSize+2]},
+		{name: "truncated error", frame: valid[:len(valid)-1]},
+		{name: "count larger than results", frame: append(binary.BigEndian.AppendUint32(nil, 2), valid[frameCountSize:]...)},
+		{name: "huge count", frame: binary.BigEndian.AppendUint32(nil, 1<<32-1)},
+		{name: "huge data length", frame: append(binary.BigEndian.AppendUint32(nil, 1),
+			binary.BigEndian.AppendUint32(make([]byte, 10), 1<<32-1)...)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			results, err := decodeResults(bytes.NewReader(tc.frame))
+			if !errors.Is(err, ErrInvalidFrame) {
+				t.Fatalf("got results %v and error %v, want %v", results, err, ErrInvalidFrame)
+			}
+		})
+	}
+}
+
+// BenchmarkUpdateEncoding measures the per entry overhead of encoding an /UpdateEntries request and decoding its
+// results, with each encoding
+func BenchmarkUpdateEncoding(b *testing.B) {
+	for _, encoding := range []string{UpdateEncodingJSON, UpdateEncodingBinary} {
+		for _, batchSize := range []int{1, 100, 10_000} {
+			entries := make([]statemachine.Entry, batchSize)
+			results := make([]EntryResult, batchSize)
+			for i := range entries {
+				entries[i] = statemachine.Entry{Index: uint64(i + 1), Cmd: []byte(fmt.Sprintf(`{"key":"key-%d","value":"value"}`, i))}
+				results[i] = EntryResult{Value: uint64(i + 1)}
+			}
+
+			b.Run(fmt.Sprintf("%s/%d", encoding, batchSize), func(b *testing.B) {
+				encode, decode := benchmarkBinaryEncoding(entries, results)
+				if encoding == UpdateEncodingJSON {
+					encode, decode = benchmarkJSONEncoding(entries, results)
+				}
+				b.ReportAllocs()
+				b.ResetTimer()
+				var size int64
+				for i := 0; i < b.N; i++ {
+					n, err := encode()
+					if err != nil {
+						b.Fatal(err)
+					}
+					size = n
+					if err := decode(); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*batchSize), "ns/entry")
+				b.ReportMetric(float64(size)/float64(batchSize), "request-B/entry")
+			})
+		}
+	}
+}
+
+func benchmarkJSONEncoding(entries []statemachine.Entry, results []EntryResult) (func() (int64, error), func() error) {
+	resBytes, _ := json.Marshal(updateResponse{Results: results})
+	encode := func() (int64, error) {
+		jsonBytes, err := json.Marshal(map[string]any{
+			"Entries": lo.Map(entries, func(entry statemachine.Entry, index int) updateEntry {
+				return updateEntry{
+					Index: entry.Index,
+					Cmd:   entry.Cmd,
+				}
+			}),
+		})
+		return int64(len(jsonBytes)), err
+	}
+	decode := func() error {
+		var resBody updateResponse
+		return json.Unmarshal(resBytes, &resBody)
+	}
+
+	return encode, decode
+}
+
+func benchmarkBinaryEncoding(entries []statemachine.Entry, results []EntryResult) (func() (int64, error), func() error) {
+	resBytes := encodeResults(results)
+	encode := func() (int64, error) {
+		return io.Copy(io.Discard, newEntriesReader(entries))
+	}
+	decode := func() error {
+		_, err := decodeResults(bytes.NewReader(resBytes))
+		return err
+	}
+
+	return encode, decode
+}
+
+func TestUpdateEncodingMismatch(t *testing.T) {
+	for _, tc := range []struct {
+		name            string
+		updateEncodings []string
+		wantErr         error
+	}{
+		{name: "json only", wantErr: ErrUnsupportedUpdateEncoding},
+		{name: "other encoding", updateEncodings: []string{"protobuf"}, wantErr: ErrUnsupportedUpdateEncoding},
+		{name: "binary", updateEncodings: []string{"binary"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var contentType string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/LastLogIndex":
+					_ = json.NewEncoder(w).Encode(map[string]any{"LastLogIndex": 0, "UpdateEncodings": tc.updateEncodings})
+				case "/UpdateEntries":
+					contentType = r.Header.Get("content-type")
+					_ = json.NewEncoder(w).Encode(updateResponse{})
+				}
+			}))
+			t.Cleanup(srv.Close)
+			t.Setenv("APP_UPDATE_ENCODING", UpdateEncodingBinary)
+			setTestEnv(t, t.TempDir(), 1, "127.0.0.1:1", "1=127.0.0.1:1", srv.URL)
+			backend, err := newAppBackend()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			readyMap := syncx.NewMap[uint64, ShardState]()
+			sm := createStateMachine(0, 1, zerolog.Nop(), backend, &readyMap, &shardProgress{}, func() (uint64, error) { return 0, nil }, nil).(*OnDiskStateMachine)
+			_, err = sm.Open(nil)
+			if tc.wantErr != nil {
+				// The replica fails to open rather than failing every batch
+				if state, _ := readyMap.Load(0); !errors.Is(err, tc.wantErr) || state != ShardStateFailed {
+					t.Fatalf("open returned %v with state %s, want %v", err, state, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := sm.Update([]statemachine.Entry{{Index: 1, Cmd: []byte("a")}}); err != nil {
+				t.Fatal(err)
+			}
+			if contentType != binaryContentType {
+				t.Fatalf("sent /UpdateEntries as %s", contentType)
+			}
+		})
+	}
+}
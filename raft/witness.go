@@ -0,0 +1,46 @@
+package raft
+
+import (
+	"errors"
+	"io"
+
+	"github.com/lni/dragonboat/v4/statemachine"
+)
+
+var ErrWitness = errors.New("witness replicas have no state machine")
+
+// witnessStateMachine is used for witness replicas. Witnesses vote but never receive entries or snapshots, so this
+// never calls the application.
+type witnessStateMachine struct{}
+
+func (w *witnessStateMachine) Open(stopc <-chan struct{}) (uint64, error) {
+	return 0, nil
+}
+
+func (w *witnessStateMachine) Update(entries []statemachine.Entry) ([]statemachine.Entry, error) {
+	return entries, nil
+}
+
+func (w *witnessStateMachine) Lookup(i interface{}) (interface{}, error) {
+	return nil, ErrWitness
+}
+
+func (w *witnessStateMachine) Sync() error {
+	return nil
+}
+
+func (w *witnessStateMachine) PrepareSnapshot() (interface{}, error) {
+	return nil, ErrWitness
+}
+
+func (w *witnessStateMachine) SaveSnapshot(i interface{}, writer io.Writer, i2 <-chan struct{}) error {
+	return ErrWitness
+}
+
+func (w *witnessStateMachine) RecoverFromSnapshot(reader io.Reader, i <-chan struct{}) error {
+	return nil
+}
+
+func (w *witnessStateMachine) Close() error {
+	return nil
+}
@@ -32,6 +32,9 @@ func (m *Map[K, V]) Range(f func(key K, value V) bool) {
 	m.m.Range(func(key, value any) bool { return f(key.(K), value.(V)) })
 }
 func (m *Map[K, V]) Store(key K, value V) { m.m.Store(key, value) }
+func (m *Map[K, V]) CompareAndSwap(key K, old, new V) (swapped bool) {
+	return m.m.CompareAndSwap(key, old, new)
+}
 
 func NewMap[K comparable, V any]() Map[K, V] {
 	return Map[K, V]{
@@ -18,16 +18,16 @@ import (
 )
 
 var (
-	Tracer = otel.Tracer(env.TracingServiceName)
+	Tracer = otel.Tracer(env.Current.TracingServiceName)
 )
 
 // InitTracer creates a new OLTP trace provider instance and registers it as global trace provider.
 func InitTracer(ctx context.Context) (tp *trace.TracerProvider, err error) {
 	logger := zerolog.Ctx(ctx)
 	var exporter trace.SpanExporter
-	if env.OLTPEndpoint != "" {
+	if env.Current.OLTPEndpoint != "" {
 		exporter, err = otlptracegrpc.New(ctx,
-			otlptracegrpc.WithEndpoint(env.OLTPEndpoint),
+			otlptracegrpc.WithEndpoint(env.Current.OLTPEndpoint),
 			otlptracegrpc.WithInsecure(),
 		)
 		if err != nil {
@@ -50,7 +50,7 @@ func InitTracer(ctx context.Context) (tp *trace.TracerProvider, err error) {
 		trace.WithSampler(trace.AlwaysSample()),
 		trace.WithBatcher(exporter),
 		trace.WithResource(resource.NewSchemaless(
-			semconv.ServiceName(env.TracingServiceName),
+			semconv.ServiceName(env.Current.TracingServiceName),
 			semconv.HostName(hostname),
 		)),
 	)